@@ -1,26 +1,36 @@
 package cfg
 
 import (
-	_ "embed"
+	"embed"
 	"fmt"
 	"net/http"
 	"os"
+	"path"
+	"reflect"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/knadh/koanf"
 	"github.com/knadh/koanf/parsers/yaml"
+	"github.com/knadh/koanf/providers/confmap"
 	"github.com/knadh/koanf/providers/env"
 	"github.com/knadh/koanf/providers/file"
 	"github.com/knadh/koanf/providers/posflag"
 	"github.com/knadh/koanf/providers/rawbytes"
+	"github.com/mitchellh/mapstructure"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
 	log "github.com/sirupsen/logrus"
 	flag "github.com/spf13/pflag"
 )
 
 var (
-	//go:embed defaults.yaml
-	DefaultMetrics []byte
+	//go:embed definitions/*.yaml
+	embeddedDefinitions embed.FS
+	// DefaultLanguage is the language of the embedded definitions that are used if no language is configured.
+	DefaultLanguage = "en"
 )
 
 // ParseConfig overrides internal config defaults with an optional YAML file, then environment variables and lastly CLI flags.
@@ -32,24 +42,106 @@ func ParseConfig(version, commit, date string, fs *flag.FlagSet, args []string)
 		fmt.Fprintf(os.Stderr, "Usage of %s (version %s, %s, %s):\n", os.Args[0], version, commit, date)
 		fs.PrintDefaults()
 	}
+	fs.String("config.file", config.Config.File,
+		"YAML file with the configuration, using the flag names as keys, e.g. \"isg: {url: http://isg}\". May also contain the metric definitions under \"definitions\"")
 	fs.String("bindAddr", config.BindAddr, "IP Address to bind to listen for Prometheus scrapes")
 	fs.String("log.level", config.Log.Level, "Logging level")
 	fs.BoolP("log.verbose", "v", config.Log.Verbose, "Shortcut for --log.level=debug")
 	fs.StringSlice("isg.header", []string{},
 		"List of \"key: value\" headers to append to the requests going to Stiebel Eltron ISG")
 	fs.StringP("isg.url", "u", config.ISG.URL, "Target URL of Stiebel Eltron ISG device")
+	fs.String("isg.username", config.ISG.Username, "Username to log in if the web UI of Stiebel Eltron ISG is password-protected")
+	fs.String("isg.password", config.ISG.Password, "Password to log in if the web UI of Stiebel Eltron ISG is password-protected. Prefer the ISG_PASSWORD environment variable")
 	fs.Int64("isg.timeout", int64(config.ISG.Timeout.Seconds()),
 		"Timeout in seconds when collecting metrics from Stiebel Eltron ISG. Should not be larger than the scrape interval")
-	fs.String("isg.definitionPath", "", "Configuration file that may hold translations of metric names. Accepts full and relative path to a .yaml file. If empty, embedded defaults in English are used")
+	fs.Int64("isg.pollInterval", int64(config.ISG.PollInterval.Seconds()),
+		"Interval in seconds in which the exporter polls Stiebel Eltron ISG in the background. Scrapes are then served from the last poll. If 0, each scrape polls the ISG")
+	fs.Int64("isg.maxAge", int64(config.ISG.MaxAge.Seconds()),
+		"Maximum age in seconds of the last successful poll before its values are considered stale and not exported anymore. If 0, three times the poll interval is used")
+	fs.Int("isg.modbusPort", config.ISG.ModbusPort, "TCP port of the Modbus server of Stiebel Eltron ISG. Only used for pages of type modbus")
+	fs.Uint8("isg.modbusUnitID", config.ISG.ModbusUnitID, "Modbus unit identifier of Stiebel Eltron ISG. Only used for pages of type modbus")
+	fs.Bool("isg.discovery", config.ISG.Discovery,
+		"Additionally export every numeric property found in the ISG pages as stiebeleltron_property_value, including properties that aren't in the definitions")
+	fs.String("isg.definitionPath", "", "Configuration file that may hold translations of metric names. Accepts full and relative path to a .yaml file. If empty, embedded defaults in the language given by --isg.language are used")
+	fs.String("isg.language", config.ISG.Language,
+		fmt.Sprintf("Language of the Stiebel Eltron ISG web UI, selects the embedded definitions. One of %s", strings.Join(EmbeddedLanguages(), ", ")))
+	fs.String("isg.decimalSeparator", config.ISG.DecimalSeparator,
+		"Decimal separator of numbers in the Stiebel Eltron ISG web UI, either \",\" or \".\". The other one is the grouping separator of thousands")
+	fs.String("state.path", config.State.Path,
+		"File in which the exporter keeps its state across restarts, e.g. the counters accumulated from daily values. If empty, the state is lost on restart")
+	fs.String("faults.page", config.Faults.Page,
+		"URL suffix of the Stiebel Eltron ISG diagnosis page that lists the faults. If empty, faults are not exported")
+	fs.Bool("faults.history", config.Faults.History,
+		"Keep a history of the faults in memory and serve it as JSON on the /faults endpoint")
+	fs.Int("faults.historySize", config.Faults.HistorySize, "Maximum number of distinct faults kept in the fault history")
+	fs.String("mqtt.broker", config.MQTT.Broker,
+		"URL of an MQTT broker, e.g. tcp://localhost:1883, to which the values are published after each poll. Requires --isg.pollInterval. If empty, nothing is published")
+	fs.String("mqtt.clientID", config.MQTT.ClientID, "Client ID of the exporter at the MQTT broker")
+	fs.String("mqtt.username", config.MQTT.Username, "Username to log in at the MQTT broker")
+	fs.String("mqtt.password", config.MQTT.Password, "Password to log in at the MQTT broker. Prefer the MQTT_PASSWORD environment variable")
+	fs.String("mqtt.topicPrefix", config.MQTT.TopicPrefix, "First level of the MQTT topics to which the values are published")
+	fs.Bool("mqtt.retain", config.MQTT.Retain, "Publish the values as retained messages")
+	fs.Uint8("mqtt.qos", config.MQTT.QoS, "MQTT quality of service level of the published values, 0, 1 or 2")
+	fs.String("mqtt.discoveryPrefix", config.MQTT.DiscoveryPrefix,
+		"Topic prefix of Home Assistant MQTT discovery. If empty, no discovery configs are published")
+	fs.String("mqtt.nodeID", config.MQTT.NodeID, "Identifier of the ISG in Home Assistant, has to be unique if there is more than one ISG")
+	fs.String("influx.url", config.Influx.URL,
+		"Base URL of InfluxDB v2, e.g. http://localhost:8086, to which the values are pushed. Requires --isg.pollInterval. If empty, nothing is pushed")
+	fs.String("influx.org", config.Influx.Org, "InfluxDB organization to push the values to")
+	fs.String("influx.bucket", config.Influx.Bucket, "InfluxDB bucket to push the values to")
+	fs.String("influx.token", config.Influx.Token, "InfluxDB API token with write access to the bucket. Prefer the INFLUX_TOKEN environment variable")
+	fs.Int64("influx.pushInterval", int64(config.Influx.PushInterval.Seconds()),
+		"Interval in seconds in which the values of the polls are pushed to InfluxDB. Values that couldn't be pushed are retried in the next interval")
+	fs.Int("influx.batchSize", config.Influx.BatchSize, "Maximum number of values per write request to InfluxDB")
+	fs.Int("influx.bufferSize", config.Influx.BufferSize,
+		"Maximum number of values kept until they are pushed to InfluxDB. If InfluxDB isn't reachable for long enough, the oldest values are dropped")
+	fs.String("remoteWrite.url", config.RemoteWrite.URL,
+		"Prometheus remote write endpoint, e.g. http://localhost:9090/api/v1/write, to which the values are pushed after each poll. Requires --isg.pollInterval. If empty, nothing is pushed")
+	fs.String("remoteWrite.username", config.RemoteWrite.Username, "Username for basic authentication at the remote write endpoint")
+	fs.String("remoteWrite.password", config.RemoteWrite.Password,
+		"Password for basic authentication at the remote write endpoint. Prefer the REMOTEWRITE_PASSWORD environment variable")
+	fs.String("remoteWrite.bearerToken", config.RemoteWrite.BearerToken,
+		"Bearer token for the remote write endpoint. Prefer the REMOTEWRITE_BEARERTOKEN environment variable")
+	fs.StringSlice("remoteWrite.label", []string{},
+		"List of \"key=value\" labels to add to all series pushed via remote write, e.g. to tell several ISGs apart")
+	fs.Int("remoteWrite.batchSize", config.RemoteWrite.BatchSize, "Maximum number of samples per remote write request")
+	fs.Int("remoteWrite.bufferSize", config.RemoteWrite.BufferSize,
+		"Maximum number of samples kept until they are pushed via remote write. If the endpoint isn't reachable for long enough, the oldest samples are dropped")
+	fs.Int64("remoteWrite.maxBackoff", int64(config.RemoteWrite.MaxBackoff.Seconds()),
+		"Maximum time in seconds to wait between retries of failed remote write requests")
+	fs.String("otlp.endpoint", config.OTLP.Endpoint,
+		"URL of an OTLP receiver, e.g. http://localhost:4318/v1/metrics, to which the values are exported after each poll. Requires --isg.pollInterval. If empty, nothing is exported")
+	fs.String("otlp.protocol", config.OTLP.Protocol, fmt.Sprintf("OTLP protocol, one of %s, %s", OTLPProtocolHTTP, OTLPProtocolGRPC))
+	fs.StringSlice("otlp.header", []string{}, "List of \"key=value\" headers to send to the OTLP receiver, e.g. for authentication")
+	fs.StringSlice("otlp.resourceAttribute", []string{},
+		"List of \"key=value\" attributes to add to the OTLP resource, e.g. deployment.environment=home. The resource always has the attributes isg.url and, if it can be read from the ISG, isg.firmware")
+	fs.String("settings.token", config.Settings.Token,
+		"Bearer token that authorizes changes of the settings in the definitions via the /api/v1/settings endpoint. If empty, the endpoint is disabled. Prefer the SETTINGS_TOKEN environment variable")
+	fs.Bool("settings.dryRun", config.Settings.DryRun, "Validate and audit changes of settings, but don't write them to Stiebel Eltron ISG")
+	fs.String("settings.auditLog", config.Settings.AuditLog,
+		"File to which every change of a setting is appended as a line of JSON. Changes are logged regardless")
+	fs.StringSlice("probe.allowedTargets", []string{},
+		"List of ISG URLs that may be scraped via the /probe endpoint. Targets not in this list are rejected")
 
 	if err := fs.Parse(args); err != nil {
 		log.WithError(err).Fatal("Could not parse flags")
 	}
 
 	k := koanf.New(".")
+	keys := flagKeys(fs)
+
+	configFile, _ := fs.GetString("config.file")
+	if !fs.Changed("config.file") && os.Getenv("CONFIG_FILE") != "" {
+		configFile = os.Getenv("CONFIG_FILE")
+	}
+	if configFile != "" {
+		if err := loadConfigFile(k, configFile, keys); err != nil {
+			log.WithError(err).WithField("file", configFile).Fatal("Could not load config file")
+		}
+	}
 
 	err := k.Load(env.Provider("", ".", func(s string) string {
-		return strings.Replace(strings.ToLower(s), "_", ".", -1)
+		return normalizeKey(strings.Replace(strings.ToLower(s), "_", ".", -1), keys)
 	}), nil)
 	if err != nil {
 		log.WithError(err).Fatal("Could not load environment variables")
@@ -60,11 +152,33 @@ func ParseConfig(version, commit, date string, fs *flag.FlagSet, args []string)
 		log.WithError(err).Fatal("Could not load CLI flags")
 	}
 
-	if err := k.Unmarshal("", config); err != nil {
+	err = k.UnmarshalWithConf("", config, koanf.UnmarshalConf{DecoderConfig: &mapstructure.DecoderConfig{
+		DecodeHook:       mapstructure.ComposeDecodeHookFunc(secondsHookFunc(), mapstructure.StringToTimeDurationHookFunc()),
+		Result:           config,
+		WeaklyTypedInput: true,
+	}})
+	if err != nil {
 		log.WithError(err).Fatal("Could not read config")
 	}
 
-	config.ISG.Timeout *= time.Second
+	if config.ISG.MaxAge == 0 {
+		config.ISG.MaxAge = 3 * config.ISG.PollInterval
+	}
+	if config.Definitions != nil && config.ISG.DefinitionPath != "" {
+		log.Fatal("Metric definitions can be given either inline in the config file or with --isg.definitionPath, not both")
+	}
+	if config.ISG.DecimalSeparator != "," && config.ISG.DecimalSeparator != "." {
+		log.WithField("decimalSeparator", config.ISG.DecimalSeparator).Fatal("Decimal separator must be either \",\" or \".\"")
+	}
+	if config.Influx.URL != "" && (config.Influx.Bucket == "" || config.Influx.PushInterval <= 0) {
+		log.Fatal("Pushing to InfluxDB requires --influx.bucket and a positive --influx.pushInterval")
+	}
+	if config.OTLP.Protocol != OTLPProtocolHTTP && config.OTLP.Protocol != OTLPProtocolGRPC {
+		log.WithField("protocol", config.OTLP.Protocol).Fatal(fmt.Sprintf("OTLP protocol must be one of %s, %s", OTLPProtocolHTTP, OTLPProtocolGRPC))
+	}
+	if config.MQTT.QoS > 2 {
+		log.WithField("qos", config.MQTT.QoS).Fatal("MQTT quality of service must be 0, 1 or 2")
+	}
 	if config.Log.Verbose {
 		config.Log.Level = "debug"
 	}
@@ -76,10 +190,99 @@ func ParseConfig(version, commit, date string, fs *flag.FlagSet, args []string)
 	} else {
 		log.SetLevel(level)
 	}
-	log.WithField("config", *config).Debug("Parsed config")
+	redacted := *config
+	if redacted.ISG.Password != "" {
+		redacted.ISG.Password = "***"
+	}
+	if redacted.MQTT.Password != "" {
+		redacted.MQTT.Password = "***"
+	}
+	if redacted.Influx.Token != "" {
+		redacted.Influx.Token = "***"
+	}
+	if redacted.RemoteWrite.Password != "" {
+		redacted.RemoteWrite.Password = "***"
+	}
+	if redacted.RemoteWrite.BearerToken != "" {
+		redacted.RemoteWrite.BearerToken = "***"
+	}
+	if redacted.Settings.Token != "" {
+		redacted.Settings.Token = "***"
+	}
+	redacted.ISG.Headers = redactHeaders(redacted.ISG.Headers)
+	redacted.OTLP.Headers = redactHeaders(redacted.OTLP.Headers)
+	redacted.Definitions = nil
+	log.WithField("config", redacted).Debug("Parsed config")
 	return config
 }
 
+// redactHeaders returns the given "key=value" headers with the values replaced, as they may hold credentials.
+func redactHeaders(headers []string) []string {
+	if len(headers) == 0 {
+		return headers
+	}
+	redacted := make([]string, len(headers))
+	for i, header := range headers {
+		key, _, _ := strings.Cut(header, "=")
+		redacted[i] = strings.TrimSpace(key) + "=***"
+	}
+	return redacted
+}
+
+// secondsHookFunc decodes plain numbers, e.g. of the flags or in environment variables, into durations in seconds.
+// Other strings are left to mapstructure.StringToTimeDurationHookFunc, e.g. "30s" or "1m".
+func secondsHookFunc() mapstructure.DecodeHookFuncType {
+	return func(from reflect.Type, to reflect.Type, data interface{}) (interface{}, error) {
+		if to != reflect.TypeOf(time.Duration(0)) {
+			return data, nil
+		}
+		switch from.Kind() {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			return time.Duration(reflect.ValueOf(data).Int()) * time.Second, nil
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+			return time.Duration(reflect.ValueOf(data).Uint()) * time.Second, nil
+		case reflect.Float32, reflect.Float64:
+			return time.Duration(reflect.ValueOf(data).Float() * float64(time.Second)), nil
+		case reflect.String:
+			if seconds, err := strconv.ParseInt(data.(string), 10, 64); err == nil {
+				return time.Duration(seconds) * time.Second, nil
+			}
+		}
+		return data, nil
+	}
+}
+
+// flagKeys returns the names of the flags by their lowercase names.
+func flagKeys(fs *flag.FlagSet) map[string]string {
+	keys := map[string]string{}
+	fs.VisitAll(func(f *flag.Flag) {
+		keys[strings.ToLower(f.Name)] = f.Name
+	})
+	return keys
+}
+
+// normalizeKey returns the name of the flag that matches the key regardless of case, or the key itself.
+// This way, a value from the config file or the environment takes precedence over the default of the flag.
+func normalizeKey(key string, keys map[string]string) string {
+	if name, known := keys[strings.ToLower(key)]; known {
+		return name
+	}
+	return key
+}
+
+// loadConfigFile loads the YAML file into k, with the keys normalized to the flag names.
+func loadConfigFile(k *koanf.Koanf, path string, keys map[string]string) error {
+	fk := koanf.New(".")
+	if err := fk.Load(file.Provider(path), yaml.Parser()); err != nil {
+		return err
+	}
+	normalized := map[string]interface{}{}
+	for key, value := range fk.All() {
+		normalized[normalizeKey(key, keys)] = value
+	}
+	return k.Load(confmap.Provider(normalized, "."), nil)
+}
+
 // ConvertHeaders takes a list of `key=value` headers and adds those trimmed to the specified header struct. It ignores
 // any malformed entries.
 func ConvertHeaders(headers []string, header *http.Header) {
@@ -94,17 +297,50 @@ func ConvertHeaders(headers []string, header *http.Header) {
 		}
 		key := strings.TrimSpace(arr[0])
 		value := strings.TrimSpace(arr[1])
-		log.WithFields(log.Fields{
-			"key":   key,
-			"value": value,
-		}).Debug("Using header")
+		// The value isn't logged, as it may hold credentials.
+		log.WithField("key", key).Debug("Using header")
 		header.Set(key, value)
 	}
 }
 
-// LoadMetricDefinitions loads the metrics from configured file path.
-// If the path is empty, embedded defaults are read.
+// ConvertAttributes takes a list of `key=value` attributes and returns those trimmed as map. It ignores
+// any malformed entries.
+func ConvertAttributes(attributes []string) map[string]string {
+	result := map[string]string{}
+	for _, attr := range attributes {
+		arr := strings.SplitN(attr, "=", 2)
+		if len(arr) < 2 {
+			log.WithFields(log.Fields{
+				"arg":   attr,
+				"error": "cannot split: missing equal sign",
+			}).Warn("Could not parse attribute, ignoring")
+			continue
+		}
+		result[strings.TrimSpace(arr[0])] = strings.TrimSpace(arr[1])
+	}
+	return result
+}
+
+// ConvertLabels takes a list of `key=value` labels and returns those trimmed as Prometheus labels. It ignores
+// any malformed entries and invalid label names.
+func ConvertLabels(labels []string) prometheus.Labels {
+	result := prometheus.Labels{}
+	for key, value := range ConvertAttributes(labels) {
+		if !model.LabelName(key).IsValid() {
+			log.WithField("label", key).Warn("Invalid label name, ignoring")
+			continue
+		}
+		result[key] = value
+	}
+	return result
+}
+
+// LoadMetricDefinitions returns the definitions given inline in the config file, or loads them from the configured file path.
+// If neither is given, the embedded definitions of the configured language are read.
 func (configuration *Configuration) LoadMetricDefinitions() *MetricDefinitions {
+	if configuration.Definitions != nil {
+		return configuration.Definitions
+	}
 	def := &MetricDefinitions{}
 	k := koanf.New(".")
 	if configuration.ISG.DefinitionPath != "" {
@@ -113,9 +349,12 @@ func (configuration *Configuration) LoadMetricDefinitions() *MetricDefinitions {
 			log.WithError(err).Fatal("Could not read file")
 		}
 	} else {
-		err := k.Load(rawbytes.Provider(DefaultMetrics), yaml.Parser())
+		b, err := EmbeddedDefinitions(configuration.ISG.Language)
 		if err != nil {
-			log.WithError(err).Fatal("Could not read embedded default file")
+			log.WithError(err).Fatal("Could not read embedded definitions")
+		}
+		if err := k.Load(rawbytes.Provider(b), yaml.Parser()); err != nil {
+			log.WithError(err).Fatal("Could not read embedded definitions")
 		}
 	}
 
@@ -125,3 +364,27 @@ func (configuration *Configuration) LoadMetricDefinitions() *MetricDefinitions {
 
 	return def
 }
+
+// EmbeddedLanguages returns the languages for which definitions are embedded, sorted alphabetically.
+func EmbeddedLanguages() []string {
+	entries, _ := embeddedDefinitions.ReadDir("definitions")
+	languages := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		languages = append(languages, strings.TrimSuffix(entry.Name(), path.Ext(entry.Name())))
+	}
+	sort.Strings(languages)
+	return languages
+}
+
+// EmbeddedDefinitions returns the raw YAML of the embedded definitions in the given language.
+// All embedded definitions produce the same metric names and labels, only the search strings differ.
+func EmbeddedDefinitions(language string) ([]byte, error) {
+	if language == "" {
+		language = DefaultLanguage
+	}
+	b, err := embeddedDefinitions.ReadFile(path.Join("definitions", strings.ToLower(language)+".yaml"))
+	if err != nil {
+		return nil, fmt.Errorf("no embedded definitions for language %q, available: %s", language, strings.Join(EmbeddedLanguages(), ", "))
+	}
+	return b, nil
+}
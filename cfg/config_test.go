@@ -3,11 +3,16 @@ package cfg
 import (
 	"net/http"
 	"os"
+	"path/filepath"
 	"testing"
 	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+	logtest "github.com/sirupsen/logrus/hooks/test"
 	flag "github.com/spf13/pflag"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestConvertHeaders(t *testing.T) {
@@ -69,14 +74,107 @@ func TestConvertHeaders(t *testing.T) {
 	}
 }
 
+func TestConvertHeaders_GivenDebugLevel_ThenDontLogValue(t *testing.T) {
+	hook := logtest.NewGlobal()
+	defer log.StandardLogger().ReplaceHooks(log.LevelHooks{})
+	level := log.GetLevel()
+	log.SetLevel(log.DebugLevel)
+	defer log.SetLevel(level)
+
+	ConvertHeaders([]string{"Authorization=Bearer secret"}, &http.Header{})
+
+	require.Len(t, hook.AllEntries(), 1)
+	entry := hook.LastEntry()
+	assert.Equal(t, log.Fields{"key": "Authorization"}, entry.Data)
+	assert.NotContains(t, entry.Message, "secret")
+}
+
+func TestConvertAttributes(t *testing.T) {
+	tests := []struct {
+		name       string
+		attributes []string
+		expected   map[string]string
+	}{
+		{
+			name:       "WhenInvalidEntry_ThenIgnore",
+			attributes: []string{"invalid"},
+			expected:   map[string]string{},
+		},
+		{
+			name:       "GivenValidEntries_WhenSpacesAroundValues_ThenTrim",
+			attributes: []string{" isg.firmware = 12.0.0 ", "deployment.environment=home"},
+			expected:   map[string]string{"isg.firmware": "12.0.0", "deployment.environment": "home"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, ConvertAttributes(tt.attributes))
+		})
+	}
+}
+
+func TestRedactHeaders(t *testing.T) {
+	tests := []struct {
+		name     string
+		headers  []string
+		expected []string
+	}{
+		{
+			name: "GivenNoHeaders_ThenReturnNone",
+		},
+		{
+			name:     "GivenHeaders_ThenReplaceValues",
+			headers:  []string{"Authorization=Bearer secret", " X-Api-Key = secret", "invalid"},
+			expected: []string{"Authorization=***", "X-Api-Key=***", "invalid=***"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, redactHeaders(tt.headers))
+		})
+	}
+}
+
+func TestConvertLabels(t *testing.T) {
+	tests := []struct {
+		name     string
+		labels   []string
+		expected prometheus.Labels
+	}{
+		{
+			name:     "WhenEmptyArray_ThenReturnEmptyLabels",
+			labels:   []string{},
+			expected: prometheus.Labels{},
+		},
+		{
+			name:     "WhenInvalidEntry_ThenIgnore",
+			labels:   []string{"invalid", "in-valid=name"},
+			expected: prometheus.Labels{},
+		},
+		{
+			name:     "GivenValidEntries_WhenSpacesAroundValues_ThenTrim",
+			labels:   []string{" instance = isg-1 ", "site=home"},
+			expected: prometheus.Labels{"instance": "isg-1", "site": "home"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, ConvertLabels(tt.labels))
+		})
+	}
+}
+
 func TestParseConfig(t *testing.T) {
 	tests := []struct {
-		name   string
-		args   []string
-		envs   map[string]string
-		want   *Configuration
-		fs     flag.FlagSet
-		verify func(c *Configuration)
+		name string
+		args []string
+		envs map[string]string
+		// file is the content of a config file that is passed with --config.file, or with CONFIG_FILE if fileViaEnv is set.
+		file       string
+		fileViaEnv bool
+		want       *Configuration
+		fs         flag.FlagSet
+		verify     func(c *Configuration)
 	}{
 		{
 			name: "GivenNoFlags_ThenReturnDefaultConfig",
@@ -148,6 +246,20 @@ func TestParseConfig(t *testing.T) {
 				assert.Equal(t, "myurl", c.ISG.URL)
 			},
 		},
+		{
+			name: "GivenNoLanguageFlag_ThenUseDefaultLanguage",
+			args: []string{},
+			verify: func(c *Configuration) {
+				assert.Equal(t, "en", c.ISG.Language)
+			},
+		},
+		{
+			name: "GivenLanguageFlag_ThenOverrideDefault",
+			args: []string{"--isg.language", "de"},
+			verify: func(c *Configuration) {
+				assert.Equal(t, "de", c.ISG.Language)
+			},
+		},
 		{
 			name: "GivenTimeoutFlag_WhenSpecified_ThenOverrideDefault",
 			args: []string{"--isg.timeout", "3"},
@@ -155,13 +267,174 @@ func TestParseConfig(t *testing.T) {
 				assert.Equal(t, 3*time.Second, c.ISG.Timeout)
 			},
 		},
+		{
+			name: "GivenPollIntervalFlag_WhenMaxAgeNotSpecified_ThenDeriveMaxAge",
+			args: []string{"--isg.pollInterval", "30"},
+			verify: func(c *Configuration) {
+				assert.Equal(t, 30*time.Second, c.ISG.PollInterval)
+				assert.Equal(t, 90*time.Second, c.ISG.MaxAge)
+			},
+		},
+		{
+			name: "GivenPollIntervalFlag_WhenMaxAgeSpecified_ThenOverrideDefault",
+			args: []string{"--isg.pollInterval", "30", "--isg.maxAge", "45"},
+			verify: func(c *Configuration) {
+				assert.Equal(t, 30*time.Second, c.ISG.PollInterval)
+				assert.Equal(t, 45*time.Second, c.ISG.MaxAge)
+			},
+		},
+		{
+			name: "GivenRemoteWriteFlags_ThenFillLabelsAndConvertMaxBackoff",
+			args: []string{"--remoteWrite.url", "http://localhost:9090/api/v1/write", "--remoteWrite.label", "instance=isg-1",
+				"--remoteWrite.maxBackoff", "10"},
+			verify: func(c *Configuration) {
+				assert.Equal(t, "http://localhost:9090/api/v1/write", c.RemoteWrite.URL)
+				assert.Equal(t, []string{"instance=isg-1"}, c.RemoteWrite.Labels)
+				assert.Equal(t, 10*time.Second, c.RemoteWrite.MaxBackoff)
+			},
+		},
+		{
+			name: "GivenOTLPFlags_ThenFillResourceAttributes",
+			args: []string{"--otlp.endpoint", "http://localhost:4317", "--otlp.protocol", "grpc",
+				"--otlp.resourceAttribute", "isg.firmware=12.0.0"},
+			verify: func(c *Configuration) {
+				assert.Equal(t, "http://localhost:4317", c.OTLP.Endpoint)
+				assert.Equal(t, "grpc", c.OTLP.Protocol)
+				assert.Equal(t, []string{"isg.firmware=12.0.0"}, c.OTLP.ResourceAttributes)
+			},
+		},
+		{
+			name: "GivenCamelCaseEnvVar_ThenOverrideDefault",
+			envs: map[string]string{"ISG_POLLINTERVAL": "20"},
+			verify: func(c *Configuration) {
+				assert.Equal(t, 20*time.Second, c.ISG.PollInterval)
+			},
+		},
+		{
+			name: "GivenConfigFile_ThenOverrideDefaults",
+			file: "isg:\n  url: http://isg.local\n  pollInterval: 30\n  header:\n    - key1=value1\nmqtt:\n  retain: false\n",
+			verify: func(c *Configuration) {
+				assert.Equal(t, "http://isg.local", c.ISG.URL)
+				assert.Equal(t, 30*time.Second, c.ISG.PollInterval)
+				assert.Equal(t, []string{"key1=value1"}, c.ISG.Headers)
+				assert.False(t, c.MQTT.Retain)
+				assert.Equal(t, "info", c.Log.Level)
+			},
+		},
+		{
+			name:       "GivenConfigFileInEnvVar_ThenOverrideDefaults",
+			file:       "isg:\n  url: http://isg.local\n",
+			fileViaEnv: true,
+			verify: func(c *Configuration) {
+				assert.Equal(t, "http://isg.local", c.ISG.URL)
+			},
+		},
+		{
+			name: "GivenConfigFileWithLowercaseKeys_ThenOverrideDefaults",
+			file: "isg:\n  pollinterval: 30\n",
+			verify: func(c *Configuration) {
+				assert.Equal(t, 30*time.Second, c.ISG.PollInterval)
+			},
+		},
+		{
+			name: "GivenConfigFileAndEnvVar_ThenPreferEnvVar",
+			file: "isg:\n  url: http://file\n  pollInterval: 30\n",
+			envs: map[string]string{"ISG_URL": "http://env", "ISG_POLLINTERVAL": "20"},
+			verify: func(c *Configuration) {
+				assert.Equal(t, "http://env", c.ISG.URL)
+				assert.Equal(t, 20*time.Second, c.ISG.PollInterval)
+			},
+		},
+		{
+			name: "GivenConfigFileAndEnvVarAndFlag_ThenPreferFlag",
+			file: "isg:\n  url: http://file\n",
+			envs: map[string]string{"ISG_URL": "http://env"},
+			args: []string{"--isg.url", "http://flag"},
+			verify: func(c *Configuration) {
+				assert.Equal(t, "http://flag", c.ISG.URL)
+			},
+		},
+		{
+			name: "GivenConfigFileWithDefinitions_ThenUseInlineDefinitions",
+			file: `
+isg:
+  url: http://isg.local
+definitions:
+  language: de
+  pages:
+    info:
+      urlSuffix: "?s=1,0"
+      groups:
+        temperature:
+          searchString: TEMPERATUREN
+          metrics:
+            - name: outside
+              searchString: AUSSENTEMPERATUR
+              unit: celsius
+`,
+			verify: func(c *Configuration) {
+				definitions := c.LoadMetricDefinitions()
+				assert.Equal(t, "de", definitions.Language)
+				assert.Equal(t, "?s=1,0", definitions.Pages["info"].URLSuffix)
+				assert.Equal(t, []Metric{{Name: "outside", SearchString: "AUSSENTEMPERATUR", Unit: "celsius"}},
+					definitions.Pages["info"].Groups["temperature"].Metrics)
+			},
+		},
+		{
+			name: "GivenConfigFileWithoutDefinitions_ThenUseEmbeddedDefinitions",
+			file: "isg:\n  language: de\n",
+			verify: func(c *Configuration) {
+				assert.Nil(t, c.Definitions)
+				assert.Equal(t, "de", c.LoadMetricDefinitions().Language)
+			},
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			setEnv(tt.envs)
-			result := ParseConfig("version", "commit", "date", &tt.fs, tt.args)
+			args := tt.args
+			envs := tt.envs
+			if tt.file != "" {
+				path := filepath.Join(t.TempDir(), "config.yaml")
+				require.NoError(t, os.WriteFile(path, []byte(tt.file), 0644))
+				if tt.fileViaEnv {
+					envs = map[string]string{"CONFIG_FILE": path}
+				} else {
+					args = append([]string{"--config.file", path}, args...)
+				}
+			}
+			setEnv(envs)
+			result := ParseConfig("version", "commit", "date", &tt.fs, args)
 			tt.verify(result)
-			unsetEnv(tt.envs)
+			unsetEnv(envs)
+		})
+	}
+}
+
+func TestParseConfig_GivenDurationInConfigFile_ThenDecodeDuration(t *testing.T) {
+	tests := []struct {
+		name     string
+		value    string
+		expected time.Duration
+	}{
+		{name: "GivenNumber_ThenUseSeconds", value: "30", expected: 30 * time.Second},
+		{name: "GivenNumberAsString_ThenUseSeconds", value: `"30"`, expected: 30 * time.Second},
+		{name: "GivenDurationInSeconds_ThenUseDuration", value: `"30s"`, expected: 30 * time.Second},
+		{name: "GivenDurationInMinutes_ThenUseDuration", value: `"1m"`, expected: time.Minute},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "config.yaml")
+			file := "isg:\n  pollInterval: " + tt.value + "\n  timeout: " + tt.value + "\ninflux:\n  pushInterval: " + tt.value +
+				"\nremoteWrite:\n  maxBackoff: " + tt.value + "\n"
+			require.NoError(t, os.WriteFile(path, []byte(file), 0644))
+
+			c := ParseConfig("version", "commit", "date", &flag.FlagSet{}, []string{"--config.file", path})
+
+			assert.Equal(t, tt.expected, c.ISG.PollInterval)
+			assert.Equal(t, 3*tt.expected, c.ISG.MaxAge)
+			assert.Equal(t, tt.expected, c.ISG.Timeout)
+			assert.Equal(t, tt.expected, c.Influx.PushInterval)
+			assert.Equal(t, tt.expected, c.RemoteWrite.MaxBackoff)
 		})
 	}
 }
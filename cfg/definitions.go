@@ -0,0 +1,227 @@
+package cfg
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+
+	"github.com/ccremer/stiebeleltron-exporter/pkg/stiebeleltron"
+	"gopkg.in/yaml.v3"
+)
+
+var transliterations = strings.NewReplacer(
+	"ä", "ae", "ö", "oe", "ü", "ue", "ß", "ss",
+	"à", "a", "á", "a", "â", "a", "ç", "c", "è", "e", "é", "e", "ê", "e", "ë", "e",
+	"ì", "i", "í", "i", "î", "i", "ï", "i", "ò", "o", "ó", "o", "ô", "o", "ù", "u", "ú", "u", "û", "u",
+)
+
+// AddDiscoveredProperties adds the given properties of a page to the definitions, unless they're already defined.
+// Pages are matched by URL suffix or name, groups by their search string, so that existing names are kept.
+// It returns the number of added metrics.
+func (definitions *MetricDefinitions) AddDiscoveredProperties(pageName, urlSuffix string, props []stiebeleltron.DiscoveredProperty) int {
+	if definitions.Pages == nil {
+		definitions.Pages = map[string]Page{}
+	}
+	pageName = definitions.findPageName(pageName, urlSuffix)
+	page, exists := definitions.Pages[pageName]
+	if !exists {
+		page = Page{URLSuffix: urlSuffix}
+	}
+	if page.Groups == nil {
+		page.Groups = map[string]Group{}
+	}
+
+	added := 0
+	for _, prop := range props {
+		groupName := page.findGroupName(prop.Group)
+		group := page.Groups[groupName]
+		group.SearchString = prop.Group
+		if group.hasSearchString(prop.Name) {
+			continue
+		}
+		metric := Metric{
+			Name:         group.uniqueMetricName(ToMetricName(prop.Name)),
+			Description:  describeProperty(prop),
+			SearchString: prop.Name,
+		}
+		group.Metrics = append(group.Metrics, metric)
+		page.Groups[groupName] = group
+		added++
+	}
+	definitions.Pages[pageName] = page
+	return added
+}
+
+// ToYAML returns the definitions in the same format as they are loaded.
+func (definitions MetricDefinitions) ToYAML() ([]byte, error) {
+	var b strings.Builder
+	enc := yaml.NewEncoder(&b)
+	enc.SetIndent(2)
+	if err := enc.Encode(definitions); err != nil {
+		return nil, err
+	}
+	if err := enc.Close(); err != nil {
+		return nil, err
+	}
+	return []byte(b.String()), nil
+}
+
+// ToMetricName converts the given text of the ISG web UI into a snake_case name that is valid in Prometheus metric names.
+func ToMetricName(s string) string {
+	s = transliterations.Replace(strings.ToLower(s))
+	var b strings.Builder
+	underscore := false
+	for _, r := range s {
+		if r < unicode.MaxASCII && (unicode.IsLetter(r) || unicode.IsDigit(r)) {
+			b.WriteRune(r)
+			underscore = false
+			continue
+		}
+		if !underscore && b.Len() > 0 {
+			b.WriteRune('_')
+			underscore = true
+		}
+	}
+	return strings.TrimSuffix(b.String(), "_")
+}
+
+func (definitions *MetricDefinitions) findPageName(pageName, urlSuffix string) string {
+	if _, exists := definitions.Pages[pageName]; exists {
+		return pageName
+	}
+	for name, page := range definitions.Pages {
+		if urlSuffix != "" && page.URLSuffix == urlSuffix {
+			return name
+		}
+	}
+	return pageName
+}
+
+func (page Page) findGroupName(searchString string) string {
+	for name, group := range page.Groups {
+		if group.SearchString == searchString {
+			return name
+		}
+	}
+	name := ToMetricName(searchString)
+	for i := 2; ; i++ {
+		if _, exists := page.Groups[name]; !exists {
+			return name
+		}
+		name = fmt.Sprintf("%s_%d", ToMetricName(searchString), i)
+	}
+}
+
+func (group Group) hasSearchString(searchString string) bool {
+	for _, metric := range group.Metrics {
+		if metric.SearchString == searchString {
+			return true
+		}
+	}
+	return false
+}
+
+func (group Group) uniqueMetricName(name string) string {
+	unique := name
+	for i := 2; ; i++ {
+		exists := false
+		for _, metric := range group.Metrics {
+			exists = exists || metric.Name == unique
+		}
+		if !exists {
+			return unique
+		}
+		unique = fmt.Sprintf("%s_%d", name, i)
+	}
+}
+
+// describeProperty returns a description including the unit of the value, e.g. "outside temperature in °C".
+func describeProperty(prop stiebeleltron.DiscoveredProperty) string {
+	description := strings.ToLower(prop.Name)
+	if !prop.Numeric || prop.Unit == "" {
+		return description
+	}
+	return fmt.Sprintf("%s in %s", description, prop.Unit)
+}
+
+// DetectLanguage returns the language of the embedded definitions whose groups match most of the given group headers.
+// It returns an empty string if none of the embedded definitions match any group.
+func DetectLanguage(groups []string) string {
+	detected, maxMatches := "", 0
+	for _, language := range EmbeddedLanguages() {
+		definitions, err := parseEmbeddedDefinitions(language)
+		if err != nil {
+			continue
+		}
+		if matches := definitions.CountMatchingGroups(groups); matches > maxMatches {
+			detected, maxMatches = language, matches
+		}
+	}
+	return detected
+}
+
+// CountMatchingGroups returns how many of the given group headers are searched for in the definitions.
+func (definitions MetricDefinitions) CountMatchingGroups(groups []string) int {
+	searchStrings := map[string]bool{}
+	for _, page := range definitions.Pages {
+		for _, group := range page.Groups {
+			searchStrings[group.SearchString] = true
+		}
+	}
+	matches := 0
+	for _, group := range groups {
+		if searchStrings[group] {
+			matches++
+		}
+	}
+	return matches
+}
+
+// ExpectedLanguage returns the language of the ISG web UI that the definitions are written for.
+// If the definitions don't declare a language, it is detected from their group search strings.
+func (definitions MetricDefinitions) ExpectedLanguage() string {
+	if definitions.Language != "" {
+		return definitions.Language
+	}
+	if detected := DetectLanguage(definitions.groupSearchStrings()); detected != "" {
+		return detected
+	}
+	return "unknown"
+}
+
+// groupSearchStrings returns the search strings of all groups in the definitions.
+func (definitions MetricDefinitions) groupSearchStrings() []string {
+	var groups []string
+	for _, page := range definitions.Pages {
+		for _, group := range page.Groups {
+			groups = append(groups, group.SearchString)
+		}
+	}
+	return groups
+}
+
+// VerifyLanguage returns an error if none of the given group headers found in the ISG web UI are in the definitions.
+// In that case, no metric could be parsed, most likely because the ISG web UI is in another language.
+// The error names the detected language and the language the definitions expect.
+func (definitions MetricDefinitions) VerifyLanguage(groups []string) error {
+	if len(groups) == 0 || definitions.CountMatchingGroups(groups) > 0 {
+		return nil
+	}
+	expected := definitions.ExpectedLanguage()
+	detected := DetectLanguage(groups)
+	if detected == "" {
+		return fmt.Errorf("none of the groups found in the ISG web UI are in the definitions written for language %q, the language of the ISG is unknown: %s",
+			expected, strings.Join(groups, ", "))
+	}
+	return fmt.Errorf("the ISG web UI is in language %q, but the definitions are written for language %q: set --isg.language=%s or provide matching definitions with --isg.definitionPath",
+		detected, expected, detected)
+}
+
+func parseEmbeddedDefinitions(language string) (*MetricDefinitions, error) {
+	b, err := EmbeddedDefinitions(language)
+	if err != nil {
+		return nil, err
+	}
+	definitions := &MetricDefinitions{}
+	return definitions, yaml.Unmarshal(b, definitions)
+}
@@ -0,0 +1,517 @@
+package cfg
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/ccremer/stiebeleltron-exporter/pkg/metrics"
+	"github.com/ccremer/stiebeleltron-exporter/pkg/stiebeleltron"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestToMetricName(t *testing.T) {
+	tests := map[string]string{
+		"RNT COMP 1 HEA":          "rnt_comp_1_hea",
+		"CONDENSER TEMP.":         "condenser_temp",
+		"PRESSURE HTG CIRC":       "pressure_htg_circ",
+		"WÄRMEMENGE":              "waermemenge",
+		"TEMPÉRATURE EXTÉRIEURE":  "temperature_exterieure",
+		"  VD HEIZEN / SUMME  ":   "vd_heizen_summe",
+		"LEISTUNG (WP)":           "leistung_wp",
+		"ANZAHL ABTAUUNGEN NHZ 1": "anzahl_abtauungen_nhz_1",
+	}
+	for input, expected := range tests {
+		t.Run(input, func(t *testing.T) {
+			assert.Equal(t, expected, ToMetricName(input))
+		})
+	}
+}
+
+func TestMetricDefinitions_AddDiscoveredProperties(t *testing.T) {
+	f, err := os.Open("../pkg/stiebeleltron/testdata/heatpumpinfo_1.html")
+	require.NoError(t, err)
+	defer f.Close()
+	props, err := stiebeleltron.DiscoverDocument(f, stiebeleltron.DefaultNumberFormat)
+	require.NoError(t, err)
+
+	tests := []struct {
+		name          string
+		definitions   *MetricDefinitions
+		expectedAdded int
+		verify        func(d *MetricDefinitions)
+	}{
+		{
+			name:          "GivenEmptyDefinitions_ThenAddAllProperties",
+			definitions:   &MetricDefinitions{},
+			expectedAdded: 10,
+			verify: func(d *MetricDefinitions) {
+				require.Contains(t, d.Pages, "heatpump")
+				page := d.Pages["heatpump"]
+				assert.Equal(t, "?s=1,1", page.URLSuffix)
+				require.Contains(t, page.Groups, "amount_of_heat")
+				group := page.Groups["amount_of_heat"]
+				assert.Equal(t, "AMOUNT OF HEAT", group.SearchString)
+				assert.Equal(t, Metric{
+					Name:         "compressor_heating_day",
+					Description:  "compressor heating day in kWh",
+					SearchString: "COMPRESSOR HEATING DAY",
+				}, group.Metrics[0])
+			},
+		},
+		{
+			name: "GivenExistingDefinitions_ThenOnlyAddMissingProperties",
+			definitions: &MetricDefinitions{Pages: map[string]Page{
+				"hp": {URLSuffix: "?s=1,1", Groups: map[string]Group{
+					"runtime": {SearchString: "RUNTIME", Metrics: []Metric{
+						{Name: "compressor", SearchString: "RNT COMP 1 HEA"},
+						{Name: "bh_1", SearchString: "SOMETHING ELSE"},
+					}},
+				}},
+			}},
+			expectedAdded: 9,
+			verify: func(d *MetricDefinitions) {
+				assert.NotContains(t, d.Pages, "heatpump")
+				group := d.Pages["hp"].Groups["runtime"]
+				require.Len(t, group.Metrics, 5)
+				assert.Equal(t, "compressor", group.Metrics[0].Name)
+				assert.Equal(t, "rnt_comp_1_dhw", group.Metrics[2].Name)
+				assert.Equal(t, "bh_1_2", group.Metrics[3].Name)
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			added := tt.definitions.AddDiscoveredProperties("heatpump", "?s=1,1", props)
+			assert.Equal(t, tt.expectedAdded, added)
+			tt.verify(tt.definitions)
+		})
+	}
+}
+
+func TestEmbeddedDefinitions_GivenAllLanguages_ThenProduceSameMetrics(t *testing.T) {
+	toMetricKeys := func(d *MetricDefinitions) []string {
+		var keys []string
+		pages, err := d.MapToPrometheusMetric()
+		require.NoError(t, err)
+		for _, page := range pages {
+			for _, m := range page.Metrics {
+				keys = append(keys, m.Desc.String())
+			}
+		}
+		sort.Strings(keys)
+		return keys
+	}
+	config := NewDefaultExporterConfig()
+	expected := toMetricKeys(config.LoadMetricDefinitions())
+	require.NotEmpty(t, expected)
+
+	languages := EmbeddedLanguages()
+	assert.Equal(t, []string{"de", "en", "fr", "it", "nl"}, languages)
+	for _, language := range languages {
+		t.Run(language, func(t *testing.T) {
+			config.ISG.Language = language
+			definitions := config.LoadMetricDefinitions()
+			assert.Equal(t, language, definitions.Language)
+			assert.Equal(t, expected, toMetricKeys(definitions))
+			assert.Equal(t, language, DetectLanguage(definitions.groupSearchStrings()), "group headers should identify the language")
+		})
+	}
+}
+
+func TestEmbeddedDefinitions_GivenTotalAmountsOfHeat_ThenExportCounters(t *testing.T) {
+	config := NewDefaultExporterConfig()
+	for _, language := range EmbeddedLanguages() {
+		t.Run(language, func(t *testing.T) {
+			config.ISG.Language = language
+			pages, err := config.LoadMetricDefinitions().MapToPrometheusMetric()
+			require.NoError(t, err)
+			var totals []*metrics.PrometheusMetric
+			for _, page := range pages {
+				for _, m := range page.Metrics {
+					if m.Group == "energy" && m.GaugeName == "heating_joules" {
+						totals = append(totals, m)
+					}
+				}
+			}
+			require.Len(t, totals, 3)
+			for _, m := range totals {
+				assert.Equal(t, "stiebeleltron_energy_heating_joules_total", m.FQName())
+				assert.True(t, m.IsCounter())
+				assert.Equal(t, "joules", m.Unit)
+			}
+		})
+	}
+}
+
+func TestEmbeddedDefinitions_GivenUnknownLanguage_ThenReturnError(t *testing.T) {
+	_, err := EmbeddedDefinitions("xx")
+	assert.ErrorContains(t, err, `no embedded definitions for language "xx", available: de, en, fr, it, nl`)
+}
+
+func TestMetricDefinitions_VerifyLanguage(t *testing.T) {
+	english := NewDefaultExporterConfig().LoadMetricDefinitions()
+	custom := &MetricDefinitions{Pages: map[string]Page{
+		"heatpump": {Groups: map[string]Group{"runtime": {SearchString: "LAUFZEIT"}}},
+	}}
+	tests := []struct {
+		name          string
+		definitions   *MetricDefinitions
+		groups        []string
+		expectedError string
+	}{
+		{
+			name:        "GivenNoGroups_ThenSkipVerification",
+			definitions: english,
+		},
+		{
+			name:        "GivenMatchingGroups_ThenReturnNil",
+			definitions: english,
+			groups:      []string{"PROCESS DATA", "AMOUNT OF HEAT", "RUNTIME"},
+		},
+		{
+			name:          "GivenGermanGroups_WhenEnglishDefinitions_ThenReturnDetectedLanguage",
+			definitions:   english,
+			groups:        []string{"PROZESSDATEN", "WÄRMEMENGE", "LAUFZEIT"},
+			expectedError: `the ISG web UI is in language "de", but the definitions are written for language "en": set --isg.language=de`,
+		},
+		{
+			name:          "GivenEnglishGroups_WhenCustomGermanDefinitions_ThenDetectExpectedLanguage",
+			definitions:   custom,
+			groups:        []string{"PROCESS DATA", "AMOUNT OF HEAT", "RUNTIME"},
+			expectedError: `the ISG web UI is in language "en", but the definitions are written for language "de"`,
+		},
+		{
+			name:          "GivenUnknownGroups_ThenReturnUnknownLanguage",
+			definitions:   english,
+			groups:        []string{"DURATA DI FUNZIONAMENTO"},
+			expectedError: `none of the groups found in the ISG web UI are in the definitions written for language "en", the language of the ISG is unknown: DURATA DI FUNZIONAMENTO`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.definitions.VerifyLanguage(tt.groups)
+			if tt.expectedError == "" {
+				assert.NoError(t, err)
+				return
+			}
+			assert.ErrorContains(t, err, tt.expectedError)
+		})
+	}
+}
+
+func TestMetricDefinitions_MapToPrometheusMetric(t *testing.T) {
+	tests := []struct {
+		name          string
+		yaml          string
+		value         float64
+		expected      float64
+		expectedError string
+	}{
+		{
+			name: "GivenTransforms_ThenApplyInOrder",
+			yaml: `
+          - name: temperature
+            transforms:
+              - divide: 10
+              - clamp:
+                  min: 0
+              - round: 0
+`,
+			value:    215,
+			expected: 22,
+		},
+		{
+			name: "GivenMultiplierAndDivisor_ThenApplyBoth",
+			yaml: `
+          - name: temperature
+            multiplier: 3600
+            divisor: 60
+`,
+			value:    2,
+			expected: 120,
+		},
+		{
+			name: "GivenDivisionByZero_ThenReturnError",
+			yaml: `
+          - name: temperature
+            transforms:
+              - divide: 0
+`,
+			expectedError: "metric page/group/temperature: transform step 1: cannot divide by 0",
+		},
+		{
+			name: "GivenTransformsAndMultiplier_ThenReturnError",
+			yaml: `
+          - name: temperature
+            multiplier: 10
+            transforms:
+              - divide: 10
+`,
+			expectedError: "transforms can't be combined with multiplier or divisor",
+		},
+		{
+			name: "GivenStatesAndCodes_ThenReturnError",
+			yaml: `
+          - name: temperature
+            states:
+              ECO MODE: eco
+            codes:
+              "ON": 1
+`,
+			expectedError: "states and codes can't be combined",
+		},
+		{
+			name: "GivenStatesAndUnit_ThenReturnError",
+			yaml: `
+          - name: temperature
+            unit: celsius
+            states:
+              ECO MODE: eco
+`,
+			expectedError: "states and codes can't be combined with type counter, reset, unit or transforms",
+		},
+		{
+			name: "GivenDailyResetOnCounter_ThenReturnError",
+			yaml: `
+          - name: heating_total
+            type: counter
+            reset: daily
+`,
+			expectedError: `unknown reset "daily" on metric of type counter, must be daily on metrics of type gauge`,
+		},
+		{
+			name: "GivenDailyResetAndCounterWithAccumulatedName_ThenReturnError",
+			yaml: `
+          - name: heating_accumulated
+            searchString: HEATING
+          - name: heating_total
+            reset: daily
+`,
+			expectedError: "metrics with the same name must be of the same type, found gauge and counter",
+		},
+		{
+			name: "GivenUnknownType_ThenReturnError",
+			yaml: `
+          - name: temperature
+            type: histogram
+`,
+			expectedError: `unknown type "histogram"`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "definitions.yaml")
+			require.NoError(t, os.WriteFile(path, []byte(`
+pages:
+  page:
+    groups:
+      group:
+        metrics:`+tt.yaml), 0o600))
+			config := NewDefaultExporterConfig()
+			config.ISG.DefinitionPath = path
+
+			pages, err := config.LoadMetricDefinitions().MapToPrometheusMetric()
+			if tt.expectedError != "" {
+				assert.ErrorContains(t, err, tt.expectedError)
+				return
+			}
+			require.NoError(t, err)
+			require.Len(t, pages, 1)
+			require.Len(t, pages[0].Metrics, 1)
+			assert.Equal(t, tt.expected, pages[0].Metrics[0].Transform(tt.value))
+		})
+	}
+}
+
+func TestMetricDefinitions_MapToPrometheusMetric_GivenModbusPage(t *testing.T) {
+	tests := []struct {
+		name          string
+		yaml          string
+		expectedError string
+	}{
+		{
+			name: "GivenRegister_ThenReturnMetric",
+			yaml: `
+          - name: outside
+            register: 507
+            registerType: input
+            dataType: int16
+            transforms:
+              - divide: 10
+`,
+		},
+		{
+			name: "GivenNoRegister_ThenReturnError",
+			yaml: `
+          - name: outside
+`,
+			expectedError: "metric system/temperature/outside: register is required in pages of type modbus",
+		},
+		{
+			name: "GivenUnknownRegisterType_ThenReturnError",
+			yaml: `
+          - name: outside
+            register: 507
+            registerType: inputs
+`,
+			expectedError: "unsupported register type: inputs, must be one of input, holding",
+		},
+		{
+			name: "GivenUnknownDataType_ThenReturnError",
+			yaml: `
+          - name: outside
+            register: 507
+            dataType: int32
+`,
+			expectedError: "unsupported data type: int32, must be one of int16, uint16",
+		},
+		{
+			name: "GivenUnit_ThenReturnError",
+			yaml: `
+          - name: outside
+            register: 507
+            unit: celsius
+`,
+			expectedError: "unit can't be converted in pages of type modbus, use transforms instead",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "definitions.yaml")
+			require.NoError(t, os.WriteFile(path, []byte(`
+pages:
+  system:
+    type: modbus
+    groups:
+      temperature:
+        metrics:`+tt.yaml), 0o600))
+			config := NewDefaultExporterConfig()
+			config.ISG.DefinitionPath = path
+
+			pages, err := config.LoadMetricDefinitions().MapToPrometheusMetric()
+			if tt.expectedError != "" {
+				assert.ErrorContains(t, err, tt.expectedError)
+				return
+			}
+			require.NoError(t, err)
+			require.Len(t, pages, 1)
+			require.Len(t, pages[0].Metrics, 1)
+			assert.Equal(t, uint16(507), pages[0].Metrics[0].Register)
+		})
+	}
+}
+
+func TestConfiguration_LoadMetricDefinitions_GivenStates(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "definitions.yaml")
+	require.NoError(t, os.WriteFile(path, []byte(`
+pages:
+  page:
+    groups:
+      status:
+        metrics:
+          - name: operating_mode
+            searchString: OPERATING MODE
+            states:
+              ECO MODE: eco
+              AUTOMATIC: automatic
+          - name: compressor_running
+            searchString: COMPRESSOR
+            codes:
+              "ON": 1
+              "OFF": 0
+`), 0o600))
+	config := NewDefaultExporterConfig()
+	config.ISG.DefinitionPath = path
+
+	pages, err := config.LoadMetricDefinitions().MapToPrometheusMetric()
+	require.NoError(t, err)
+	require.Len(t, pages, 1)
+	for _, m := range pages[0].Metrics {
+		switch m.GaugeName {
+		case "operating_mode":
+			assert.Equal(t, map[string]string{"ECO MODE": "eco", "AUTOMATIC": "automatic"}, m.States)
+			assert.Equal(t, []string{"automatic", "eco"}, m.StateNames())
+		case "compressor_running":
+			assert.Equal(t, map[string]float64{"ON": 1, "OFF": 0}, m.Codes)
+		}
+	}
+}
+
+func TestConfiguration_LoadMetricDefinitions_GivenSettings(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "definitions.yaml")
+	require.NoError(t, os.WriteFile(path, []byte(`
+pages: {}
+settings:
+  - name: dhw_set_temperature
+    id: val22
+    min: 10
+    max: 65
+    step: 0.5
+  - name: operating_mode
+    id: val39s
+    options:
+      eco: "11"
+      standby: "1"
+`), 0o600))
+	config := NewDefaultExporterConfig()
+	config.ISG.DefinitionPath = path
+
+	definitions := config.LoadMetricDefinitions()
+	require.NoError(t, definitions.VerifySettings())
+	require.Len(t, definitions.Settings, 2)
+	assert.Equal(t, "val22", definitions.Settings[0].ID)
+	assert.Equal(t, 65.0, *definitions.Settings[0].Max)
+	assert.Equal(t, 0.5, definitions.Settings[0].Step)
+	assert.Equal(t, map[string]string{"eco": "11", "standby": "1"}, definitions.Settings[1].Options)
+}
+
+func TestMetricDefinitions_VerifySettings(t *testing.T) {
+	min, max := 10.0, 65.0
+	tests := []struct {
+		name        string
+		settings    []stiebeleltron.Setting
+		expectedErr string
+	}{
+		{
+			name: "GivenValidSettings_ThenReturnNoError",
+			settings: []stiebeleltron.Setting{
+				{Name: "dhw_set_temperature", ID: "val22", Min: &min, Max: &max},
+			},
+		},
+		{
+			name: "GivenDuplicateName_ThenReturnError",
+			settings: []stiebeleltron.Setting{
+				{Name: "dhw_set_temperature", ID: "val22", Min: &min, Max: &max},
+				{Name: "dhw_set_temperature", ID: "val23", Min: &min, Max: &max},
+			},
+			expectedErr: "setting dhw_set_temperature: name is used more than once",
+		},
+		{
+			name: "GivenNoName_ThenReturnError",
+			settings: []stiebeleltron.Setting{
+				{ID: "val22", Min: &min, Max: &max},
+			},
+			expectedErr: `setting with id "val22": name is required`,
+		},
+		{
+			name: "GivenNoRange_ThenReturnError",
+			settings: []stiebeleltron.Setting{
+				{Name: "dhw_set_temperature", ID: "val22"},
+			},
+			expectedErr: "setting dhw_set_temperature: min and max are required for settings without options",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := MetricDefinitions{Settings: tt.settings}.VerifySettings()
+			if tt.expectedErr != "" {
+				assert.EqualError(t, err, tt.expectedErr)
+				return
+			}
+			assert.NoError(t, err)
+		})
+	}
+}
@@ -1,15 +1,22 @@
 package cfg
 
 import (
+	"fmt"
+	"strings"
 	"time"
 
 	"github.com/ccremer/stiebeleltron-exporter/pkg/metrics"
+	"github.com/ccremer/stiebeleltron-exporter/pkg/stiebeleltron"
 	"github.com/prometheus/client_golang/prometheus"
 )
 
 type (
 	// Configuration holds a strongly-typed tree of the configuration
 	Configuration struct {
+		Config struct {
+			// File is the YAML file that the configuration is loaded from, if any.
+			File string
+		}
 		Log struct {
 			Level   string
 			Verbose bool
@@ -17,68 +24,355 @@ type (
 		ISG struct {
 			URL            string
 			Timeout        time.Duration
+			PollInterval   time.Duration
+			MaxAge         time.Duration
 			Headers        []string `koanf:"header"`
 			DefinitionPath string
+			Language       string
+			// DecimalSeparator is the decimal separator of numbers in the web UI, the grouping separator is the other of "," and ".".
+			DecimalSeparator string
+			Username         string
+			Password         string
+			ModbusPort       int
+			ModbusUnitID     uint8
+			Discovery        bool
+		}
+		Probe struct {
+			AllowedTargets []string
+		}
+		State struct {
+			Path string
+		}
+		Faults struct {
+			Page        string
+			History     bool
+			HistorySize int
+		}
+		MQTT struct {
+			// Broker is the URL of the MQTT broker, publishing is disabled if empty.
+			Broker          string
+			ClientID        string
+			Username        string
+			Password        string
+			TopicPrefix     string
+			Retain          bool
+			QoS             uint8
+			DiscoveryPrefix string
+			NodeID          string
+		}
+		Influx struct {
+			// URL is the base URL of InfluxDB v2, pushing is disabled if empty.
+			URL          string
+			Org          string
+			Bucket       string
+			Token        string
+			PushInterval time.Duration
+			BatchSize    int
+			BufferSize   int
+		}
+		RemoteWrite struct {
+			// URL is the Prometheus remote write endpoint, pushing is disabled if empty.
+			URL         string
+			Username    string
+			Password    string
+			BearerToken string
+			Labels      []string `koanf:"label"`
+			BatchSize   int
+			BufferSize  int
+			MaxBackoff  time.Duration
+		}
+		OTLP struct {
+			// Endpoint is the URL of the OTLP receiver, exporting is disabled if empty.
+			Endpoint           string
+			Protocol           string
+			Headers            []string `koanf:"header"`
+			ResourceAttributes []string `koanf:"resourceattribute"`
+		}
+		Settings struct {
+			// Token authorizes writes of settings, the settings endpoint is disabled if empty.
+			Token    string
+			DryRun   bool
+			AuditLog string
 		}
 		BindAddr string `koanf:"bindaddr"`
+		// Definitions are the metric definitions given inline in the config file, if any.
+		Definitions *MetricDefinitions
 	}
 	MetricDefinitions struct {
-		Pages map[string]Page
+		// Language is the language of the ISG web UI that the search strings are written in.
+		Language string          `yaml:"language,omitempty"`
+		Pages    map[string]Page `yaml:"pages"`
+		// Settings are the settings of the ISG that may be changed through the exporter.
+		Settings []stiebeleltron.Setting `yaml:"settings,omitempty"`
 	}
 	Page struct {
-		Groups    map[string]Group
-		URLSuffix string
+		Groups    map[string]Group `yaml:"groups"`
+		URLSuffix string           `yaml:"urlSuffix,omitempty"`
+		// Type is either "html" (default), "status" or "modbus".
+		Type string `yaml:"type,omitempty"`
 	}
 	Group struct {
-		SearchString string
-		Metrics      []Metric
+		SearchString string   `yaml:"searchString,omitempty"`
+		Metrics      []Metric `yaml:"metrics"`
 	}
 	Metric struct {
-		Name         string
-		Description  string
-		SearchString string
-		Multiplier   *float64
-		Divisor      *float64
-		Labels       prometheus.Labels
+		Name string `yaml:"name"`
+		// Type is either "gauge" (default) or "counter".
+		// Counters are meant for cumulative values that only ever increase, e.g. runtimes and heat amounts.
+		Type string `yaml:"type,omitempty"`
+		// Reset is "daily" for values that the ISG resets at midnight, which have to be of type "gauge".
+		// Such values are additionally accumulated into a counter named like the metric with the suffix "_accumulated_total".
+		Reset        string `yaml:"reset,omitempty"`
+		Description  string `yaml:"description,omitempty"`
+		SearchString string `yaml:"searchString,omitempty"`
+		// Unit is the unit that the value is converted into, e.g. "joules" for values displayed in kWh or MWh.
+		// If empty, the value is exported as displayed.
+		Unit string `yaml:"unit,omitempty"`
+		// States maps text values of the ISG, e.g. "ECO MODE", to states that are exported as state set, e.g. "eco".
+		States map[string]string `yaml:"states,omitempty"`
+		// Codes maps text values of the ISG, e.g. "ON", to numeric codes.
+		Codes map[string]float64 `yaml:"codes,omitempty"`
+		// Register is the 1-based register number of metrics in pages of type "modbus".
+		Register uint16 `yaml:"register,omitempty"`
+		// RegisterType is either "input" (default) or "holding".
+		RegisterType string `yaml:"registerType,omitempty"`
+		// DataType is either "int16" (default) or "uint16".
+		DataType string `yaml:"dataType,omitempty"`
+		// Transforms is the chain of steps that converts the value, applied in order.
+		Transforms []metrics.TransformStep `yaml:"transforms,omitempty"`
+		// Multiplier is deprecated, use a multiply step in Transforms instead.
+		Multiplier *float64 `yaml:"multiplier,omitempty"`
+		// Divisor is deprecated, use a divide step in Transforms instead.
+		Divisor *float64          `yaml:"divisor,omitempty"`
+		Labels  prometheus.Labels `yaml:"labels,omitempty"`
+	}
+)
+
+// NumberFormat returns the format of numbers in the web UI of the ISG.
+func (configuration *Configuration) NumberFormat() stiebeleltron.NumberFormat {
+	if configuration.ISG.DecimalSeparator == "." {
+		return stiebeleltron.NumberFormat{DecimalSeparator: ".", GroupingSeparator: ","}
 	}
+	return stiebeleltron.DefaultNumberFormat
+}
+
+// ResetDaily is the Metric.Reset of values that the ISG resets at midnight.
+const ResetDaily = "daily"
+
+const (
+	// OTLPProtocolHTTP sends the metrics as protobuf via OTLP/HTTP.
+	OTLPProtocolHTTP = "http/protobuf"
+	// OTLPProtocolGRPC sends the metrics via OTLP/gRPC.
+	OTLPProtocolGRPC = "grpc"
 )
 
+// VerifySettings returns an error if any setting can't be written or if a name is used more than once.
+func (definitions MetricDefinitions) VerifySettings() error {
+	names := map[string]bool{}
+	for _, setting := range definitions.Settings {
+		if setting.Name == "" {
+			return fmt.Errorf("setting with id %q: name is required", setting.ID)
+		}
+		if names[setting.Name] {
+			return fmt.Errorf("setting %s: name is used more than once", setting.Name)
+		}
+		names[setting.Name] = true
+		if err := setting.Verify(); err != nil {
+			return fmt.Errorf("setting %s: %w", setting.Name, err)
+		}
+	}
+	return nil
+}
+
 // NewDefaultExporterConfig retrieves the hardcoded configs with sane defaults
 func NewDefaultExporterConfig() *Configuration {
 	c := &Configuration{}
 	c.Log.Level = "info"
 	c.ISG.URL = "http://isg.ip.or.hostname"
 	c.ISG.Timeout = 5 * time.Second
+	c.ISG.Language = DefaultLanguage
+	c.ISG.DecimalSeparator = stiebeleltron.DefaultNumberFormat.DecimalSeparator
+	c.ISG.ModbusPort = stiebeleltron.DefaultModbusPort
+	c.ISG.ModbusUnitID = 1
+	c.Faults.HistorySize = 100
+	c.Influx.PushInterval = 60 * time.Second
+	c.Influx.BatchSize = 5000
+	c.Influx.BufferSize = 100000
+	c.RemoteWrite.BatchSize = 2000
+	c.RemoteWrite.BufferSize = 100000
+	c.RemoteWrite.MaxBackoff = 60 * time.Second
+	c.OTLP.Protocol = OTLPProtocolHTTP
+	c.MQTT.ClientID = "stiebeleltron-exporter"
+	c.MQTT.TopicPrefix = "stiebeleltron"
+	c.MQTT.Retain = true
+	c.MQTT.DiscoveryPrefix = "homeassistant"
+	c.MQTT.NodeID = "stiebeleltron"
 	c.BindAddr = ":8080"
 	return c
 }
 
 // MapToPrometheusMetric transforms given config from into Prometheus metric objects.
-func (definitions MetricDefinitions) MapToPrometheusMetric() map[string][]*metrics.PrometheusMetric {
-	m := make(map[string][]*metrics.PrometheusMetric, 0)
-	for _, page := range definitions.Pages {
+// It returns an error if any metric is invalid, e.g. an unknown type or a transform chain that divides by 0.
+func (definitions MetricDefinitions) MapToPrometheusMetric() ([]*metrics.Page, error) {
+	m := make([]*metrics.Page, 0, len(definitions.Pages))
+	types := map[string]string{}
+	for pageName, page := range definitions.Pages {
 		perPageMetrics := make([]*metrics.PrometheusMetric, 0)
 		for groupName, group := range page.Groups {
 			for _, metric := range group.Metrics {
+				metricType, err := metric.metricType()
+				if err != nil {
+					return nil, fmt.Errorf("metric %s/%s/%s: %w", pageName, groupName, metric.Name, err)
+				}
+				// Metrics with the same name but different labels have to be of the same type.
+				fqName := groupName + "_" + metric.Name
+				if existing, exists := types[fqName]; exists && existing != metricType {
+					return nil, fmt.Errorf("metric %s/%s/%s: metrics with the same name must be of the same type, found %s and %s",
+						pageName, groupName, metric.Name, existing, metricType)
+				}
+				types[fqName] = metricType
+				if metric.Reset == ResetDaily {
+					accumulatedName := groupName + "_" + metrics.AccumulatedName(metric.Name)
+					if existing, exists := types[accumulatedName]; exists && existing != metrics.MetricTypeCounter {
+						return nil, fmt.Errorf("metric %s/%s/%s: metrics with the same name must be of the same type, found %s and %s",
+							pageName, groupName, metric.Name, existing, metrics.MetricTypeCounter)
+					}
+					types[accumulatedName] = metrics.MetricTypeCounter
+				}
+				steps, err := metric.transformSteps()
+				if err != nil {
+					return nil, fmt.Errorf("metric %s/%s/%s: %w", pageName, groupName, metric.Name, err)
+				}
+				if err := metric.validateTextMapping(metricType, steps); err != nil {
+					return nil, fmt.Errorf("metric %s/%s/%s: %w", pageName, groupName, metric.Name, err)
+				}
+				if err := validateUnit(metric.Unit); err != nil {
+					return nil, fmt.Errorf("metric %s/%s/%s: %w", pageName, groupName, metric.Name, err)
+				}
+				if page.Type == stiebeleltron.PageTypeModbus {
+					if err := metric.validateRegister(); err != nil {
+						return nil, fmt.Errorf("metric %s/%s/%s: %w", pageName, groupName, metric.Name, err)
+					}
+				}
+				transformer, err := metrics.NewTransformer(steps)
+				if err != nil {
+					return nil, fmt.Errorf("metric %s/%s/%s: %w", pageName, groupName, metric.Name, err)
+				}
 				promMetric := &metrics.PrometheusMetric{
 					GaugeName:            metric.Name,
+					Type:                 metricType,
+					DailyReset:           metric.Reset == ResetDaily,
 					Group:                groupName,
 					GroupSearchString:    group.SearchString,
 					PropertySearchString: metric.SearchString,
+					Register:             metric.Register,
+					RegisterType:         stiebeleltron.RegisterType(metric.RegisterType),
+					DataType:             stiebeleltron.DataType(metric.DataType),
 					HelpText:             metric.Description,
+					Unit:                 metric.Unit,
+					States:               metric.States,
+					Codes:                metric.Codes,
 					Labels:               metric.Labels,
-				}
-				if metric.Divisor != nil {
-					promMetric.ValueTransformer = metrics.NewDivisorTransformer(*metric.Divisor)
-				}
-				if metric.Multiplier != nil {
-					promMetric.ValueTransformer = metrics.NewMultiplierTransformer(*metric.Multiplier)
+					ValueTransformer:     transformer,
 				}
 				promMetric.InitializeMetric()
 				perPageMetrics = append(perPageMetrics, promMetric)
 			}
 		}
-		m[page.URLSuffix] = perPageMetrics
+		promPage := &metrics.Page{
+			Name:    pageName,
+			Path:    page.URLSuffix,
+			Type:    page.Type,
+			Metrics: perPageMetrics,
+		}
+		if promPage.Type == "" {
+			promPage.Type = stiebeleltron.PageTypeHTML
+		}
+		if promPage.Type == stiebeleltron.PageTypeModbus {
+			promPage.Path = pageName
+		}
+		m = append(m, promPage)
+	}
+	return m, nil
+}
+
+// metricType returns the type of the metric, defaulting to a gauge.
+func (metric Metric) metricType() (string, error) {
+	metricType := metric.Type
+	if metricType == "" {
+		metricType = metrics.MetricTypeGauge
+	}
+	if metricType != metrics.MetricTypeGauge && metricType != metrics.MetricTypeCounter {
+		return "", fmt.Errorf("unknown type %q, must be one of gauge, counter", metric.Type)
+	}
+	if metric.Reset != "" && (metric.Reset != ResetDaily || metricType != metrics.MetricTypeGauge) {
+		return "", fmt.Errorf("unknown reset %q on metric of type %s, must be daily on metrics of type gauge", metric.Reset, metricType)
+	}
+	return metricType, nil
+}
+
+// validateTextMapping returns an error if the states or codes of a metric are combined with settings for numeric values.
+func (metric Metric) validateTextMapping(metricType string, steps []metrics.TransformStep) error {
+	if len(metric.States) == 0 && len(metric.Codes) == 0 {
+		return nil
+	}
+	if len(metric.States) > 0 && len(metric.Codes) > 0 {
+		return fmt.Errorf("states and codes can't be combined")
+	}
+	if metricType != metrics.MetricTypeGauge || metric.Unit != "" || len(steps) > 0 {
+		return fmt.Errorf("states and codes can't be combined with type counter, reset, unit or transforms")
+	}
+	if _, exists := metric.Labels[metrics.StateLabel]; exists && len(metric.States) > 0 {
+		return fmt.Errorf("label %q is reserved for the state of metrics with states", metrics.StateLabel)
+	}
+	return nil
+}
+
+// validateRegister returns an error if the register of a metric in a page of type "modbus" is missing or invalid.
+// Registers have no unit to convert from, so unit is rejected as well.
+func (metric Metric) validateRegister() error {
+	if metric.Register == 0 {
+		return fmt.Errorf("register is required in pages of type modbus")
+	}
+	if err := stiebeleltron.RegisterType(metric.RegisterType).Validate(); err != nil {
+		return fmt.Errorf("%w, must be one of input, holding", err)
+	}
+	if err := stiebeleltron.DataType(metric.DataType).Validate(); err != nil {
+		return fmt.Errorf("%w, must be one of int16, uint16", err)
+	}
+	if metric.Unit != "" {
+		return fmt.Errorf("unit can't be converted in pages of type modbus, use transforms instead")
+	}
+	return nil
+}
+
+func validateUnit(unit string) error {
+	if unit == "" {
+		return nil
+	}
+	for _, known := range stiebeleltron.KnownUnits() {
+		if unit == known {
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown unit %q, must be one of %s", unit, strings.Join(stiebeleltron.KnownUnits(), ", "))
+}
+
+// transformSteps returns the transform chain of the metric.
+// The deprecated multiplier and divisor are converted into steps, but can't be combined with transforms.
+func (metric Metric) transformSteps() ([]metrics.TransformStep, error) {
+	if len(metric.Transforms) > 0 && (metric.Multiplier != nil || metric.Divisor != nil) {
+		return nil, fmt.Errorf("transforms can't be combined with multiplier or divisor, add them as steps of the transforms instead")
+	}
+	if len(metric.Transforms) > 0 {
+		return metric.Transforms, nil
+	}
+	var steps []metrics.TransformStep
+	if metric.Multiplier != nil {
+		steps = append(steps, metrics.TransformStep{Multiply: metric.Multiplier})
+	}
+	if metric.Divisor != nil {
+		steps = append(steps, metrics.TransformStep{Divide: metric.Divisor})
 	}
-	return m
+	return steps, nil
 }
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/ccremer/stiebeleltron-exporter/cfg"
+	"github.com/ccremer/stiebeleltron-exporter/pkg/stiebeleltron"
+	log "github.com/sirupsen/logrus"
+	flag "github.com/spf13/pflag"
+)
+
+const generateDefinitionsCommand = "generate-definitions"
+
+// runGenerateDefinitions writes a definition file with all properties found in the ISG pages.
+// If an existing definition file is given, only the missing properties are added.
+func runGenerateDefinitions(args []string) {
+	fs := flag.NewFlagSet(generateDefinitionsCommand, flag.ExitOnError)
+	output := fs.StringP("output", "o", "", "Path of the generated definition file. If empty, the definitions are written to stdout")
+	pageFlags := fs.StringSlice("page", []string{},
+		"List of \"name=urlSuffix\" pages to fetch from Stiebel Eltron ISG. If empty, the pages of the definitions are fetched")
+	fileFlags := fs.StringSlice("file", []string{},
+		"List of \"name=path\" HTML pages saved from the ISG web UI to read instead of fetching the ISG")
+	config = cfg.ParseConfig(version, commit, date, fs, args)
+
+	definitions := &cfg.MetricDefinitions{}
+	existing := config.LoadMetricDefinitions()
+	if config.ISG.DefinitionPath != "" {
+		definitions = existing
+	}
+
+	added := 0
+	if len(*fileFlags) > 0 {
+		for name, path := range splitNameValues(*fileFlags) {
+			added += addPropertiesFromFile(definitions, existing, name, path)
+		}
+	} else {
+		pages := splitNameValues(*pageFlags)
+		if len(pages) == 0 {
+			for name, page := range existing.Pages {
+				if page.Type == "" || page.Type == stiebeleltron.PageTypeHTML {
+					pages[name] = page.URLSuffix
+				}
+			}
+		}
+		headers := http.Header{}
+		cfg.ConvertHeaders(config.ISG.Headers, &headers)
+		client, err := stiebeleltron.NewISGClient(stiebeleltron.ClientOptions{
+			BaseURL:      config.ISG.URL,
+			Headers:      headers,
+			Username:     config.ISG.Username,
+			Password:     config.ISG.Password,
+			NumberFormat: config.NumberFormat(),
+		})
+		if err != nil {
+			log.WithError(err).Fatal("Could not create client")
+		}
+		for name, urlSuffix := range pages {
+			ctx, cancel := context.WithTimeout(context.Background(), config.ISG.Timeout)
+			props, _, err := client.DiscoverPage(ctx, urlSuffix, nil)
+			cancel()
+			if err != nil {
+				log.WithError(err).WithField("page", urlSuffix).Fatal("Could not fetch page")
+			}
+			added += definitions.AddDiscoveredProperties(name, urlSuffix, props)
+		}
+	}
+
+	b, err := definitions.ToYAML()
+	if err != nil {
+		log.WithError(err).Fatal("Could not marshal definitions")
+	}
+	if *output == "" {
+		fmt.Print(string(b))
+	} else if err := os.WriteFile(*output, b, 0644); err != nil {
+		log.WithError(err).Fatal("Could not write definitions")
+	}
+	log.WithField("added", added).Info("Generated definitions.")
+}
+
+// addPropertiesFromFile adds the properties of a saved HTML page.
+// The URL suffix is taken from the page with the same name in the existing definitions, if there is any.
+func addPropertiesFromFile(definitions, existing *cfg.MetricDefinitions, name, path string) int {
+	f, err := os.Open(path)
+	if err != nil {
+		log.WithError(err).Fatal("Could not open file")
+	}
+	defer f.Close()
+	props, err := stiebeleltron.DiscoverDocument(f, config.NumberFormat())
+	if err != nil {
+		log.WithError(err).WithField("file", path).Fatal("Could not parse file")
+	}
+	return definitions.AddDiscoveredProperties(name, existing.Pages[name].URLSuffix, props)
+}
+
+// splitNameValues takes a list of `name=value` entries and returns them as map. It ignores any malformed entries.
+func splitNameValues(entries []string) map[string]string {
+	m := make(map[string]string, len(entries))
+	for _, entry := range entries {
+		arr := strings.SplitN(entry, "=", 2)
+		if len(arr) < 2 {
+			log.WithField("arg", entry).Warn("Could not parse entry, expected name=value, ignoring")
+			continue
+		}
+		m[strings.TrimSpace(arr[0])] = strings.TrimSpace(arr[1])
+	}
+	return m
+}
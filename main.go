@@ -1,26 +1,44 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"strconv"
 	"time"
 
 	"github.com/ccremer/stiebeleltron-exporter/cfg"
+	"github.com/ccremer/stiebeleltron-exporter/pkg/api"
+	"github.com/ccremer/stiebeleltron-exporter/pkg/influx"
+	"github.com/ccremer/stiebeleltron-exporter/pkg/metrics"
+	"github.com/ccremer/stiebeleltron-exporter/pkg/mqtt"
+	"github.com/ccremer/stiebeleltron-exporter/pkg/otlp"
+	"github.com/ccremer/stiebeleltron-exporter/pkg/remotewrite"
+	"github.com/ccremer/stiebeleltron-exporter/pkg/state"
 	"github.com/ccremer/stiebeleltron-exporter/pkg/stiebeleltron"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	log "github.com/sirupsen/logrus"
 	flag "github.com/spf13/pflag"
 )
 
 var (
-	version     = "unknown"
-	commit      = "dirty"
-	date        = time.Now().String()
-	config      = cfg.ParseConfig(version, commit, date, flag.NewFlagSet("main", flag.ExitOnError), os.Args[1:])
-	promHandler = promhttp.Handler()
+	version = "unknown"
+	commit  = "dirty"
+	date    = time.Now().String()
+	config  *cfg.Configuration
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == generateDefinitionsCommand {
+		runGenerateDefinitions(os.Args[2:])
+		return
+	}
+	config = cfg.ParseConfig(version, commit, date, flag.NewFlagSet("main", flag.ExitOnError), os.Args[1:])
 
 	log.WithFields(log.Fields{
 		"version": version,
@@ -49,25 +67,303 @@ func main() {
 
 	headers := http.Header{}
 	cfg.ConvertHeaders(config.ISG.Headers, &headers)
-	client, err := stiebeleltron.NewISGClient(stiebeleltron.ClientOptions{
-		BaseURL: config.ISG.URL,
-		Headers: headers,
-	})
+	parsers, err := newPageParsers(config.ISG.URL, headers)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	props := config.LoadMetricDefinitions().MapToPrometheusMetric()
+	definitions := config.LoadMetricDefinitions()
+	verifyLanguage(parsers[stiebeleltron.PageTypeHTML].(*stiebeleltron.ISGClient), definitions)
+	props, err := definitions.MapToPrometheusMetric()
+	if err != nil {
+		log.WithError(err).Fatal("Invalid definitions")
+	}
+	if err := definitions.VerifySettings(); err != nil {
+		log.WithError(err).Fatal("Invalid definitions")
+	}
+
+	collector := metrics.NewCollector(parsers, props, config.ISG.Timeout)
+	if config.State.Path != "" {
+		store, err := state.OpenFileStore(config.State.Path)
+		if err != nil {
+			log.WithError(err).WithField("path", config.State.Path).Fatal("Could not open state file")
+		}
+		collector.UseStateStore(store)
+	}
+	if config.ISG.Discovery {
+		collector.EnableDiscovery()
+	}
+	if config.MQTT.Broker != "" {
+		collector.AddSnapshotHandler(newMQTTPublisher())
+	}
+	if config.Influx.URL != "" {
+		collector.AddSnapshotHandler(newInfluxPusher())
+	}
+	if config.RemoteWrite.URL != "" {
+		collector.AddSnapshotHandler(newRemoteWritePusher())
+	}
+	if config.OTLP.Endpoint != "" {
+		collector.AddSnapshotHandler(newOTLPPusher(parsers[stiebeleltron.PageTypeHTML].(*stiebeleltron.ISGClient), props))
+	}
+	if config.ISG.PollInterval > 0 {
+		log.WithFields(log.Fields{
+			"interval": config.ISG.PollInterval.Seconds(),
+			"maxAge":   config.ISG.MaxAge.Seconds(),
+		}).Info("Polling ISG in the background.")
+		collector.StartPolling(context.Background(), config.ISG.PollInterval, config.ISG.MaxAge)
+	}
+
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		collector,
+	)
+	if config.Faults.Page != "" {
+		registerFaultCollector(registry, parsers[stiebeleltron.PageTypeHTML].(*stiebeleltron.ISGClient))
+	}
+	promHandler := promhttp.HandlerFor(registry, promhttp.HandlerOpts{})
 
 	http.HandleFunc("/metrics", func(w http.ResponseWriter, req *http.Request) {
 		log.WithFields(log.Fields{
 			"uri":    req.RequestURI,
 			"client": req.RemoteAddr,
 		}).Debug("Accessed Metrics endpoint")
-		scrapeISG(client, props)
 		promHandler.ServeHTTP(w, req)
 	})
+	http.Handle("/influx", influx.NewHandler(collector))
+	valuesHandler := api.NewValuesHandler(collector)
+	http.Handle(api.ValuesPath, valuesHandler)
+	http.Handle(api.ValuesPath+"/", valuesHandler)
+	http.Handle("/probe", newProbeHandler(config.Probe.AllowedTargets, props, config.ISG.Timeout, config.ISG.Discovery, func(target string) (map[string]stiebeleltron.PageParser, error) {
+		return newPageParsers(target, headers)
+	}))
+
+	if config.Settings.Token != "" {
+		registerSettingsHandler(registry, parsers[stiebeleltron.PageTypeHTML].(*stiebeleltron.ISGClient), definitions.Settings)
+	}
 
 	log.WithField("port", config.BindAddr).Info("Listening for scrapes.")
 	log.WithError(http.ListenAndServe(config.BindAddr, nil)).Fatal("Shutting down.")
 }
+
+// newMQTTPublisher returns a publisher that is connected to the configured MQTT broker.
+// If the broker isn't reachable yet, the publisher keeps connecting in the background.
+func newMQTTPublisher() *mqtt.Publisher {
+	if config.ISG.PollInterval <= 0 {
+		log.Fatal("Publishing to MQTT requires --isg.pollInterval")
+	}
+	publisher := mqtt.NewPublisher(mqtt.Options{
+		Broker:          config.MQTT.Broker,
+		ClientID:        config.MQTT.ClientID,
+		Username:        config.MQTT.Username,
+		Password:        config.MQTT.Password,
+		TopicPrefix:     config.MQTT.TopicPrefix,
+		Retain:          config.MQTT.Retain,
+		QoS:             config.MQTT.QoS,
+		DiscoveryPrefix: config.MQTT.DiscoveryPrefix,
+		NodeID:          config.MQTT.NodeID,
+		Timeout:         config.ISG.Timeout,
+	})
+	if err := publisher.Connect(); err != nil {
+		log.WithError(err).Warn("Could not connect to MQTT broker, retrying in the background")
+	}
+	return publisher
+}
+
+// newInfluxPusher returns a pusher that pushes the values to the configured InfluxDB in the push interval.
+func newInfluxPusher() *influx.Pusher {
+	if config.ISG.PollInterval <= 0 {
+		log.Fatal("Pushing to InfluxDB requires --isg.pollInterval")
+	}
+	pusher := influx.NewPusher(influx.PushOptions{
+		URL:        config.Influx.URL,
+		Org:        config.Influx.Org,
+		Bucket:     config.Influx.Bucket,
+		Token:      config.Influx.Token,
+		BatchSize:  config.Influx.BatchSize,
+		BufferSize: config.Influx.BufferSize,
+		Timeout:    config.ISG.Timeout,
+	})
+	pusher.Start(context.Background(), config.Influx.PushInterval)
+	log.WithFields(log.Fields{
+		"url":      config.Influx.URL,
+		"interval": config.Influx.PushInterval.Seconds(),
+	}).Info("Pushing values to InfluxDB.")
+	return pusher
+}
+
+// newRemoteWritePusher returns a pusher that pushes the values to the configured remote write endpoint after each poll.
+func newRemoteWritePusher() *remotewrite.Pusher {
+	if config.ISG.PollInterval <= 0 {
+		log.Fatal("Pushing via remote write requires --isg.pollInterval")
+	}
+	pusher := remotewrite.NewPusher(remotewrite.Options{
+		URL:         config.RemoteWrite.URL,
+		Username:    config.RemoteWrite.Username,
+		Password:    config.RemoteWrite.Password,
+		BearerToken: config.RemoteWrite.BearerToken,
+		Labels:      cfg.ConvertLabels(config.RemoteWrite.Labels),
+		BatchSize:   config.RemoteWrite.BatchSize,
+		BufferSize:  config.RemoteWrite.BufferSize,
+		MaxBackoff:  config.RemoteWrite.MaxBackoff,
+		Timeout:     config.ISG.Timeout,
+	})
+	pusher.Start(context.Background())
+	log.WithField("url", config.RemoteWrite.URL).Info("Pushing values via remote write.")
+	return pusher
+}
+
+// newOTLPPusher returns a pusher that exports the values to the configured OTLP receiver after each poll.
+// Unless configured as resource attribute, the firmware version is read from the ISG.
+func newOTLPPusher(client *stiebeleltron.ISGClient, pages []*metrics.Page) *otlp.Pusher {
+	if config.ISG.PollInterval <= 0 {
+		log.Fatal("Exporting via OTLP requires --isg.pollInterval")
+	}
+	headers := http.Header{}
+	cfg.ConvertHeaders(config.OTLP.Headers, &headers)
+	headerMap := map[string]string{}
+	for key := range headers {
+		headerMap[key] = headers.Get(key)
+	}
+	attributes := cfg.ConvertAttributes(config.OTLP.ResourceAttributes)
+	if _, exists := attributes[otlp.FirmwareAttribute]; !exists {
+		if firmware := readFirmwareVersion(client, pages); firmware != "" {
+			attributes[otlp.FirmwareAttribute] = firmware
+		}
+	}
+	pusher, err := otlp.NewPusher(context.Background(), otlp.Options{
+		Endpoint: config.OTLP.Endpoint,
+		GRPC:     config.OTLP.Protocol == cfg.OTLPProtocolGRPC,
+		Headers:  headerMap,
+		Resource: otlp.NewResource(config.ISG.URL, attributes),
+		Timeout:  config.ISG.Timeout,
+	})
+	if err != nil {
+		log.WithError(err).Fatal("Could not create OTLP exporter")
+	}
+	pusher.Start(context.Background())
+	log.WithFields(log.Fields{
+		"endpoint": config.OTLP.Endpoint,
+		"protocol": config.OTLP.Protocol,
+	}).Info("Exporting values via OTLP.")
+	return pusher
+}
+
+// readFirmwareVersion returns the firmware version shown in the first HTML page of the ISG.
+// If the ISG isn't reachable, it returns an empty string.
+func readFirmwareVersion(client *stiebeleltron.ISGClient, pages []*metrics.Page) string {
+	for _, page := range pages {
+		if page.Type != stiebeleltron.PageTypeHTML {
+			continue
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), config.ISG.Timeout)
+		defer cancel()
+		firmware, err := client.FirmwareVersion(ctx, page.Path)
+		if err != nil {
+			log.WithError(err).WithField("page", page.Path).Warn("Could not read firmware version of ISG, omitting it from the OTLP resource")
+			return ""
+		}
+		return firmware
+	}
+	return ""
+}
+
+// registerFaultCollector exports the faults of the ISG and serves the fault history, if enabled.
+// In polling mode, the fault list is fetched with each poll instead of each scrape.
+func registerFaultCollector(registry *prometheus.Registry, client *stiebeleltron.ISGClient) {
+	var history *metrics.FaultHistory
+	if config.Faults.History {
+		history = metrics.NewFaultHistory(config.Faults.HistorySize)
+		http.HandleFunc("/faults", func(w http.ResponseWriter, r *http.Request) {
+			log.WithFields(log.Fields{
+				"uri":    r.RequestURI,
+				"client": r.RemoteAddr,
+			}).Debug("Accessed Faults endpoint")
+			w.Header().Set("Content-Type", "application/json")
+			if err := json.NewEncoder(w).Encode(history.Entries()); err != nil {
+				log.WithError(err).Warn("Could not write fault history")
+			}
+		})
+	}
+	collector := metrics.NewFaultCollector(client, config.Faults.Page, config.ISG.Timeout, history)
+	if config.ISG.PollInterval > 0 {
+		collector.StartPolling(context.Background(), config.ISG.PollInterval, config.ISG.MaxAge)
+	}
+	registry.MustRegister(collector)
+}
+
+// registerSettingsHandler serves the settings in the definitions for writing.
+// Every write is audited in the log and, if configured, in the audit log file.
+func registerSettingsHandler(registry *prometheus.Registry, client *stiebeleltron.ISGClient, settings []stiebeleltron.Setting) {
+	audit := api.NewAuditLog(nil)
+	if config.Settings.AuditLog != "" {
+		f, err := os.OpenFile(config.Settings.AuditLog, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+		if err != nil {
+			log.WithError(err).WithField("path", config.Settings.AuditLog).Fatal("Could not open audit log")
+		}
+		audit = api.NewAuditLog(f)
+	}
+	handler := api.NewSettingsHandler(client, settings, config.Settings.Token, config.Settings.DryRun, config.ISG.Timeout, audit)
+	registry.MustRegister(handler)
+	http.Handle(api.SettingsPath, handler)
+	http.Handle(api.SettingsPath+"/", handler)
+	log.WithFields(log.Fields{
+		"settings": len(settings),
+		"dryRun":   config.Settings.DryRun,
+	}).Info("Serving settings for writing.")
+}
+
+// verifyLanguage exits if the ISG web UI is in another language than the definitions are written for.
+// If the ISG isn't reachable, the verification is skipped.
+func verifyLanguage(client *stiebeleltron.ISGClient, definitions *cfg.MetricDefinitions) {
+	var groups []string
+	for _, page := range definitions.Pages {
+		if page.Type != "" && page.Type != stiebeleltron.PageTypeHTML {
+			continue
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), config.ISG.Timeout)
+		pageGroups, err := client.FindGroups(ctx, page.URLSuffix)
+		cancel()
+		if err != nil {
+			log.WithError(err).WithField("page", page.URLSuffix).Warn("Could not verify language of ISG web UI, skipping")
+			return
+		}
+		groups = append(groups, pageGroups...)
+	}
+	if err := definitions.VerifyLanguage(groups); err != nil {
+		log.WithError(err).Fatal("Definitions don't match the ISG web UI.")
+	}
+	log.WithField("language", definitions.ExpectedLanguage()).Debug("Verified language of ISG web UI.")
+}
+
+// newPageParsers returns the parsers of each page type for the ISG with the given URL.
+// The Modbus server is expected on the same host as the web UI.
+func newPageParsers(baseURL string, headers http.Header) (map[string]stiebeleltron.PageParser, error) {
+	client, err := stiebeleltron.NewISGClient(stiebeleltron.ClientOptions{
+		BaseURL:      baseURL,
+		Headers:      headers,
+		Username:     config.ISG.Username,
+		Password:     config.ISG.Password,
+		NumberFormat: config.NumberFormat(),
+	})
+	if err != nil {
+		return nil, err
+	}
+	u, err := url.Parse(baseURL)
+	if err != nil {
+		return nil, err
+	}
+	modbusClient, err := stiebeleltron.NewModbusClient(stiebeleltron.ModbusOptions{
+		Address: net.JoinHostPort(u.Hostname(), strconv.Itoa(config.ISG.ModbusPort)),
+		UnitID:  config.ISG.ModbusUnitID,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return map[string]stiebeleltron.PageParser{
+		stiebeleltron.PageTypeHTML:   client,
+		stiebeleltron.PageTypeModbus: modbusClient,
+		stiebeleltron.PageTypeStatus: stiebeleltron.NewStatusParser(client),
+	}, nil
+}
@@ -0,0 +1,74 @@
+package api
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+type (
+	// AuditLog records every attempt to write a setting, including rejected writes and dry-runs.
+	// Each entry is logged and, if a writer is given, appended to it as a line of JSON.
+	AuditLog struct {
+		mu  sync.Mutex
+		w   io.Writer
+		now func() time.Time
+	}
+	// AuditEntry is an attempt to write a setting.
+	AuditEntry struct {
+		Time    time.Time `json:"time"`
+		Client  string    `json:"client"`
+		Setting string    `json:"setting"`
+		Value   string    `json:"value"`
+		DryRun  bool      `json:"dryRun"`
+		// Result is one of the Result constants.
+		Result string `json:"result"`
+		Error  string `json:"error,omitempty"`
+	}
+)
+
+const (
+	// ResultWritten means that the value was written to the ISG.
+	ResultWritten = "written"
+	// ResultDryRun means that the value was valid, but not written.
+	ResultDryRun = "dry-run"
+	// ResultRejected means that the setting or value was invalid.
+	ResultRejected = "rejected"
+	// ResultFailed means that the ISG couldn't be written to.
+	ResultFailed = "failed"
+)
+
+// NewAuditLog returns an AuditLog that appends the entries to w.
+// If w is nil, the entries are only logged.
+func NewAuditLog(w io.Writer) *AuditLog {
+	return &AuditLog{w: w, now: time.Now}
+}
+
+// Record logs the given entry.
+// The time of the entry is set to the current time.
+func (a *AuditLog) Record(entry AuditEntry) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	entry.Time = a.now()
+	entryLog := log.WithFields(log.Fields{
+		"client":  entry.Client,
+		"setting": entry.Setting,
+		"value":   entry.Value,
+		"dryRun":  entry.DryRun,
+		"result":  entry.Result,
+	})
+	if entry.Error != "" {
+		entryLog.WithField("error", entry.Error).Warn("Audit: write of setting not executed")
+	} else {
+		entryLog.Info("Audit: write of setting")
+	}
+	if a.w == nil {
+		return
+	}
+	if err := json.NewEncoder(a.w).Encode(entry); err != nil {
+		log.WithError(err).Error("Could not write audit log")
+	}
+}
@@ -0,0 +1,213 @@
+package api
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/ccremer/stiebeleltron-exporter/pkg/metrics"
+	"github.com/ccremer/stiebeleltron-exporter/pkg/stiebeleltron"
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+)
+
+type (
+	// SettingsHandler serves the whitelisted settings of the ISG and changes them.
+	// Every request has to be authorized with the token as bearer token.
+	// It implements prometheus.Collector to export the number of unauthorized requests, which aren't audited.
+	//
+	//	GET /api/v1/settings                      lists the settings and their ranges or options
+	//	PUT /api/v1/settings/<name>[?dryRun=true] writes {"value": ...} to the setting
+	SettingsHandler struct {
+		writer   stiebeleltron.SettingWriter
+		settings map[string]stiebeleltron.Setting
+		token    string
+		dryRun   bool
+		timeout  time.Duration
+		audit    *AuditLog
+
+		unauthorizedCounter prometheus.Counter
+	}
+	// settingInfo is a setting as listed by the SettingsHandler.
+	settingInfo struct {
+		stiebeleltron.Setting
+		Options []string `json:"options,omitempty"`
+	}
+	// writeRequest is the body of a write.
+	// The value is either a number or the name of an option.
+	writeRequest struct {
+		Value json.RawMessage `json:"value"`
+	}
+	// writeResponse is the body of the response to a successful write.
+	writeResponse struct {
+		Setting string `json:"setting"`
+		Value   string `json:"value"`
+		DryRun  bool   `json:"dryRun"`
+	}
+)
+
+// SettingsPath is the path of the SettingsHandler.
+const SettingsPath = "/api/v1/settings"
+
+// NewSettingsHandler returns a SettingsHandler that writes the given settings with the writer.
+// If dryRun is true, writes are validated and audited, but never executed.
+func NewSettingsHandler(writer stiebeleltron.SettingWriter, settings []stiebeleltron.Setting, token string, dryRun bool,
+	timeout time.Duration, audit *AuditLog) *SettingsHandler {
+	byName := make(map[string]stiebeleltron.Setting, len(settings))
+	for _, setting := range settings {
+		byName[setting.Name] = setting
+	}
+	return &SettingsHandler{
+		writer:   writer,
+		settings: byName,
+		token:    token,
+		dryRun:   dryRun,
+		timeout:  timeout,
+		audit:    audit,
+		unauthorizedCounter: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metrics.Namespace,
+			Name:      "settings_unauthorized_requests_total",
+			Help:      "Requests to the settings endpoint without valid token",
+		}),
+	}
+}
+
+// Describe implements prometheus.Collector.
+func (h *SettingsHandler) Describe(ch chan<- *prometheus.Desc) {
+	h.unauthorizedCounter.Describe(ch)
+}
+
+// Collect implements prometheus.Collector.
+func (h *SettingsHandler) Collect(ch chan<- prometheus.Metric) {
+	h.unauthorizedCounter.Collect(ch)
+}
+
+func (h *SettingsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	log.WithFields(log.Fields{
+		"uri":    r.RequestURI,
+		"client": r.RemoteAddr,
+	}).Debug("Accessed Settings endpoint")
+	if !h.authorized(r) {
+		// Not audited, so that anyone who can reach the endpoint can't flood the audit log.
+		h.unauthorizedCounter.Inc()
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, "invalid or missing token", http.StatusUnauthorized)
+		return
+	}
+	name := settingName(r)
+	switch {
+	case name == "" && r.Method == http.MethodGet:
+		h.list(w)
+	case name != "" && r.Method == http.MethodPut:
+		h.write(w, r, name)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// authorized returns true if the request has the token as bearer token.
+// The authentication scheme is compared ignoring case, the token in constant time.
+func (h *SettingsHandler) authorized(r *http.Request) bool {
+	scheme, token, found := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !found || !strings.EqualFold(scheme, "Bearer") {
+		return false
+	}
+	return h.token != "" && subtle.ConstantTimeCompare([]byte(token), []byte(h.token)) == 1
+}
+
+func settingName(r *http.Request) string {
+	return strings.Trim(strings.TrimPrefix(r.URL.Path, SettingsPath), "/")
+}
+
+func (h *SettingsHandler) list(w http.ResponseWriter) {
+	infos := make([]settingInfo, 0, len(h.settings))
+	for _, setting := range h.settings {
+		infos = append(infos, settingInfo{Setting: setting, Options: setting.OptionNames()})
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].Name < infos[j].Name
+	})
+	writeJSON(w, http.StatusOK, infos)
+}
+
+func (h *SettingsHandler) write(w http.ResponseWriter, r *http.Request, name string) {
+	dryRun := h.dryRun || r.URL.Query().Get("dryRun") == "true"
+	entry := AuditEntry{Client: r.RemoteAddr, Setting: name, DryRun: dryRun}
+	reject := func(status int, err error) {
+		entry.Result = ResultRejected
+		entry.Error = err.Error()
+		h.audit.Record(entry)
+		http.Error(w, err.Error(), status)
+	}
+
+	setting, exists := h.settings[name]
+	if !exists {
+		reject(http.StatusNotFound, fmt.Errorf("setting %s is not writable", name))
+		return
+	}
+	value, err := decodeValue(r)
+	if err != nil {
+		reject(http.StatusBadRequest, err)
+		return
+	}
+	entry.Value = value
+	if err := setting.Validate(value); err != nil {
+		reject(http.StatusBadRequest, err)
+		return
+	}
+
+	if dryRun {
+		entry.Result = ResultDryRun
+	} else {
+		ctx, cancel := context.WithTimeout(r.Context(), h.timeout)
+		defer cancel()
+		if err := h.writer.WriteSetting(ctx, setting, value); err != nil {
+			entry.Result = ResultFailed
+			entry.Error = err.Error()
+			h.audit.Record(entry)
+			status := http.StatusBadGateway
+			if errors.Is(err, stiebeleltron.ErrInvalidSettingValue) {
+				status = http.StatusBadRequest
+			}
+			http.Error(w, err.Error(), status)
+			return
+		}
+		entry.Result = ResultWritten
+	}
+	h.audit.Record(entry)
+	writeJSON(w, http.StatusOK, writeResponse{Setting: name, Value: value, DryRun: dryRun})
+}
+
+// decodeValue returns the value of the write request as text.
+func decodeValue(r *http.Request) (string, error) {
+	var body writeRequest
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		return "", fmt.Errorf("invalid request body: %w", err)
+	}
+	if len(body.Value) == 0 {
+		return "", errors.New("invalid request body: value is missing")
+	}
+	var text string
+	if err := json.Unmarshal(body.Value, &text); err == nil {
+		return text, nil
+	}
+	var number json.Number
+	if err := json.Unmarshal(body.Value, &number); err != nil {
+		return "", errors.New("invalid request body: value must be a number or a string")
+	}
+	return number.String(), nil
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.WithError(err).Warn("Could not write response")
+	}
+}
@@ -0,0 +1,228 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ccremer/stiebeleltron-exporter/pkg/stiebeleltron"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func bound(f float64) *float64 {
+	return &f
+}
+
+var testSettings = []stiebeleltron.Setting{
+	{Name: "dhw_set_temperature", ID: "val22", Min: bound(10), Max: bound(65), Step: 0.5},
+	{Name: "operating_mode", ID: "val39s", Options: map[string]string{"eco": "11", "standby": "1"}},
+}
+
+// newFakeISG returns a fake ISG that records the form data submitted to the save path.
+// It responds with a server error if fail is true.
+func newFakeISG(t *testing.T, fail bool, submitted *[]string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.NoError(t, r.ParseForm())
+		if fail {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		*submitted = append(*submitted, r.PostForm.Get("data"))
+		_, _ = w.Write([]byte(stiebeleltron.SettingsSavedResponse))
+	}))
+}
+
+func TestSettingsHandler_ServeHTTP(t *testing.T) {
+	tests := []struct {
+		name              string
+		method            string
+		path              string
+		token             string
+		authorization     string
+		body              string
+		dryRun            bool
+		failISG           bool
+		expectedStatus    int
+		expectedBody      string
+		expectedSubmitted []string
+		expectedResult    string
+		// unauthorized is true if the request is counted as unauthorized.
+		unauthorized bool
+	}{
+		{
+			name:           "GivenNoToken_ThenReturnUnauthorized",
+			method:         http.MethodPut,
+			path:           "/api/v1/settings/dhw_set_temperature",
+			body:           `{"value": 45}`,
+			expectedStatus: http.StatusUnauthorized,
+			expectedBody:   "invalid or missing token\n",
+			unauthorized:   true,
+		},
+		{
+			name:           "GivenWrongToken_ThenReturnUnauthorized",
+			method:         http.MethodPut,
+			path:           "/api/v1/settings/dhw_set_temperature",
+			token:          "wrong",
+			body:           `{"value": 45}`,
+			expectedStatus: http.StatusUnauthorized,
+			expectedBody:   "invalid or missing token\n",
+			unauthorized:   true,
+		},
+		{
+			name:           "GivenTokenWithoutBearerScheme_ThenReturnUnauthorized",
+			method:         http.MethodPut,
+			path:           "/api/v1/settings/dhw_set_temperature",
+			authorization:  "token",
+			body:           `{"value": 45}`,
+			expectedStatus: http.StatusUnauthorized,
+			expectedBody:   "invalid or missing token\n",
+			unauthorized:   true,
+		},
+		{
+			name:           "GivenList_ThenReturnSettings",
+			method:         http.MethodGet,
+			path:           "/api/v1/settings",
+			token:          "token",
+			expectedStatus: http.StatusOK,
+			expectedBody: `[{"name":"dhw_set_temperature","min":10,"max":65,"step":0.5},` +
+				`{"name":"operating_mode","options":["eco","standby"]}]` + "\n",
+		},
+		{
+			name:              "GivenNumber_ThenWriteToISG",
+			method:            http.MethodPut,
+			path:              "/api/v1/settings/dhw_set_temperature",
+			token:             "token",
+			body:              `{"value": 42.5}`,
+			expectedStatus:    http.StatusOK,
+			expectedBody:      `{"setting":"dhw_set_temperature","value":"42.5","dryRun":false}` + "\n",
+			expectedSubmitted: []string{`[{"name":"val22","value":"42,5"}]`},
+			expectedResult:    ResultWritten,
+		},
+		{
+			name:              "GivenOption_ThenWriteToISG",
+			method:            http.MethodPut,
+			path:              "/api/v1/settings/operating_mode",
+			token:             "token",
+			body:              `{"value": "eco"}`,
+			expectedStatus:    http.StatusOK,
+			expectedBody:      `{"setting":"operating_mode","value":"eco","dryRun":false}` + "\n",
+			expectedSubmitted: []string{`[{"name":"val39s","value":"11"}]`},
+			expectedResult:    ResultWritten,
+		},
+		{
+			name:           "GivenDryRunParameter_ThenDontWriteToISG",
+			method:         http.MethodPut,
+			path:           "/api/v1/settings/operating_mode?dryRun=true",
+			token:          "token",
+			body:           `{"value": "eco"}`,
+			expectedStatus: http.StatusOK,
+			expectedBody:   `{"setting":"operating_mode","value":"eco","dryRun":true}` + "\n",
+			expectedResult: ResultDryRun,
+		},
+		{
+			name:           "GivenDryRunMode_ThenDontWriteToISG",
+			method:         http.MethodPut,
+			path:           "/api/v1/settings/operating_mode",
+			token:          "token",
+			body:           `{"value": "eco"}`,
+			dryRun:         true,
+			expectedStatus: http.StatusOK,
+			expectedBody:   `{"setting":"operating_mode","value":"eco","dryRun":true}` + "\n",
+			expectedResult: ResultDryRun,
+		},
+		{
+			name:           "GivenValueOutOfRange_ThenReturnBadRequest",
+			method:         http.MethodPut,
+			path:           "/api/v1/settings/dhw_set_temperature",
+			token:          "token",
+			body:           `{"value": 80}`,
+			expectedStatus: http.StatusBadRequest,
+			expectedBody:   "invalid value 80 for dhw_set_temperature: must be between 10 and 65\n",
+			expectedResult: ResultRejected,
+		},
+		{
+			name:           "GivenSettingNotWhitelisted_ThenReturnNotFound",
+			method:         http.MethodPut,
+			path:           "/api/v1/settings/heating_curve",
+			token:          "token",
+			body:           `{"value": 0.6}`,
+			expectedStatus: http.StatusNotFound,
+			expectedBody:   "setting heating_curve is not writable\n",
+			expectedResult: ResultRejected,
+		},
+		{
+			name:           "GivenNoValue_ThenReturnBadRequest",
+			method:         http.MethodPut,
+			path:           "/api/v1/settings/operating_mode",
+			token:          "token",
+			body:           `{}`,
+			expectedStatus: http.StatusBadRequest,
+			expectedBody:   "invalid request body: value is missing\n",
+			expectedResult: ResultRejected,
+		},
+		{
+			name:           "GivenISGError_ThenReturnBadGateway",
+			method:         http.MethodPut,
+			path:           "/api/v1/settings/operating_mode",
+			token:          "token",
+			body:           `{"value": "eco"}`,
+			failISG:        true,
+			expectedStatus: http.StatusBadGateway,
+			expectedBody:   "could not write setting operating_mode: ISG responded with 500 Internal Server Error\n",
+			expectedResult: ResultFailed,
+		},
+		{
+			name:           "GivenPost_ThenReturnMethodNotAllowed",
+			method:         http.MethodPost,
+			path:           "/api/v1/settings/operating_mode",
+			token:          "token",
+			body:           `{"value": "eco"}`,
+			expectedStatus: http.StatusMethodNotAllowed,
+			expectedBody:   "method not allowed\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var submitted []string
+			isg := newFakeISG(t, tt.failISG, &submitted)
+			defer isg.Close()
+			client, err := stiebeleltron.NewISGClient(stiebeleltron.ClientOptions{BaseURL: isg.URL})
+			require.NoError(t, err)
+			auditBuffer := &bytes.Buffer{}
+			handler := NewSettingsHandler(client, testSettings, "token", tt.dryRun, time.Second, NewAuditLog(auditBuffer))
+
+			req := httptest.NewRequest(tt.method, tt.path, strings.NewReader(tt.body))
+			if tt.token != "" {
+				req.Header.Set("Authorization", "Bearer "+tt.token)
+			}
+			if tt.authorization != "" {
+				req.Header.Set("Authorization", tt.authorization)
+			}
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+
+			assert.Equal(t, tt.expectedStatus, rec.Code)
+			assert.Equal(t, tt.expectedBody, rec.Body.String())
+			assert.Equal(t, tt.expectedSubmitted, submitted)
+			expectedUnauthorized := 0.0
+			if tt.unauthorized {
+				expectedUnauthorized = 1
+			}
+			assert.Equal(t, expectedUnauthorized, testutil.ToFloat64(handler.unauthorizedCounter))
+			if tt.expectedResult == "" {
+				assert.Empty(t, auditBuffer.String(), "requests that don't write shouldn't be audited")
+				return
+			}
+			var entry AuditEntry
+			require.NoError(t, json.Unmarshal(auditBuffer.Bytes(), &entry))
+			assert.Equal(t, tt.expectedResult, entry.Result)
+			assert.Equal(t, tt.dryRun || strings.Contains(tt.path, "dryRun=true"), entry.DryRun)
+		})
+	}
+}
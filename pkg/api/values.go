@@ -0,0 +1,162 @@
+package api
+
+import (
+	"math"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/ccremer/stiebeleltron-exporter/pkg/metrics"
+	log "github.com/sirupsen/logrus"
+)
+
+type (
+	// SnapshotSource returns the current values of the ISG, or nil if there are none.
+	SnapshotSource interface {
+		CurrentSnapshot() *metrics.Snapshot
+	}
+	// ValuesHandler serves the current values of the ISG as JSON.
+	//
+	//	GET /api/v1/values                          lists the values by page and group
+	//	GET /api/v1/values/<group>/<name>[?label=…]  returns a single value, labels select among values with the same name
+	ValuesHandler struct {
+		source SnapshotSource
+	}
+	// valuesResponse is the body of the response that lists all values.
+	valuesResponse struct {
+		Timestamp time.Time `json:"timestamp"`
+		// Pages maps the pages to their groups and the groups to their values.
+		Pages map[string]map[string][]value `json:"pages"`
+	}
+	// value is a single value of a metric.
+	value struct {
+		Page  string `json:"page"`
+		Group string `json:"group"`
+		Name  string `json:"name"`
+		// Value is nil for metrics exported as state set and for values that aren't a number.
+		Value       *float64          `json:"value"`
+		State       string            `json:"state,omitempty"`
+		Unit        string            `json:"unit,omitempty"`
+		Type        string            `json:"type"`
+		Description string            `json:"description,omitempty"`
+		Labels      map[string]string `json:"labels,omitempty"`
+		Timestamp   time.Time         `json:"timestamp"`
+	}
+)
+
+// ValuesPath is the path of the ValuesHandler.
+const ValuesPath = "/api/v1/values"
+
+// NewValuesHandler returns a ValuesHandler that serves the values of the source.
+func NewValuesHandler(source SnapshotSource) *ValuesHandler {
+	return &ValuesHandler{source: source}
+}
+
+func (h *ValuesHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	log.WithFields(log.Fields{
+		"uri":    r.RequestURI,
+		"client": r.RemoteAddr,
+	}).Debug("Accessed Values endpoint")
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, ValuesPath), "/")
+	var group, name string
+	if path != "" {
+		parts := strings.Split(path, "/")
+		if len(parts) != 2 {
+			http.Error(w, "not found, expected "+ValuesPath+"/<group>/<name>", http.StatusNotFound)
+			return
+		}
+		group, name = parts[0], parts[1]
+	}
+
+	snapshot := h.source.CurrentSnapshot()
+	if snapshot == nil {
+		http.Error(w, "no current values, the ISG couldn't be polled", http.StatusServiceUnavailable)
+		return
+	}
+	if path == "" {
+		h.list(w, snapshot)
+		return
+	}
+	h.get(w, r, snapshot, group, name)
+}
+
+func (h *ValuesHandler) list(w http.ResponseWriter, snapshot *metrics.Snapshot) {
+	response := valuesResponse{Timestamp: snapshot.Timestamp, Pages: map[string]map[string][]value{}}
+	for _, s := range snapshot.Samples {
+		groups, exists := response.Pages[s.Page]
+		if !exists {
+			groups = map[string][]value{}
+			response.Pages[s.Page] = groups
+		}
+		groups[s.Metric.Group] = append(groups[s.Metric.Group], toValue(s, snapshot.SampleTimestamp(s)))
+	}
+	writeJSON(w, http.StatusOK, response)
+}
+
+func (h *ValuesHandler) get(w http.ResponseWriter, r *http.Request, snapshot *metrics.Snapshot, group, name string) {
+	var matches []value
+	// labels holds the label names of the values with that name, nil if there are none.
+	var labels map[string]bool
+	for _, s := range snapshot.Samples {
+		if s.Metric.Group != group || s.Metric.GaugeName != name {
+			continue
+		}
+		if labels == nil {
+			labels = map[string]bool{}
+		}
+		for label := range s.Metric.Labels {
+			labels[label] = true
+		}
+		if matchesLabels(s, r) {
+			matches = append(matches, toValue(s, snapshot.SampleTimestamp(s)))
+		}
+	}
+	for param := range r.URL.Query() {
+		if labels != nil && !labels[param] {
+			http.Error(w, "unknown label "+param+" of "+group+"/"+name, http.StatusBadRequest)
+			return
+		}
+	}
+	switch len(matches) {
+	case 0:
+		http.Error(w, "no current value of "+group+"/"+name, http.StatusNotFound)
+	case 1:
+		writeJSON(w, http.StatusOK, matches[0])
+	default:
+		http.Error(w, "more than one value of "+group+"/"+name+", select one with its labels as query parameters", http.StatusBadRequest)
+	}
+}
+
+// matchesLabels returns true if the sample has all labels given as query parameters.
+func matchesLabels(s metrics.Sample, r *http.Request) bool {
+	for label := range r.URL.Query() {
+		if s.Metric.Labels[label] != r.URL.Query().Get(label) {
+			return false
+		}
+	}
+	return true
+}
+
+func toValue(s metrics.Sample, timestamp time.Time) value {
+	v := value{
+		Page:        s.Page,
+		Group:       s.Metric.Group,
+		Name:        s.Metric.GaugeName,
+		State:       s.State,
+		Unit:        s.Metric.Unit,
+		Type:        s.Metric.Type,
+		Description: s.Metric.HelpText,
+		Labels:      s.Metric.Labels,
+		Timestamp:   timestamp,
+	}
+	// JSON has no representation of NaN and infinity.
+	if !s.Metric.IsStateSet() && !math.IsNaN(s.Value) && !math.IsInf(s.Value, 0) {
+		number := s.Value
+		v.Value = &number
+	}
+	return v
+}
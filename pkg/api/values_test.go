@@ -0,0 +1,151 @@
+package api
+
+import (
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/ccremer/stiebeleltron-exporter/pkg/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+)
+
+// stubSource returns a fixed snapshot.
+type stubSource struct {
+	snapshot *metrics.Snapshot
+}
+
+func (s *stubSource) CurrentSnapshot() *metrics.Snapshot {
+	return s.snapshot
+}
+
+var testSnapshot = &metrics.Snapshot{Timestamp: time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC), Samples: []metrics.Sample{
+	{Page: "info", Metric: &metrics.PrometheusMetric{Group: "temperature", GaugeName: "outside", Type: metrics.MetricTypeGauge,
+		Unit: "celsius", HelpText: "Outside temperature"}, Value: -3.5},
+	{Page: "info", Metric: &metrics.PrometheusMetric{Group: "room_temperature", GaugeName: "heating_circuit", Type: metrics.MetricTypeGauge,
+		Labels: prometheus.Labels{"circuit": "hc1"}}, Value: 21.5},
+	{Page: "info", Metric: &metrics.PrometheusMetric{Group: "room_temperature", GaugeName: "heating_circuit", Type: metrics.MetricTypeGauge,
+		Labels: prometheus.Labels{"circuit": "hc2"}}, Value: 20},
+	{Page: "status", Metric: &metrics.PrometheusMetric{Group: "status", GaugeName: "operating_mode", Type: metrics.MetricTypeGauge,
+		States: map[string]string{"ECO MODE": "eco"}}, State: "eco"},
+	{Page: "status", Metric: &metrics.PrometheusMetric{Group: "status", GaugeName: "flow_rate", Type: metrics.MetricTypeGauge},
+		Value: math.NaN()},
+}}
+
+func TestValuesHandler_ServeHTTP(t *testing.T) {
+	tests := []struct {
+		name           string
+		method         string
+		path           string
+		snapshot       *metrics.Snapshot
+		expectedStatus int
+		expectedBody   string
+	}{
+		{
+			name:           "GivenSnapshot_ThenListValuesByPageAndGroup",
+			method:         http.MethodGet,
+			path:           "/api/v1/values",
+			snapshot:       testSnapshot,
+			expectedStatus: http.StatusOK,
+			expectedBody: `{"timestamp":"2023-01-01T00:00:00Z","pages":{` +
+				`"info":{"room_temperature":[` +
+				`{"page":"info","group":"room_temperature","name":"heating_circuit","value":21.5,"type":"gauge","labels":{"circuit":"hc1"},"timestamp":"2023-01-01T00:00:00Z"},` +
+				`{"page":"info","group":"room_temperature","name":"heating_circuit","value":20,"type":"gauge","labels":{"circuit":"hc2"},"timestamp":"2023-01-01T00:00:00Z"}],` +
+				`"temperature":[{"page":"info","group":"temperature","name":"outside","value":-3.5,"unit":"celsius","type":"gauge","description":"Outside temperature","timestamp":"2023-01-01T00:00:00Z"}]},` +
+				`"status":{"status":[` +
+				`{"page":"status","group":"status","name":"operating_mode","value":null,"state":"eco","type":"gauge","timestamp":"2023-01-01T00:00:00Z"},` +
+				`{"page":"status","group":"status","name":"flow_rate","value":null,"type":"gauge","timestamp":"2023-01-01T00:00:00Z"}]}}}` + "\n",
+		},
+		{
+			name:           "GivenSingleValue_ThenReturnValue",
+			method:         http.MethodGet,
+			path:           "/api/v1/values/temperature/outside",
+			snapshot:       testSnapshot,
+			expectedStatus: http.StatusOK,
+			expectedBody:   `{"page":"info","group":"temperature","name":"outside","value":-3.5,"unit":"celsius","type":"gauge","description":"Outside temperature","timestamp":"2023-01-01T00:00:00Z"}` + "\n",
+		},
+		{
+			name:   "GivenValueOfEarlierScrape_ThenReturnTimestampOfPage",
+			method: http.MethodGet,
+			path:   "/api/v1/values/temperature/outside",
+			snapshot: &metrics.Snapshot{Timestamp: testSnapshot.Timestamp, Samples: testSnapshot.Samples,
+				PageTimestamps: map[string]time.Time{"info": time.Date(2022, 12, 31, 23, 59, 0, 0, time.UTC)}},
+			expectedStatus: http.StatusOK,
+			expectedBody:   `{"page":"info","group":"temperature","name":"outside","value":-3.5,"unit":"celsius","type":"gauge","description":"Outside temperature","timestamp":"2022-12-31T23:59:00Z"}` + "\n",
+		},
+		{
+			name:           "GivenValuesWithLabels_WhenLabelSelected_ThenReturnValue",
+			method:         http.MethodGet,
+			path:           "/api/v1/values/room_temperature/heating_circuit?circuit=hc2",
+			snapshot:       testSnapshot,
+			expectedStatus: http.StatusOK,
+			expectedBody:   `{"page":"info","group":"room_temperature","name":"heating_circuit","value":20,"type":"gauge","labels":{"circuit":"hc2"},"timestamp":"2023-01-01T00:00:00Z"}` + "\n",
+		},
+		{
+			name:           "GivenValuesWithLabels_WhenNoLabelSelected_ThenReturnBadRequest",
+			method:         http.MethodGet,
+			path:           "/api/v1/values/room_temperature/heating_circuit",
+			snapshot:       testSnapshot,
+			expectedStatus: http.StatusBadRequest,
+			expectedBody:   "more than one value of room_temperature/heating_circuit, select one with its labels as query parameters\n",
+		},
+		{
+			name:           "GivenUnknownLabel_ThenReturnBadRequest",
+			method:         http.MethodGet,
+			path:           "/api/v1/values/room_temperature/heating_circuit?circuit=hc2&zone=1",
+			snapshot:       testSnapshot,
+			expectedStatus: http.StatusBadRequest,
+			expectedBody:   "unknown label zone of room_temperature/heating_circuit\n",
+		},
+		{
+			name:           "GivenLabelOfValueWithoutLabels_ThenReturnBadRequest",
+			method:         http.MethodGet,
+			path:           "/api/v1/values/temperature/outside?circuit=hc1",
+			snapshot:       testSnapshot,
+			expectedStatus: http.StatusBadRequest,
+			expectedBody:   "unknown label circuit of temperature/outside\n",
+		},
+		{
+			name:           "GivenUnknownValue_ThenReturnNotFound",
+			method:         http.MethodGet,
+			path:           "/api/v1/values/temperature/inside",
+			snapshot:       testSnapshot,
+			expectedStatus: http.StatusNotFound,
+			expectedBody:   "no current value of temperature/inside\n",
+		},
+		{
+			name:           "GivenInvalidPath_ThenReturnNotFound",
+			method:         http.MethodGet,
+			path:           "/api/v1/values/temperature",
+			snapshot:       testSnapshot,
+			expectedStatus: http.StatusNotFound,
+			expectedBody:   "not found, expected /api/v1/values/<group>/<name>\n",
+		},
+		{
+			name:           "GivenStaleSnapshot_ThenReturnServiceUnavailable",
+			method:         http.MethodGet,
+			path:           "/api/v1/values",
+			expectedStatus: http.StatusServiceUnavailable,
+			expectedBody:   "no current values, the ISG couldn't be polled\n",
+		},
+		{
+			name:           "GivenPost_ThenReturnMethodNotAllowed",
+			method:         http.MethodPost,
+			path:           "/api/v1/values",
+			snapshot:       testSnapshot,
+			expectedStatus: http.StatusMethodNotAllowed,
+			expectedBody:   "method not allowed\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			NewValuesHandler(&stubSource{snapshot: tt.snapshot}).ServeHTTP(rec, httptest.NewRequest(tt.method, tt.path, nil))
+
+			assert.Equal(t, tt.expectedStatus, rec.Code)
+			assert.Equal(t, tt.expectedBody, rec.Body.String())
+		})
+	}
+}
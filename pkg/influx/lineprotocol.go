@@ -0,0 +1,115 @@
+package influx
+
+import (
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/ccremer/stiebeleltron-exporter/pkg/metrics"
+	log "github.com/sirupsen/logrus"
+)
+
+type (
+	// SnapshotSource returns the current values, e.g. a metrics.Collector.
+	SnapshotSource interface {
+		CurrentSnapshot() *metrics.Snapshot
+	}
+	// Handler serves the current values in InfluxDB line protocol, e.g. for the http input of Telegraf.
+	Handler struct {
+		source SnapshotSource
+	}
+)
+
+var (
+	measurementEscaper = strings.NewReplacer(",", `\,`, " ", `\ `)
+	keyEscaper         = strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `)
+	stringEscaper      = strings.NewReplacer(`"`, `\"`, `\`, `\\`)
+)
+
+// Encode returns the samples of the snapshot in InfluxDB line protocol, see Lines.
+func Encode(snapshot *metrics.Snapshot) []byte {
+	var b strings.Builder
+	for _, line := range Lines(snapshot) {
+		b.WriteString(line)
+		b.WriteString("\n")
+	}
+	return []byte(b.String())
+}
+
+// Lines returns the samples of the snapshot in InfluxDB line protocol, one line per sample.
+// The measurement is made of the namespace and the group of the metric, the field is the name of the metric and the
+// labels are tags, e.g. "stiebeleltron_room_temperature,circuit=hc1,state=actual heating_circuit=21.5 1672531200000000000".
+// The state of a metric exported as state set is a string field.
+// Values that can't be represented in line protocol, e.g. NaN, are skipped.
+func Lines(snapshot *metrics.Snapshot) []string {
+	lines := make([]string, 0, len(snapshot.Samples))
+	for _, sample := range snapshot.Samples {
+		value, valid := fieldValue(sample)
+		if !valid {
+			continue
+		}
+		metric := sample.Metric
+		var b strings.Builder
+		b.WriteString(measurementEscaper.Replace(metrics.Namespace + "_" + metric.Group))
+		for _, name := range sortedLabelNames(metric) {
+			if metric.Labels[name] == "" {
+				// Tags with empty values are invalid.
+				continue
+			}
+			b.WriteString(",")
+			b.WriteString(keyEscaper.Replace(name))
+			b.WriteString("=")
+			b.WriteString(keyEscaper.Replace(metric.Labels[name]))
+		}
+		b.WriteString(" ")
+		b.WriteString(keyEscaper.Replace(metric.GaugeName))
+		b.WriteString("=")
+		b.WriteString(value)
+		b.WriteString(" ")
+		b.WriteString(strconv.FormatInt(snapshot.SampleTimestamp(sample).UnixNano(), 10))
+		lines = append(lines, b.String())
+	}
+	return lines
+}
+
+func fieldValue(sample metrics.Sample) (string, bool) {
+	if sample.Metric.IsStateSet() {
+		return `"` + stringEscaper.Replace(sample.State) + `"`, true
+	}
+	if math.IsNaN(sample.Value) || math.IsInf(sample.Value, 0) {
+		return "", false
+	}
+	return strconv.FormatFloat(sample.Value, 'f', -1, 64), true
+}
+
+func sortedLabelNames(metric *metrics.PrometheusMetric) []string {
+	names := make([]string, 0, len(metric.Labels))
+	for name := range metric.Labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// NewHandler returns a Handler that serves the current values of the given source.
+func NewHandler(source SnapshotSource) *Handler {
+	return &Handler{source: source}
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	log.WithFields(log.Fields{
+		"uri":    r.RequestURI,
+		"client": r.RemoteAddr,
+	}).Debug("Accessed Influx endpoint")
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	snapshot := h.source.CurrentSnapshot()
+	if snapshot == nil {
+		// Like for Prometheus, stale values are omitted.
+		return
+	}
+	if _, err := w.Write(Encode(snapshot)); err != nil {
+		log.WithError(err).Warn("Could not write response")
+	}
+}
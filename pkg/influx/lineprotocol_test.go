@@ -0,0 +1,100 @@
+package influx
+
+import (
+	"math"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/ccremer/stiebeleltron-exporter/pkg/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+)
+
+var testTimestamp = time.Unix(1672531200, 0)
+
+func TestEncode(t *testing.T) {
+	tests := []struct {
+		name     string
+		samples  []metrics.Sample
+		expected string
+	}{
+		{
+			name: "GivenMetricWithLabels_ThenWriteTagsSortedByName",
+			samples: []metrics.Sample{{
+				Metric: &metrics.PrometheusMetric{Group: "room_temperature", GaugeName: "heating_circuit",
+					Labels: prometheus.Labels{"state": "actual", "circuit": "hc1"}},
+				Value: 21.5,
+			}},
+			expected: "stiebeleltron_room_temperature,circuit=hc1,state=actual heating_circuit=21.5 1672531200000000000\n",
+		},
+		{
+			name: "GivenStateSet_ThenWriteStringField",
+			samples: []metrics.Sample{{
+				Metric: &metrics.PrometheusMetric{Group: "status", GaugeName: "operating_mode", States: map[string]string{"ECO MODE": "eco"}},
+				State:  "eco",
+			}},
+			expected: "stiebeleltron_status operating_mode=\"eco\" 1672531200000000000\n",
+		},
+		{
+			name: "GivenSpecialCharacters_ThenEscape",
+			samples: []metrics.Sample{{
+				Metric: &metrics.PrometheusMetric{Group: "energy", GaugeName: "total",
+					Labels: prometheus.Labels{"type": "heat pump,dhw=1"}},
+				Value: 1,
+			}},
+			expected: "stiebeleltron_energy,type=heat\\ pump\\,dhw\\=1 total=1 1672531200000000000\n",
+		},
+		{
+			name: "GivenNaN_ThenSkip",
+			samples: []metrics.Sample{
+				{Metric: &metrics.PrometheusMetric{Group: "runtime", GaugeName: "compressor"}, Value: math.NaN()},
+				{Metric: &metrics.PrometheusMetric{Group: "runtime", GaugeName: "reheating"}, Value: 3600},
+			},
+			expected: "stiebeleltron_runtime reheating=3600 1672531200000000000\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result := Encode(&metrics.Snapshot{Timestamp: testTimestamp, Samples: tt.samples})
+			assert.Equal(t, tt.expected, string(result))
+		})
+	}
+}
+
+// stubSource returns a fixed snapshot.
+type stubSource struct {
+	snapshot *metrics.Snapshot
+}
+
+func (s *stubSource) CurrentSnapshot() *metrics.Snapshot {
+	return s.snapshot
+}
+
+func TestHandler_ServeHTTP(t *testing.T) {
+	tests := []struct {
+		name     string
+		snapshot *metrics.Snapshot
+		expected string
+	}{
+		{
+			name: "GivenSnapshot_ThenServeLines",
+			snapshot: &metrics.Snapshot{Timestamp: testTimestamp, Samples: []metrics.Sample{
+				{Metric: &metrics.PrometheusMetric{Group: "runtime", GaugeName: "compressor"}, Value: 7200},
+			}},
+			expected: "stiebeleltron_runtime compressor=7200 1672531200000000000\n",
+		},
+		{
+			name: "GivenStaleSnapshot_ThenServeNothing",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			NewHandler(&stubSource{snapshot: tt.snapshot}).ServeHTTP(rec, httptest.NewRequest("GET", "/influx", nil))
+			assert.Equal(t, 200, rec.Code)
+			assert.Equal(t, "text/plain; charset=utf-8", rec.Header().Get("Content-Type"))
+			assert.Equal(t, tt.expected, rec.Body.String())
+		})
+	}
+}
@@ -0,0 +1,124 @@
+package influx
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/ccremer/stiebeleltron-exporter/pkg/metrics"
+	"github.com/ccremer/stiebeleltron-exporter/pkg/pushbuffer"
+)
+
+type (
+	// PushOptions configures a Pusher.
+	PushOptions struct {
+		// URL is the base URL of InfluxDB, e.g. "http://localhost:8086".
+		URL    string
+		Org    string
+		Bucket string
+		Token  string
+		// BatchSize is the maximum number of lines per write request.
+		BatchSize int
+		// BufferSize is the maximum number of lines that are kept until they are written.
+		// If InfluxDB isn't reachable for long enough, the oldest lines are dropped.
+		BufferSize int
+		// Timeout is the timeout of each write request.
+		Timeout time.Duration
+	}
+	// Pusher implements metrics.SnapshotHandler.
+	// It buffers the values of each Snapshot and writes them to the InfluxDB v2 write endpoint in batches.
+	// Batches that fail with a temporary error are kept in the buffer and retried with exponential backoff.
+	Pusher struct {
+		options PushOptions
+		client  http.Client
+		buffer  *pushbuffer.Buffer[string]
+	}
+	// writeError is an error response of InfluxDB.
+	writeError struct {
+		status int
+		body   string
+	}
+)
+
+// NewPusher returns a new Pusher with an empty buffer.
+func NewPusher(options PushOptions) *Pusher {
+	p := &Pusher{
+		options: options,
+		client:  http.Client{Timeout: options.Timeout},
+	}
+	p.buffer = pushbuffer.New(pushbuffer.Options{
+		Target:     "InfluxDB",
+		BatchSize:  options.BatchSize,
+		BufferSize: options.BufferSize,
+	}, p.write)
+	return p
+}
+
+// HandleSnapshot implements metrics.SnapshotHandler.
+func (p *Pusher) HandleSnapshot(snapshot *metrics.Snapshot) {
+	p.buffer.Add(Lines(snapshot)...)
+}
+
+// Start flushes the buffer in the given interval until the context is cancelled.
+// After a temporary error, the lines are retried with exponential backoff of up to the interval.
+func (p *Pusher) Start(ctx context.Context, interval time.Duration) {
+	p.buffer.Start(ctx, interval)
+}
+
+// Buffered returns the number of lines that weren't written yet.
+func (p *Pusher) Buffered() int {
+	return p.buffer.Buffered()
+}
+
+// Flush writes the buffered lines in batches, the oldest first.
+// If a batch fails with a temporary error, e.g. a network error or a server error, it and all following batches stay
+// in the buffer and the error is returned.
+// A batch that InfluxDB rejects permanently, e.g. because of invalid lines, is dropped.
+func (p *Pusher) Flush(ctx context.Context) error {
+	return p.buffer.Flush(ctx)
+}
+
+func (p *Pusher) write(ctx context.Context, lines []string) error {
+	query := url.Values{
+		"org":       {p.options.Org},
+		"bucket":    {p.options.Bucket},
+		"precision": {"ns"},
+	}
+	body := strings.Join(lines, "\n") + "\n"
+	req, err := http.NewRequestWithContext(ctx, "POST", strings.TrimSuffix(p.options.URL, "/")+"/api/v2/write?"+query.Encode(), strings.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	if p.options.Token != "" {
+		req.Header.Set("Authorization", "Token "+p.options.Token)
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return nil
+	}
+	b, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	err = &writeError{status: resp.StatusCode, body: strings.TrimSpace(string(b))}
+	if !isTemporary(resp.StatusCode) {
+		return pushbuffer.Permanent(err)
+	}
+	return err
+}
+
+func (e *writeError) Error() string {
+	return fmt.Sprintf("InfluxDB responded with status %d: %s", e.status, e.body)
+}
+
+// isTemporary returns true if writing the lines again may succeed.
+// Only client errors other than rate limiting are permanent.
+func isTemporary(status int) bool {
+	return status == http.StatusTooManyRequests || status >= 500
+}
@@ -0,0 +1,108 @@
+package influx
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/ccremer/stiebeleltron-exporter/pkg/metrics"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newReceiver returns a fake InfluxDB that responds with the given status codes in order, then with 204.
+// The bodies of successful writes are recorded.
+func newReceiver(t *testing.T, statuses []int, written *[]string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/api/v2/write", r.URL.Path)
+		assert.Equal(t, "home", r.URL.Query().Get("org"))
+		assert.Equal(t, "isg", r.URL.Query().Get("bucket"))
+		assert.Equal(t, "ns", r.URL.Query().Get("precision"))
+		assert.Equal(t, "Token secret", r.Header.Get("Authorization"))
+		body, err := io.ReadAll(r.Body)
+		require.NoError(t, err)
+		if len(statuses) > 0 {
+			status := statuses[0]
+			statuses = statuses[1:]
+			w.WriteHeader(status)
+			return
+		}
+		*written = append(*written, string(body))
+		w.WriteHeader(http.StatusNoContent)
+	}))
+}
+
+// newTestSnapshot returns a snapshot with a runtime sample per value.
+func newTestSnapshot(values ...float64) *metrics.Snapshot {
+	snapshot := &metrics.Snapshot{Timestamp: testTimestamp}
+	for _, v := range values {
+		snapshot.Samples = append(snapshot.Samples, metrics.Sample{
+			Metric: &metrics.PrometheusMetric{Group: "runtime", GaugeName: "compressor"}, Value: v,
+		})
+	}
+	return snapshot
+}
+
+func TestPusher_Flush(t *testing.T) {
+	tests := []struct {
+		name             string
+		values           []float64
+		batchSize        int
+		statuses         []int
+		expectedErr      bool
+		expectedWritten  []string
+		expectedBuffered int
+	}{
+		{
+			name:      "GivenLinesMoreThanBatchSize_ThenWriteInBatches",
+			values:    []float64{1, 2, 3},
+			batchSize: 2,
+			expectedWritten: []string{
+				"stiebeleltron_runtime compressor=1 1672531200000000000\nstiebeleltron_runtime compressor=2 1672531200000000000\n",
+				"stiebeleltron_runtime compressor=3 1672531200000000000\n",
+			},
+		},
+		{
+			name:             "GivenServerError_ThenKeepLinesForRetry",
+			values:           []float64{1, 2, 3},
+			batchSize:        2,
+			statuses:         []int{http.StatusServiceUnavailable},
+			expectedErr:      true,
+			expectedBuffered: 3,
+		},
+		{
+			name:      "GivenClientError_ThenDropBatch",
+			values:    []float64{1, 2, 3},
+			batchSize: 2,
+			statuses:  []int{http.StatusBadRequest},
+			expectedWritten: []string{
+				"stiebeleltron_runtime compressor=3 1672531200000000000\n",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var written []string
+			receiver := newReceiver(t, tt.statuses, &written)
+			defer receiver.Close()
+			pusher := NewPusher(PushOptions{
+				URL: receiver.URL, Org: "home", Bucket: "isg", Token: "secret",
+				BatchSize: tt.batchSize, Timeout: time.Second,
+			})
+
+			pusher.HandleSnapshot(newTestSnapshot(tt.values...))
+			err := pusher.Flush(context.Background())
+
+			if tt.expectedErr {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+			assert.Equal(t, tt.expectedWritten, written)
+			assert.Equal(t, tt.expectedBuffered, pusher.Buffered())
+		})
+	}
+}
@@ -0,0 +1,596 @@
+package metrics
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/ccremer/stiebeleltron-exporter/pkg/state"
+	"github.com/ccremer/stiebeleltron-exporter/pkg/stiebeleltron"
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+)
+
+// countersKey is the key of the offsets of counters in the state.Store.
+const countersKey = "counters"
+
+type (
+	// Collector implements prometheus.Collector.
+	// By default, each call to Collect scrapes the ISG and emits only the values that could be parsed in that scrape.
+	// With StartPolling, the ISG is scraped in the background instead and Collect serves the latest values of each page.
+	Collector struct {
+		parsers map[string]stiebeleltron.PageParser
+		pages   []*Page
+		timeout time.Duration
+
+		scrapeErrorCounter        prometheus.Counter
+		parseErrorCounter         prometheus.Counter
+		scrapeDurationGauge       *prometheus.Desc
+		lastSuccessfulScrapeGauge *prometheus.Desc
+		pageLastSuccessGauge      *prometheus.Desc
+		propertyValueGauge        *prometheus.Desc
+
+		discovery bool
+
+		mu                   sync.RWMutex
+		polling              bool
+		maxAge               time.Duration
+		lastScrape           *Snapshot
+		pageSnapshots        map[string]*pageSnapshot
+		lastSuccessfulScrape time.Time
+
+		counterMu sync.Mutex
+		counters  map[string]*counterState
+		daily     *DailyCounters
+		store     state.Store
+
+		handlers []SnapshotHandler
+
+		scrapeMu sync.Mutex
+		inflight *scrapeCall
+	}
+	// scrapeCall is a scrape in progress that concurrent callers of Scrape wait for.
+	scrapeCall struct {
+		done     chan struct{}
+		snapshot *Snapshot
+	}
+	// SnapshotHandler is notified of each Snapshot, e.g. to publish the values to other systems than Prometheus.
+	SnapshotHandler interface {
+		HandleSnapshot(snapshot *Snapshot)
+	}
+	// counterState tracks the resets of a cumulative ISG value, so that the exported counter never decreases.
+	counterState struct {
+		Last   float64 `json:"last"`
+		Offset float64 `json:"offset"`
+	}
+	// Snapshot holds the values of a single scrape.
+	Snapshot struct {
+		// Timestamp is the time when the scrape started.
+		Timestamp time.Time
+		// Duration is the time it took to scrape all pages.
+		Duration time.Duration
+		// Successful is true if all pages could be fetched within the timeout.
+		Successful bool
+		// PageTimestamps maps the pages to the start of the scrape that their values are from.
+		// It's only set for pages whose values are from an earlier scrape than Timestamp, see SampleTimestamp.
+		PageTimestamps map[string]time.Time
+		// Samples contains the values that could be parsed.
+		Samples []Sample
+		// Discovered contains all numeric values found in the pages, if discovery is enabled.
+		Discovered []DiscoveredSample
+	}
+	// DiscoveredSample is a numeric value found in a page in discovery mode, regardless of the definitions.
+	DiscoveredSample struct {
+		Page     string
+		Group    string
+		Property string
+		Value    float64
+	}
+	// Sample is a parsed and transformed value of a PrometheusMetric.
+	Sample struct {
+		// Page is the name of the page in the definitions that the value was parsed from.
+		Page   string
+		Metric *PrometheusMetric
+		Value  float64
+		// State is the current state of a PrometheusMetric that is exported as state set.
+		State string
+	}
+	// propertyValue is a Property that captures the value of a PrometheusMetric within a single scrape.
+	propertyValue struct {
+		metric *PrometheusMetric
+		value  float64
+		state  string
+		parsed bool
+	}
+	// pageSnapshot holds the values of a page from the latest scrape in which the page could be fetched.
+	pageSnapshot struct {
+		timestamp  time.Time
+		samples    []Sample
+		discovered []DiscoveredSample
+	}
+	pageResult struct {
+		page       string
+		values     []*propertyValue
+		discovered []DiscoveredSample
+	}
+)
+
+// NewCollector returns a new Collector that scrapes the given pages.
+// The parsers are keyed by the page type, see Page.Type.
+func NewCollector(parsers map[string]stiebeleltron.PageParser, pages []*Page, timeout time.Duration) *Collector {
+	return &Collector{
+		parsers:       parsers,
+		pages:         pages,
+		timeout:       timeout,
+		counters:      map[string]*counterState{},
+		pageSnapshots: map[string]*pageSnapshot{},
+		daily:         NewDailyCounters(),
+		store:         state.NewMemoryStore(),
+		scrapeErrorCounter: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: Namespace,
+			Name:      "scrape_errors_total",
+			Help:      "Scrape errors can be used to monitor whether ISG is responsive",
+		}),
+		parseErrorCounter: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: Namespace,
+			Name:      "parse_errors_total",
+			Help:      "Parsing errors when extracting the ISG HTML pages for metric properties",
+		}),
+		scrapeDurationGauge: prometheus.NewDesc(
+			prometheus.BuildFQName(Namespace, "", "scrape_duration_seconds"),
+			"Total scrape duration in seconds",
+			nil, nil,
+		),
+		lastSuccessfulScrapeGauge: prometheus.NewDesc(
+			prometheus.BuildFQName(Namespace, "", "last_successful_scrape_timestamp_seconds"),
+			"Unix timestamp of the last scrape in which all pages could be fetched",
+			nil, nil,
+		),
+		pageLastSuccessGauge: prometheus.NewDesc(
+			prometheus.BuildFQName(Namespace, "page", "last_successful_scrape_timestamp_seconds"),
+			"Unix timestamp of the last scrape in which the page could be fetched",
+			[]string{"page"}, nil,
+		),
+		propertyValueGauge: prometheus.NewDesc(
+			prometheus.BuildFQName(Namespace, "property", "value"),
+			"Numeric value of an ISG property as displayed in the page, found in discovery mode",
+			[]string{"page", "group", "property"}, nil,
+		),
+	}
+}
+
+// EnableDiscovery additionally exports every numeric property found in the pages as generic gauge.
+// This includes properties that aren't in the definitions.
+// Only pages whose parser implements stiebeleltron.PageDiscoverer are discovered.
+func (c *Collector) EnableDiscovery() {
+	c.discovery = true
+}
+
+// UseStateStore restores the state of counters from the given store and saves it there after each scrape.
+// By default, the state is kept in memory only.
+// A state that can't be restored is reset with a warning.
+func (c *Collector) UseStateStore(store state.Store) {
+	c.counterMu.Lock()
+	defer c.counterMu.Unlock()
+	counters := map[string]*counterState{}
+	if _, err := store.Load(countersKey, &counters); err != nil {
+		log.WithError(err).Warn("Could not restore state of counters, resetting")
+		counters = map[string]*counterState{}
+	}
+	if err := c.daily.LoadFrom(store); err != nil {
+		log.WithError(err).Warn("Could not restore state of daily counters, resetting")
+	}
+	c.counters = counters
+	c.store = store
+}
+
+// AddSnapshotHandler notifies the given handler of each Snapshot after a scrape, including unsuccessful ones.
+// Handlers are called in the order they were added and must not be added after scraping started.
+// In polling mode, the handlers are called after each poll.
+func (c *Collector) AddSnapshotHandler(handler SnapshotHandler) {
+	c.handlers = append(c.handlers, handler)
+}
+
+// StartPolling scrapes the ISG in the given interval until the context is cancelled.
+// From then on, Collect serves the latest values of each page instead of scraping the ISG, so that a page that couldn't
+// be fetched in the latest poll keeps its values of an earlier poll.
+// Values older than maxAge are considered stale and are not exported anymore.
+func (c *Collector) StartPolling(ctx context.Context, interval, maxAge time.Duration) {
+	c.mu.Lock()
+	c.polling = true
+	c.maxAge = maxAge
+	c.mu.Unlock()
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			c.Scrape()
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// Describe implements prometheus.Collector.
+func (c *Collector) Describe(ch chan<- *prometheus.Desc) {
+	c.scrapeErrorCounter.Describe(ch)
+	c.parseErrorCounter.Describe(ch)
+	ch <- c.scrapeDurationGauge
+	ch <- c.lastSuccessfulScrapeGauge
+	ch <- c.pageLastSuccessGauge
+	ch <- c.propertyValueGauge
+	for _, page := range c.pages {
+		for _, metric := range page.Metrics {
+			ch <- metric.Desc
+			if metric.Accumulated != nil {
+				ch <- metric.Accumulated.Desc
+			}
+		}
+	}
+}
+
+// Collect implements prometheus.Collector.
+func (c *Collector) Collect(ch chan<- prometheus.Metric) {
+	snapshot, lastSuccessfulScrape := c.currentSnapshot()
+	if snapshot != nil {
+		for _, s := range snapshot.Samples {
+			c.collectSample(ch, s)
+		}
+		c.collectDiscovered(ch, snapshot.Discovered)
+		ch <- prometheus.MustNewConstMetric(c.scrapeDurationGauge, prometheus.GaugeValue, snapshot.Duration.Seconds())
+	}
+	if !lastSuccessfulScrape.IsZero() {
+		ch <- prometheus.MustNewConstMetric(c.lastSuccessfulScrapeGauge, prometheus.GaugeValue, float64(lastSuccessfulScrape.UnixNano())/1e9)
+	}
+	c.mu.RLock()
+	for name, page := range c.pageSnapshots {
+		ch <- prometheus.MustNewConstMetric(c.pageLastSuccessGauge, prometheus.GaugeValue, float64(page.timestamp.UnixNano())/1e9, name)
+	}
+	c.mu.RUnlock()
+	c.scrapeErrorCounter.Collect(ch)
+	c.parseErrorCounter.Collect(ch)
+}
+
+func (c *Collector) collectSample(ch chan<- prometheus.Metric, s Sample) {
+	if s.Metric.IsStateSet() {
+		m, err := s.Metric.NewStateSetMetrics(s.State)
+		if err != nil {
+			log.WithError(err).WithField("metric", s.Metric.GaugeName).Warn("Could not create metric")
+			return
+		}
+		for _, metric := range m {
+			ch <- metric
+		}
+		return
+	}
+	m, err := s.Metric.NewConstMetric(s.Value)
+	if err != nil {
+		log.WithError(err).WithField("metric", s.Metric.GaugeName).Warn("Could not create metric")
+		return
+	}
+	ch <- m
+}
+
+func (c *Collector) collectDiscovered(ch chan<- prometheus.Metric, discovered []DiscoveredSample) {
+	seen := make(map[DiscoveredSample]bool, len(discovered))
+	for _, d := range discovered {
+		key := DiscoveredSample{Page: d.Page, Group: d.Group, Property: d.Property}
+		if seen[key] {
+			// The same property in the same group would be a duplicate series.
+			continue
+		}
+		seen[key] = true
+		ch <- prometheus.MustNewConstMetric(c.propertyValueGauge, prometheus.GaugeValue, d.Value, d.Page, d.Group, d.Property)
+	}
+}
+
+// CurrentSnapshot returns the Snapshot that Collect exports: a new scrape, or the latest values of each page in polling mode.
+// It returns nil in polling mode if the values of all pages are stale or no page could be polled yet.
+func (c *Collector) CurrentSnapshot() *Snapshot {
+	snapshot, _ := c.currentSnapshot()
+	return snapshot
+}
+
+// currentSnapshot scrapes the ISG, or merges the latest values of each page in polling mode.
+// Stale pages are omitted, and if all pages are stale, the Snapshot is returned as nil.
+func (c *Collector) currentSnapshot() (*Snapshot, time.Time) {
+	c.mu.RLock()
+	polling := c.polling
+	c.mu.RUnlock()
+	if !polling {
+		snapshot := c.Scrape()
+		c.mu.RLock()
+		defer c.mu.RUnlock()
+		return snapshot, c.lastSuccessfulScrape
+	}
+
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if c.lastScrape == nil {
+		return nil, c.lastSuccessfulScrape
+	}
+	snapshot := &Snapshot{
+		Timestamp:      c.lastScrape.Timestamp,
+		Duration:       c.lastScrape.Duration,
+		Successful:     true,
+		PageTimestamps: map[string]time.Time{},
+	}
+	seen := map[string]bool{}
+	for _, page := range c.pages {
+		if seen[page.Name] {
+			continue
+		}
+		seen[page.Name] = true
+		cached, exists := c.pageSnapshots[page.Name]
+		if !exists {
+			snapshot.Successful = false
+			continue
+		}
+		if age := time.Since(cached.timestamp); c.maxAge > 0 && age > c.maxAge {
+			log.WithFields(log.Fields{
+				"page":   page.Name,
+				"age":    age.Seconds(),
+				"maxAge": c.maxAge.Seconds(),
+			}).Debug("Values of page are stale, omitting them")
+			snapshot.Successful = false
+			continue
+		}
+		if !cached.timestamp.Equal(snapshot.Timestamp) {
+			snapshot.Successful = false
+			snapshot.PageTimestamps[page.Name] = cached.timestamp
+		}
+		snapshot.Samples = append(snapshot.Samples, cached.samples...)
+		snapshot.Discovered = append(snapshot.Discovered, cached.discovered...)
+	}
+	if len(snapshot.Samples) == 0 && len(snapshot.Discovered) == 0 {
+		return nil, c.lastSuccessfulScrape
+	}
+	return snapshot, c.lastSuccessfulScrape
+}
+
+// SampleTimestamp returns the time when the value of the given sample was scraped.
+func (s *Snapshot) SampleTimestamp(sample Sample) time.Time {
+	if timestamp, exists := s.PageTimestamps[sample.Page]; exists {
+		return timestamp
+	}
+	return s.Timestamp
+}
+
+// Scrape fetches all pages concurrently and returns the values that could be parsed within the timeout.
+// The values of each page that could be fetched are cached for Collect in polling mode.
+// If a scrape is already in progress, e.g. because of concurrent requests to /metrics, Scrape waits for it and returns
+// its Snapshot instead. This way, counters are adjusted in the order of the scrapes.
+func (c *Collector) Scrape() *Snapshot {
+	c.scrapeMu.Lock()
+	if call := c.inflight; call != nil {
+		c.scrapeMu.Unlock()
+		<-call.done
+		return call.snapshot
+	}
+	call := &scrapeCall{done: make(chan struct{})}
+	c.inflight = call
+	c.scrapeMu.Unlock()
+
+	call.snapshot = c.scrape()
+
+	c.scrapeMu.Lock()
+	c.inflight = nil
+	c.scrapeMu.Unlock()
+	close(call.done)
+	return call.snapshot
+}
+
+func (c *Collector) scrape() *Snapshot {
+	start := time.Now()
+	ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
+	defer cancel()
+
+	// The channel is buffered so that no page ever blocks when sending its result.
+	resultChan := make(chan pageResult, len(c.pages))
+	wg := &sync.WaitGroup{}
+	wg.Add(len(c.pages))
+	for _, page := range c.pages {
+		go c.scrapeSinglePage(ctx, page, resultChan, wg)
+	}
+	// The requests are bound to the context, so all pages return shortly after a timeout.
+	wg.Wait()
+	close(resultChan)
+
+	if ctx.Err() != nil {
+		log.WithField("timeout", c.timeout.Seconds()).Warn("Scrape timed out")
+		c.scrapeErrorCounter.Inc()
+	} else {
+		log.WithFields(log.Fields{
+			"duration": time.Since(start).Seconds(),
+		}).Debug("Scrape completed")
+	}
+
+	snapshot := &Snapshot{
+		Timestamp:  start,
+		Successful: ctx.Err() == nil && len(resultChan) == len(c.pages),
+	}
+	pages := map[string]*pageSnapshot{}
+	for result := range resultChan {
+		page := &pageSnapshot{timestamp: start, discovered: result.discovered}
+		pages[result.page] = page
+		for _, v := range result.values {
+			if !v.parsed {
+				continue
+			}
+			value := v.value
+			if v.metric.IsCounter() {
+				value = c.adjustCounter(v.metric, value)
+			}
+			page.samples = append(page.samples, Sample{Page: result.page, Metric: v.metric, Value: value, State: v.state})
+			if v.metric.DailyReset {
+				page.samples = append(page.samples, Sample{Page: result.page, Metric: v.metric.Accumulated,
+					Value: c.daily.Add(v.metric.ID(), value)})
+			}
+		}
+		snapshot.Samples = append(snapshot.Samples, page.samples...)
+		snapshot.Discovered = append(snapshot.Discovered, result.discovered...)
+	}
+	snapshot.Duration = time.Since(start)
+	if err := c.saveState(); err != nil {
+		log.WithError(err).Warn("Could not save state")
+	}
+
+	c.mu.Lock()
+	c.lastScrape = snapshot
+	for name, page := range pages {
+		c.pageSnapshots[name] = page
+	}
+	if snapshot.Successful {
+		c.lastSuccessfulScrape = start
+	}
+	c.mu.Unlock()
+	for _, handler := range c.handlers {
+		handler.HandleSnapshot(snapshot)
+	}
+	return snapshot
+}
+
+// adjustCounter returns the value of the counter so that it never decreases.
+// If the ISG value drops, e.g. after a reset of the ISG, the last value is added as offset to all following values.
+func (c *Collector) adjustCounter(metric *PrometheusMetric, value float64) float64 {
+	c.counterMu.Lock()
+	defer c.counterMu.Unlock()
+	counter, exists := c.counters[metric.ID()]
+	if !exists {
+		counter = &counterState{Last: value}
+		c.counters[metric.ID()] = counter
+	}
+	if value < counter.Last {
+		log.WithFields(log.Fields{
+			"metric":   metric.GaugeName,
+			"previous": counter.Last,
+			"value":    value,
+		}).Info("Counter value dropped, assuming a reset of the ISG")
+		counter.Offset += counter.Last
+	}
+	counter.Last = value
+	return value + counter.Offset
+}
+
+// saveState saves the state of the counters in the store and persists it.
+func (c *Collector) saveState() error {
+	c.counterMu.Lock()
+	err := c.store.Save(countersKey, c.counters)
+	c.counterMu.Unlock()
+	if err != nil {
+		return err
+	}
+	if err := c.daily.SaveTo(c.store); err != nil {
+		return err
+	}
+	return c.store.Flush()
+}
+
+func (c *Collector) scrapeSinglePage(ctx context.Context, page *Page, resultChan chan<- pageResult, wg *sync.WaitGroup) {
+	defer wg.Done()
+	scrapeLog := log.WithFields(log.Fields{"page": page.Path})
+	parser, exists := c.parsers[page.Type]
+	if !exists {
+		c.scrapeErrorCounter.Inc()
+		scrapeLog.WithField("type", page.Type).Error("No parser available for page type")
+		return
+	}
+	values := make([]*propertyValue, len(page.Metrics))
+	list := make([]stiebeleltron.Property, len(page.Metrics))
+	for i := range page.Metrics {
+		values[i] = &propertyValue{metric: page.Metrics[i]}
+		list[i] = values[i]
+	}
+	result := pageResult{page: page.Name, values: values}
+	var parseErrors []stiebeleltron.ParseError
+	var err error
+	if discoverer, canDiscover := parser.(stiebeleltron.PageDiscoverer); c.discovery && canDiscover {
+		var discovered []stiebeleltron.DiscoveredProperty
+		discovered, parseErrors, err = discoverer.DiscoverPage(ctx, page.Path, list)
+		for _, d := range discovered {
+			if d.Numeric {
+				result.discovered = append(result.discovered, DiscoveredSample{
+					Page: page.Name, Group: d.Group, Property: d.Name, Value: d.Value,
+				})
+			}
+		}
+	} else {
+		parseErrors, err = parser.ParsePage(ctx, page.Path, list)
+	}
+	if err != nil {
+		if ctx.Err() != nil {
+			// Timeouts are counted once per scrape.
+			scrapeLog.WithError(err).Debug("Aborted scrape of page")
+			return
+		}
+		c.scrapeErrorCounter.Inc()
+		scrapeLog.WithError(err).Error("Could not scrape page")
+		return
+	}
+	for _, parseError := range parseErrors {
+		fields := log.Fields{
+			"value": parseError.RawText,
+			"error": parseError.Error,
+		}
+		if parseError.Property != nil {
+			fields["property"] = parseError.Property.GetSearchString()
+		}
+		scrapeLog.WithFields(fields).Warn("Could not parse property")
+		c.parseErrorCounter.Inc()
+	}
+	scrapeLog.Debug("Parsed page")
+	resultChan <- result
+}
+
+func (v *propertyValue) GetGroup() string {
+	return v.metric.GetGroup()
+}
+
+func (v *propertyValue) GetSearchString() string {
+	return v.metric.GetSearchString()
+}
+
+func (v *propertyValue) GetRegister() uint16 {
+	return v.metric.GetRegister()
+}
+
+func (v *propertyValue) GetRegisterType() stiebeleltron.RegisterType {
+	return v.metric.GetRegisterType()
+}
+
+func (v *propertyValue) GetDataType() stiebeleltron.DataType {
+	return v.metric.GetDataType()
+}
+
+func (v *propertyValue) GetUnit() string {
+	return v.metric.GetUnit()
+}
+
+func (v *propertyValue) IsText() bool {
+	return v.metric.IsText()
+}
+
+// SetText maps the given text to the state or numeric code of the metric.
+func (v *propertyValue) SetText(text string) error {
+	if state, found := v.metric.LookupState(text); found {
+		v.state = state
+		v.parsed = true
+		return nil
+	}
+	if code, found := v.metric.LookupCode(text); found {
+		v.value = code
+		v.parsed = true
+		return nil
+	}
+	return fmt.Errorf("text %q is not mapped to a state or code", text)
+}
+
+func (v *propertyValue) SetValue(f float64) {
+	v.value = v.metric.Transform(f)
+	v.parsed = true
+}
@@ -0,0 +1,452 @@
+package metrics
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ccremer/stiebeleltron-exporter/pkg/state"
+	"github.com/ccremer/stiebeleltron-exporter/pkg/stiebeleltron"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestMetric(group, groupSearchString, name, searchString string) *PrometheusMetric {
+	m := &PrometheusMetric{
+		GaugeName:            name,
+		Group:                group,
+		GroupSearchString:    groupSearchString,
+		PropertySearchString: searchString,
+		HelpText:             "help",
+	}
+	m.InitializeMetric()
+	return m
+}
+
+func newTestCollector(t *testing.T, url string, pages map[string][]*PrometheusMetric) *Collector {
+	client, err := stiebeleltron.NewISGClient(stiebeleltron.ClientOptions{BaseURL: url})
+	require.NoError(t, err)
+	list := make([]*Page, 0, len(pages))
+	for path, metricList := range pages {
+		list = append(list, &Page{Name: "page", Path: path, Type: stiebeleltron.PageTypeHTML, Metrics: metricList})
+	}
+	return NewCollector(map[string]stiebeleltron.PageParser{stiebeleltron.PageTypeHTML: client}, list, time.Second)
+}
+
+func TestCollector_Collect(t *testing.T) {
+	server := httptest.NewServer(http.FileServer(http.Dir("../stiebeleltron/testdata")))
+	defer server.Close()
+
+	tests := []struct {
+		name     string
+		pages    map[string][]*PrometheusMetric
+		expected string
+	}{
+		{
+			name: "GivenExistingPage_ThenEmitParsedValues",
+			pages: map[string][]*PrometheusMetric{
+				"/heatpumpinfo_1.html": {newTestMetric("runtime", "RUNTIME", "compressor", "RNT COMP 1 DHW")},
+			},
+			expected: `
+# HELP stiebeleltron_runtime_compressor help
+# TYPE stiebeleltron_runtime_compressor gauge
+stiebeleltron_runtime_compressor 1771
+`,
+		},
+		{
+			name: "GivenMissingPage_ThenOmitSeries",
+			pages: map[string][]*PrometheusMetric{
+				"/nonexisting.html": {newTestMetric("runtime", "RUNTIME", "compressor", "RNT COMP 1 DHW")},
+			},
+			expected: "",
+		},
+		{
+			name: "GivenMissingProperty_ThenOmitSeries",
+			pages: map[string][]*PrometheusMetric{
+				"/heatpumpinfo_1.html": {
+					newTestMetric("runtime", "RUNTIME", "compressor", "RNT COMP 1 DHW"),
+					newTestMetric("runtime", "RUNTIME", "nonexisting", "NONEXISTING"),
+				},
+			},
+			expected: `
+# HELP stiebeleltron_runtime_compressor help
+# TYPE stiebeleltron_runtime_compressor gauge
+stiebeleltron_runtime_compressor 1771
+`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			collector := newTestCollector(t, server.URL, tt.pages)
+			err := testutil.CollectAndCompare(collector, strings.NewReader(tt.expected),
+				"stiebeleltron_runtime_compressor", "stiebeleltron_runtime_nonexisting")
+			assert.NoError(t, err)
+		})
+	}
+}
+
+func TestCollector_Collect_GivenSlowServer_WhenTimeout_ThenCancelAllRequests(t *testing.T) {
+	wg := sync.WaitGroup{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer wg.Done()
+		select {
+		case <-r.Context().Done():
+		case <-time.After(10 * time.Second):
+		}
+	}))
+	defer server.Close()
+
+	pages := map[string][]*PrometheusMetric{
+		"/page1": {newTestMetric("runtime", "RUNTIME", "compressor", "RNT COMP 1 DHW")},
+		"/page2": {newTestMetric("energy", "AMOUNT OF HEAT", "heating_total", "COMPRESSOR HEATING DAY")},
+	}
+	wg.Add(len(pages))
+	collector := newTestCollector(t, server.URL, pages)
+	collector.timeout = 100 * time.Millisecond
+
+	start := time.Now()
+	count := testutil.CollectAndCount(collector, "stiebeleltron_runtime_compressor", "stiebeleltron_energy_heating_total")
+	assert.Equal(t, 0, count)
+	assert.Less(t, time.Since(start), time.Second)
+	assert.Equal(t, float64(1), testutil.ToFloat64(collector.scrapeErrorCounter))
+
+	handlersDone := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(handlersDone)
+	}()
+	select {
+	case <-handlersDone:
+	case <-time.After(time.Second):
+		assert.Fail(t, "requests have not been cancelled on the server side")
+	}
+}
+
+func TestCollector_StartPolling(t *testing.T) {
+	server := httptest.NewServer(http.FileServer(http.Dir("../stiebeleltron/testdata")))
+	defer server.Close()
+
+	collector := newTestCollector(t, server.URL, map[string][]*PrometheusMetric{
+		"/heatpumpinfo_1.html": {newTestMetric("runtime", "RUNTIME", "compressor", "RNT COMP 1 DHW")},
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	collector.StartPolling(ctx, time.Hour, time.Hour)
+	require.Eventually(t, func() bool {
+		snapshot, _ := collector.currentSnapshot()
+		return snapshot != nil
+	}, time.Second, 10*time.Millisecond)
+
+	// Scrapes are served from the snapshot, even if the ISG isn't reachable anymore.
+	server.Close()
+	assert.Equal(t, 1, testutil.CollectAndCount(collector, "stiebeleltron_runtime_compressor"))
+	assert.Equal(t, 1, testutil.CollectAndCount(collector, "stiebeleltron_last_successful_scrape_timestamp_seconds"))
+
+	// Stale values are omitted, but the timestamp of the last successful scrape remains.
+	collector.mu.Lock()
+	collector.maxAge = time.Nanosecond
+	collector.mu.Unlock()
+	assert.Equal(t, 0, testutil.CollectAndCount(collector, "stiebeleltron_runtime_compressor"))
+	assert.Equal(t, 1, testutil.CollectAndCount(collector, "stiebeleltron_last_successful_scrape_timestamp_seconds"))
+}
+
+// failingParser returns an error in each scrape after the given number of successful scrapes.
+type failingParser struct {
+	stubParser
+	successful int
+}
+
+func (p *failingParser) ParsePage(ctx context.Context, path string, properties []stiebeleltron.Property) ([]stiebeleltron.ParseError, error) {
+	if p.scrapes >= p.successful {
+		return nil, fmt.Errorf("connection refused")
+	}
+	return p.stubParser.ParsePage(ctx, path, properties)
+}
+
+func TestCollector_CurrentSnapshot_GivenPolling_WhenPageFails_ThenKeepValuesOfPage(t *testing.T) {
+	outside := newTestMetric("heating", "HEATING", "outside_temperature", "OUTSIDE TEMPERATURE")
+	compressor := newTestMetric("runtime", "RUNTIME", "compressor", "RNT COMP 1 HEA")
+	collector := NewCollector(map[string]stiebeleltron.PageParser{
+		"stub":    &stubParser{values: []float64{5, 6}},
+		"failing": &failingParser{stubParser: stubParser{values: []float64{10}}, successful: 1},
+	}, []*Page{
+		{Name: "system", Path: "system", Type: "stub", Metrics: []*PrometheusMetric{outside}},
+		{Name: "heatpump", Path: "heatpump", Type: "failing", Metrics: []*PrometheusMetric{compressor}},
+	}, time.Second)
+	collector.polling = true
+	collector.maxAge = time.Hour
+
+	first := collector.Scrape()
+	second := collector.Scrape()
+	require.True(t, first.Successful)
+	require.False(t, second.Successful)
+	assert.Len(t, second.Samples, 1, "the scrape itself contains only the values of the pages that could be fetched")
+
+	snapshot := collector.CurrentSnapshot()
+	require.NotNil(t, snapshot)
+	assert.False(t, snapshot.Successful)
+	assert.Equal(t, second.Timestamp, snapshot.Timestamp)
+	assert.Equal(t, map[string]time.Time{"heatpump": first.Timestamp}, snapshot.PageTimestamps)
+	values := map[string]float64{}
+	for _, sample := range snapshot.Samples {
+		values[sample.Metric.GaugeName] = sample.Value
+		assert.Equal(t, map[string]time.Time{"system": second.Timestamp, "heatpump": first.Timestamp}[sample.Page], snapshot.SampleTimestamp(sample))
+	}
+	assert.Equal(t, map[string]float64{"outside_temperature": 6, "compressor": 10}, values)
+	assert.Equal(t, 2, testutil.CollectAndCount(collector, "stiebeleltron_page_last_successful_scrape_timestamp_seconds"))
+
+	// Only the stale page is omitted.
+	collector.mu.Lock()
+	collector.pageSnapshots["heatpump"].timestamp = time.Now().Add(-2 * time.Hour)
+	collector.mu.Unlock()
+	snapshot = collector.CurrentSnapshot()
+	require.Len(t, snapshot.Samples, 1)
+	assert.Equal(t, "outside_temperature", snapshot.Samples[0].Metric.GaugeName)
+}
+
+func TestCollector_EnableDiscovery(t *testing.T) {
+	server := httptest.NewServer(http.FileServer(http.Dir("../stiebeleltron/testdata")))
+	defer server.Close()
+
+	collector := newTestCollector(t, server.URL, map[string][]*PrometheusMetric{
+		"/heatpumpinfo_1.html": {newTestMetric("runtime", "RUNTIME", "compressor", "RNT COMP 1 DHW")},
+	})
+	collector.EnableDiscovery()
+
+	expected := `
+# HELP stiebeleltron_property_value Numeric value of an ISG property as displayed in the page, found in discovery mode
+# TYPE stiebeleltron_property_value gauge
+stiebeleltron_property_value{group="AMOUNT OF HEAT",page="page",property="BH HEATING TOTAL"} 0.02
+stiebeleltron_property_value{group="AMOUNT OF HEAT",page="page",property="COMPRESSOR DHW DAY"} 5.052
+stiebeleltron_property_value{group="AMOUNT OF HEAT",page="page",property="COMPRESSOR DHW TOTAL"} 12.617
+stiebeleltron_property_value{group="AMOUNT OF HEAT",page="page",property="COMPRESSOR HEATING DAY"} 21.145
+stiebeleltron_property_value{group="AMOUNT OF HEAT",page="page",property="COMPRESSOR HEATING TOTAL"} 56.97
+stiebeleltron_property_value{group="PROCESS DATA",page="page",property="COMP DLAY CNTR"} 1
+stiebeleltron_property_value{group="RUNTIME",page="page",property="BH 1"} 0
+stiebeleltron_property_value{group="RUNTIME",page="page",property="BH 2"} 2
+stiebeleltron_property_value{group="RUNTIME",page="page",property="RNT COMP 1 DHW"} 1771
+stiebeleltron_property_value{group="RUNTIME",page="page",property="RNT COMP 1 HEA"} 523
+`
+	err := testutil.CollectAndCompare(collector, strings.NewReader(expected), "stiebeleltron_property_value")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, testutil.CollectAndCount(collector, "stiebeleltron_runtime_compressor"))
+	assert.Equal(t, float64(0), testutil.ToFloat64(collector.parseErrorCounter))
+}
+
+// stubParser sets the next of its values to all properties of a page in each scrape, and repeats the last value once exhausted.
+type stubParser struct {
+	values  []float64
+	scrapes int
+}
+
+func (p *stubParser) ParsePage(_ context.Context, _ string, properties []stiebeleltron.Property) ([]stiebeleltron.ParseError, error) {
+	v := p.values[min(p.scrapes, len(p.values)-1)]
+	p.scrapes++
+	for _, prop := range properties {
+		prop.SetValue(v)
+	}
+	return nil, nil
+}
+
+func TestCollector_Collect_GivenCounter(t *testing.T) {
+	tests := []struct {
+		name     string
+		values   []float64
+		expected float64
+	}{
+		{
+			name:     "WhenValueIncreases_ThenExportValue",
+			values:   []float64{10, 12, 15},
+			expected: 15,
+		},
+		{
+			name:     "WhenValueDrops_ThenAddOffset",
+			values:   []float64{10, 12, 2},
+			expected: 14,
+		},
+		{
+			name:     "WhenValueDropsTwice_ThenAddOffsets",
+			values:   []float64{10, 2, 1, 3},
+			expected: 15,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			metric := newTestMetric("runtime", "RUNTIME", "compressor", "RNT COMP 1 HEA")
+			metric.Type = MetricTypeCounter
+			metric.InitializeMetric()
+			collector := NewCollector(map[string]stiebeleltron.PageParser{"stub": &stubParser{values: tt.values}},
+				[]*Page{{Name: "page", Path: "page", Type: "stub", Metrics: []*PrometheusMetric{metric}}}, time.Second)
+			for range tt.values[1:] {
+				collector.Scrape()
+			}
+			expected := fmt.Sprintf(`
+# HELP stiebeleltron_runtime_compressor_total help
+# TYPE stiebeleltron_runtime_compressor_total counter
+stiebeleltron_runtime_compressor_total %v
+`, tt.expected)
+			err := testutil.CollectAndCompare(collector, strings.NewReader(expected), "stiebeleltron_runtime_compressor_total")
+			assert.NoError(t, err)
+			problems, err := testutil.CollectAndLint(collector)
+			assert.NoError(t, err)
+			assert.Empty(t, problems)
+		})
+	}
+}
+
+func TestCollector_Collect_GivenDailyReset_ThenExportValueAndAccumulatedCounter(t *testing.T) {
+	metric := newTestMetric("energy", "AMOUNT OF HEAT", "heating_total", "COMPRESSOR HEATING DAY")
+	metric.DailyReset = true
+	metric.Labels = map[string]string{"timeframe": "day"}
+	metric.InitializeMetric()
+	collector := NewCollector(map[string]stiebeleltron.PageParser{"stub": &stubParser{values: []float64{10, 12, 2}}},
+		[]*Page{{Name: "page", Path: "page", Type: "stub", Metrics: []*PrometheusMetric{metric}}}, time.Second)
+	collector.Scrape()
+	collector.Scrape()
+
+	expected := `
+# HELP stiebeleltron_energy_heating_accumulated_total help accumulated across days
+# TYPE stiebeleltron_energy_heating_accumulated_total counter
+stiebeleltron_energy_heating_accumulated_total{timeframe="day"} 14
+# HELP stiebeleltron_energy_heating_total help
+# TYPE stiebeleltron_energy_heating_total gauge
+stiebeleltron_energy_heating_total{timeframe="day"} 2
+`
+	err := testutil.CollectAndCompare(collector, strings.NewReader(expected),
+		"stiebeleltron_energy_heating_total", "stiebeleltron_energy_heating_accumulated_total")
+	assert.NoError(t, err)
+}
+
+// blockingParser sets the value to all properties of a page once release is closed, and counts its scrapes.
+type blockingParser struct {
+	value   float64
+	release chan struct{}
+	scrapes atomic.Int32
+}
+
+func (p *blockingParser) ParsePage(_ context.Context, _ string, properties []stiebeleltron.Property) ([]stiebeleltron.ParseError, error) {
+	p.scrapes.Add(1)
+	<-p.release
+	for _, prop := range properties {
+		prop.SetValue(p.value)
+	}
+	return nil, nil
+}
+
+func TestCollector_Scrape_GivenConcurrentCalls_ThenScrapeOnce(t *testing.T) {
+	metric := newTestMetric("runtime", "RUNTIME", "compressor", "RNT COMP 1 HEA")
+	metric.Type = MetricTypeCounter
+	metric.InitializeMetric()
+	parser := &blockingParser{value: 10, release: make(chan struct{})}
+	collector := NewCollector(map[string]stiebeleltron.PageParser{"stub": parser},
+		[]*Page{{Name: "page", Path: "page", Type: "stub", Metrics: []*PrometheusMetric{metric}}}, time.Second)
+
+	snapshots := make([]*Snapshot, 5)
+	wg := sync.WaitGroup{}
+	for i := range snapshots {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			snapshots[i] = collector.Scrape()
+		}(i)
+	}
+	require.Eventually(t, func() bool { return parser.scrapes.Load() == 1 }, time.Second, time.Millisecond)
+	time.Sleep(10 * time.Millisecond)
+	close(parser.release)
+	wg.Wait()
+
+	assert.Equal(t, int32(1), parser.scrapes.Load(), "concurrent calls should share the scrape in flight")
+	for _, snapshot := range snapshots {
+		assert.Equal(t, float64(10), snapshot.Samples[0].Value)
+	}
+	assert.Equal(t, float64(10), collector.Scrape().Samples[0].Value, "counter shouldn't be inflated")
+}
+
+// snapshotRecorder is a SnapshotHandler that records the snapshots.
+type snapshotRecorder struct {
+	snapshots []*Snapshot
+}
+
+func (r *snapshotRecorder) HandleSnapshot(snapshot *Snapshot) {
+	r.snapshots = append(r.snapshots, snapshot)
+}
+
+func TestCollector_AddSnapshotHandler_WhenScrape_ThenNotifyHandler(t *testing.T) {
+	metric := newTestMetric("runtime", "RUNTIME", "compressor", "RNT COMP 1 HEA")
+	collector := NewCollector(map[string]stiebeleltron.PageParser{"stub": &stubParser{values: []float64{10, 12}}},
+		[]*Page{{Name: "page", Path: "page", Type: "stub", Metrics: []*PrometheusMetric{metric}}}, time.Second)
+	recorder := &snapshotRecorder{}
+	collector.AddSnapshotHandler(recorder)
+
+	first := collector.Scrape()
+	second := collector.Scrape()
+
+	assert.Equal(t, []*Snapshot{first, second}, recorder.snapshots)
+	assert.Equal(t, float64(12), recorder.snapshots[1].Samples[0].Value)
+	assert.Equal(t, "page", recorder.snapshots[1].Samples[0].Page)
+}
+
+func TestCollector_UseStateStore_GivenRestart_ThenContinueCounter(t *testing.T) {
+	store := state.NewMemoryStore()
+	newCollector := func(values ...float64) *Collector {
+		metric := newTestMetric("runtime", "RUNTIME", "compressor", "RNT COMP 1 HEA")
+		metric.Type = MetricTypeCounter
+		metric.InitializeMetric()
+		collector := NewCollector(map[string]stiebeleltron.PageParser{"stub": &stubParser{values: values}},
+			[]*Page{{Name: "page", Path: "page", Type: "stub", Metrics: []*PrometheusMetric{metric}}}, time.Second)
+		collector.UseStateStore(store)
+		return collector
+	}
+
+	first := newCollector(10, 2)
+	first.Scrape()
+	assert.Equal(t, float64(12), first.Scrape().Samples[0].Value)
+
+	restarted := newCollector(3)
+	assert.Equal(t, float64(13), restarted.Scrape().Samples[0].Value)
+}
+
+func TestCollector_Collect_GivenTextValues(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`<html><body><form id="werte"><table class="info">
+<tr><th>OPERATING STATUS</th></tr>
+<tr class="even"><td class="key">OPERATING MODE</td><td class="value">ECO MODE</td></tr>
+<tr class="odd"><td class="key">COMPRESSOR</td><td class="value">ON</td></tr>
+<tr class="even"><td class="key">PUMP</td><td class="value">DEFROST</td></tr>
+</table></form></body></html>`))
+	}))
+	defer server.Close()
+
+	mode := newTestMetric("status", "OPERATING STATUS", "operating_mode", "OPERATING MODE")
+	mode.States = map[string]string{"AUTOMATIC": "automatic", "ECO MODE": "eco", "COMFORT MODE": "comfort"}
+	mode.InitializeMetric()
+	compressor := newTestMetric("status", "OPERATING STATUS", "compressor_running", "COMPRESSOR")
+	compressor.Codes = map[string]float64{"ON": 1, "OFF": 0}
+	pump := newTestMetric("status", "OPERATING STATUS", "pump_running", "PUMP")
+	pump.Codes = map[string]float64{"ON": 1, "OFF": 0}
+	collector := newTestCollector(t, server.URL, map[string][]*PrometheusMetric{
+		"/": {mode, compressor, pump},
+	})
+
+	expected := `
+# HELP stiebeleltron_status_compressor_running help
+# TYPE stiebeleltron_status_compressor_running gauge
+stiebeleltron_status_compressor_running 1
+# HELP stiebeleltron_status_operating_mode help
+# TYPE stiebeleltron_status_operating_mode gauge
+stiebeleltron_status_operating_mode{state="automatic"} 0
+stiebeleltron_status_operating_mode{state="comfort"} 0
+stiebeleltron_status_operating_mode{state="eco"} 1
+`
+	err := testutil.CollectAndCompare(collector, strings.NewReader(expected),
+		"stiebeleltron_status_operating_mode", "stiebeleltron_status_compressor_running", "stiebeleltron_status_pump_running")
+	assert.NoError(t, err)
+	assert.Equal(t, float64(1), testutil.ToFloat64(collector.parseErrorCounter), "unmapped text should be a parse error")
+}
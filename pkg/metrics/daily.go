@@ -0,0 +1,96 @@
+package metrics
+
+import (
+	"sync"
+	"time"
+
+	"github.com/ccremer/stiebeleltron-exporter/pkg/state"
+)
+
+const (
+	dayLayout = "2006-01-02"
+	// resetTolerance is the time after midnight in which the ISG may still report the value of the previous day.
+	// It covers clocks of the ISG and the exporter that are not exactly in sync.
+	resetTolerance = time.Hour
+	// dailyCountersKey is the key of the DailyCounters in the state.Store.
+	dailyCountersKey = "daily_counters"
+)
+
+type (
+	// DailyCounters turns values that are reset by the ISG at midnight, like the heat amount of the current day,
+	// into monotonically increasing counters.
+	DailyCounters struct {
+		now      func() time.Time
+		mu       sync.Mutex
+		counters map[string]*dailyCounterState
+	}
+	// dailyCounterState is the state of a single counter.
+	dailyCounterState struct {
+		// Day is the day of the last seen value, in local time of the exporter.
+		Day string `json:"day"`
+		// Last is the last seen value of the current day.
+		Last float64 `json:"last"`
+		// Total is the value of the counter.
+		Total float64 `json:"total"`
+	}
+)
+
+// NewDailyCounters returns new DailyCounters without any state.
+func NewDailyCounters() *DailyCounters {
+	return &DailyCounters{
+		now:      time.Now,
+		counters: map[string]*dailyCounterState{},
+	}
+}
+
+// Add returns the counter with the given id after the given value of the current day has been seen.
+// A drop of the value is considered a reset, so the new value is added as a whole.
+// If the exporter missed the reset, e.g. because it wasn't running at midnight, the reset is assumed once the day changed,
+// unless the value was already seen on the same day within resetTolerance after midnight.
+func (d *DailyCounters) Add(id string, value float64) float64 {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	now := d.now()
+	day := now.Format(dayLayout)
+
+	counter, exists := d.counters[id]
+	switch {
+	case !exists:
+		counter = &dailyCounterState{Day: day, Total: value}
+		d.counters[id] = counter
+	case value < counter.Last:
+		counter.Total += value
+	case counter.Day != day && sinceMidnight(now) > resetTolerance:
+		counter.Total += value
+	default:
+		counter.Total += value - counter.Last
+	}
+	counter.Day = day
+	counter.Last = value
+	return counter.Total
+}
+
+// LoadFrom restores the counters from the given store, so that they continue where they left off.
+// If the counters can't be restored, the current counters are kept.
+func (d *DailyCounters) LoadFrom(store state.Store) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	counters := map[string]*dailyCounterState{}
+	if _, err := store.Load(dailyCountersKey, &counters); err != nil {
+		return err
+	}
+	d.counters = counters
+	return nil
+}
+
+// SaveTo saves the counters in the given store.
+func (d *DailyCounters) SaveTo(store state.Store) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return store.Save(dailyCountersKey, d.counters)
+}
+
+func sinceMidnight(t time.Time) time.Duration {
+	year, month, day := t.Date()
+	return t.Sub(time.Date(year, month, day, 0, 0, 0, 0, t.Location()))
+}
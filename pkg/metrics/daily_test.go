@@ -0,0 +1,98 @@
+package metrics
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ccremer/stiebeleltron-exporter/pkg/state"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDailyCounters_Add(t *testing.T) {
+	type observation struct {
+		time  string
+		value float64
+	}
+	tests := []struct {
+		name         string
+		observations []observation
+		expected     float64
+	}{
+		{
+			name:         "GivenFirstValue_ThenStartWithValue",
+			observations: []observation{{"2022-03-01T10:00:00", 5}},
+			expected:     5,
+		},
+		{
+			name: "GivenIncreasingValues_ThenAddDifference",
+			observations: []observation{
+				{"2022-03-01T10:00:00", 5},
+				{"2022-03-01T11:00:00", 7.5},
+				{"2022-03-01T12:00:00", 7.5},
+			},
+			expected: 7.5,
+		},
+		{
+			name: "GivenResetAtMidnight_ThenAddNewValue",
+			observations: []observation{
+				{"2022-03-01T23:59:00", 20},
+				{"2022-03-02T00:01:00", 0},
+				{"2022-03-02T01:00:00", 3},
+			},
+			expected: 23,
+		},
+		{
+			name: "GivenValueOfPreviousDay_WhenShortlyAfterMidnight_ThenWaitForReset",
+			observations: []observation{
+				{"2022-03-01T23:59:00", 20},
+				{"2022-03-02T00:01:00", 21},
+				{"2022-03-02T00:02:00", 1},
+			},
+			expected: 22,
+		},
+		{
+			name: "GivenValueOfPreviousDay_WhenNoDropUntilAfterTolerance_ThenAddDifference",
+			observations: []observation{
+				{"2022-03-01T23:59:00", 20},
+				{"2022-03-02T00:30:00", 21},
+				{"2022-03-02T01:30:00", 22},
+			},
+			expected: 22,
+		},
+		{
+			name: "GivenMissedReset_WhenDayChanged_ThenAddNewValue",
+			observations: []observation{
+				{"2022-03-01T18:00:00", 20},
+				{"2022-03-02T09:00:00", 25},
+			},
+			expected: 45,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := NewDailyCounters()
+			var result float64
+			for _, o := range tt.observations {
+				now, err := time.ParseInLocation("2006-01-02T15:04:05", o.time, time.Local)
+				require.NoError(t, err)
+				d.now = func() time.Time { return now }
+				result = d.Add("id", o.value)
+			}
+			assert.Equal(t, tt.expected, result)
+		})
+	}
+}
+
+func TestDailyCounters_SaveTo(t *testing.T) {
+	store := state.NewMemoryStore()
+	d := NewDailyCounters()
+	d.Add("id", 5)
+	d.Add("id", 7)
+	require.NoError(t, d.SaveTo(store))
+
+	// The counter continues after a restart.
+	restarted := NewDailyCounters()
+	require.NoError(t, restarted.LoadFrom(store))
+	assert.Equal(t, float64(10), restarted.Add("id", 10))
+}
@@ -0,0 +1,239 @@
+package metrics
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/ccremer/stiebeleltron-exporter/pkg/stiebeleltron"
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+)
+
+type (
+	// FaultCollector implements prometheus.Collector.
+	// By default, each call to Collect fetches the fault list of the ISG and emits the active faults.
+	// With StartPolling, the fault list is fetched in the background instead and Collect serves the latest one.
+	FaultCollector struct {
+		parser  stiebeleltron.FaultParser
+		page    string
+		timeout time.Duration
+		history *FaultHistory
+
+		faultActiveGauge   *prometheus.Desc
+		faultCountGauge    *prometheus.Desc
+		scrapeErrorCounter prometheus.Counter
+
+		mu        sync.RWMutex
+		polling   bool
+		maxAge    time.Duration
+		faults    []stiebeleltron.Fault
+		fetchedAt time.Time
+	}
+	// FaultHistory keeps the faults seen by a FaultCollector in memory, deduplicated by code and description.
+	FaultHistory struct {
+		mu      sync.Mutex
+		maxSize int
+		entries map[stiebeleltron.Fault]*FaultHistoryEntry
+		now     func() time.Time
+	}
+	// FaultHistoryEntry is a fault in the FaultHistory.
+	FaultHistoryEntry struct {
+		stiebeleltron.Fault
+		// FirstSeen is the time when the fault was seen for the first time.
+		FirstSeen time.Time `json:"firstSeen"`
+		// LastSeen is the time of the last scrape in which the fault was active.
+		LastSeen time.Time `json:"lastSeen"`
+		// Occurrences counts how often the fault became active.
+		Occurrences int `json:"occurrences"`
+		// Active is true if the fault was active in the last scrape.
+		Active bool `json:"active"`
+	}
+)
+
+// NewFaultCollector returns a new FaultCollector that fetches the fault list from the given page.
+// If history is not nil, the faults of each scrape are recorded in it.
+func NewFaultCollector(parser stiebeleltron.FaultParser, page string, timeout time.Duration, history *FaultHistory) *FaultCollector {
+	return &FaultCollector{
+		parser:  parser,
+		page:    page,
+		timeout: timeout,
+		history: history,
+		faultActiveGauge: prometheus.NewDesc(
+			prometheus.BuildFQName(Namespace, "fault", "active"),
+			"Active fault of the ISG, as listed in the diagnosis page",
+			[]string{"code", "description"}, nil,
+		),
+		faultCountGauge: prometheus.NewDesc(
+			prometheus.BuildFQName(Namespace, "fault", "count"),
+			"Number of active faults of the ISG",
+			nil, nil,
+		),
+		scrapeErrorCounter: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: Namespace,
+			Name:      "fault_scrape_errors_total",
+			Help:      "Errors when fetching the fault list of the ISG",
+		}),
+	}
+}
+
+// Describe implements prometheus.Collector.
+func (c *FaultCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.faultActiveGauge
+	ch <- c.faultCountGauge
+	c.scrapeErrorCounter.Describe(ch)
+}
+
+// StartPolling fetches the fault list in the given interval until the context is cancelled.
+// From then on, Collect serves the latest fault list instead of fetching it.
+// A fault list older than maxAge is considered stale and is not exported anymore.
+func (c *FaultCollector) StartPolling(ctx context.Context, interval, maxAge time.Duration) {
+	c.mu.Lock()
+	c.polling = true
+	c.maxAge = maxAge
+	c.mu.Unlock()
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			c.fetch()
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// Collect implements prometheus.Collector.
+// If the fault list can't be fetched, no faults and no count are emitted, so that an unreachable ISG isn't mistaken for a fault-free one.
+func (c *FaultCollector) Collect(ch chan<- prometheus.Metric) {
+	defer c.scrapeErrorCounter.Collect(ch)
+	c.mu.RLock()
+	polling := c.polling
+	c.mu.RUnlock()
+	if !polling {
+		c.fetch()
+	}
+	faults, ok := c.currentFaults()
+	if !ok {
+		return
+	}
+	for _, fault := range faults {
+		ch <- prometheus.MustNewConstMetric(c.faultActiveGauge, prometheus.GaugeValue, 1, fault.Code, fault.Description)
+	}
+	ch <- prometheus.MustNewConstMetric(c.faultCountGauge, prometheus.GaugeValue, float64(len(faults)))
+}
+
+// fetch fetches the fault list and records it in the history.
+func (c *FaultCollector) fetch() {
+	ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
+	defer cancel()
+	faults, err := c.parser.ParseFaults(ctx, c.page)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err != nil {
+		c.scrapeErrorCounter.Inc()
+		log.WithError(err).WithField("page", c.page).Error("Could not scrape fault list")
+		if !c.polling {
+			c.faults, c.fetchedAt = nil, time.Time{}
+		}
+		return
+	}
+	c.faults = uniqueFaults(faults)
+	c.fetchedAt = time.Now()
+	if c.history != nil {
+		c.history.Record(c.faults)
+	}
+}
+
+// currentFaults returns the latest fault list.
+// It returns false if no fault list could be fetched yet or if it is stale.
+func (c *FaultCollector) currentFaults() ([]stiebeleltron.Fault, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if c.fetchedAt.IsZero() || (c.polling && c.maxAge > 0 && time.Since(c.fetchedAt) > c.maxAge) {
+		return nil, false
+	}
+	return c.faults, true
+}
+
+// uniqueFaults removes duplicate faults, which would be duplicate series.
+func uniqueFaults(faults []stiebeleltron.Fault) []stiebeleltron.Fault {
+	seen := make(map[stiebeleltron.Fault]bool, len(faults))
+	unique := make([]stiebeleltron.Fault, 0, len(faults))
+	for _, fault := range faults {
+		if !seen[fault] {
+			seen[fault] = true
+			unique = append(unique, fault)
+		}
+	}
+	return unique
+}
+
+// NewFaultHistory returns an empty FaultHistory that keeps at most maxSize faults.
+// Once full, the fault that was seen least recently is dropped.
+func NewFaultHistory(maxSize int) *FaultHistory {
+	return &FaultHistory{
+		maxSize: maxSize,
+		entries: map[stiebeleltron.Fault]*FaultHistoryEntry{},
+		now:     time.Now,
+	}
+}
+
+// Record updates the history with the faults that are currently active.
+// A fault that becomes active again after it was inactive counts as another occurrence.
+func (h *FaultHistory) Record(active []stiebeleltron.Fault) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	now := h.now()
+	activeNow := make(map[stiebeleltron.Fault]bool, len(active))
+	for _, fault := range active {
+		activeNow[fault] = true
+		entry, exists := h.entries[fault]
+		if !exists {
+			entry = &FaultHistoryEntry{Fault: fault, FirstSeen: now}
+			h.entries[fault] = entry
+		}
+		if !entry.Active {
+			entry.Occurrences++
+		}
+		entry.Active = true
+		entry.LastSeen = now
+	}
+	for fault, entry := range h.entries {
+		entry.Active = activeNow[fault]
+	}
+	for len(h.entries) > h.maxSize {
+		delete(h.entries, h.sortedEntries()[len(h.entries)-1].Fault)
+	}
+}
+
+// Entries returns a copy of the faults in the history, the most recently seen first.
+func (h *FaultHistory) Entries() []FaultHistoryEntry {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	sorted := h.sortedEntries()
+	entries := make([]FaultHistoryEntry, len(sorted))
+	for i, entry := range sorted {
+		entries[i] = *entry
+	}
+	return entries
+}
+
+func (h *FaultHistory) sortedEntries() []*FaultHistoryEntry {
+	entries := make([]*FaultHistoryEntry, 0, len(h.entries))
+	for _, entry := range h.entries {
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if !entries[i].LastSeen.Equal(entries[j].LastSeen) {
+			return entries[i].LastSeen.After(entries[j].LastSeen)
+		}
+		return entries[i].Code < entries[j].Code
+	})
+	return entries
+}
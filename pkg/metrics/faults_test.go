@@ -0,0 +1,149 @@
+package metrics
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ccremer/stiebeleltron-exporter/pkg/stiebeleltron"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type stubFaultParser struct {
+	mu     sync.Mutex
+	faults []stiebeleltron.Fault
+	err    error
+	calls  int
+}
+
+func (p *stubFaultParser) ParseFaults(_ context.Context, _ string) ([]stiebeleltron.Fault, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.calls++
+	return p.faults, p.err
+}
+
+func (p *stubFaultParser) Calls() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.calls
+}
+
+func TestFaultCollector_Collect(t *testing.T) {
+	tests := []struct {
+		name     string
+		parser   *stubFaultParser
+		expected string
+	}{
+		{
+			name: "GivenFaults_ThenEmitActiveFaultsAndCount",
+			parser: &stubFaultParser{faults: []stiebeleltron.Fault{
+				{Code: "16", Description: "LOW PRESSURE SENSOR"},
+				{Code: "31", Description: "HIGH PRESSURE"},
+				{Code: "16", Description: "LOW PRESSURE SENSOR"},
+			}},
+			expected: `
+# HELP stiebeleltron_fault_active Active fault of the ISG, as listed in the diagnosis page
+# TYPE stiebeleltron_fault_active gauge
+stiebeleltron_fault_active{code="16",description="LOW PRESSURE SENSOR"} 1
+stiebeleltron_fault_active{code="31",description="HIGH PRESSURE"} 1
+# HELP stiebeleltron_fault_count Number of active faults of the ISG
+# TYPE stiebeleltron_fault_count gauge
+stiebeleltron_fault_count 2
+`,
+		},
+		{
+			name:   "GivenNoFaults_ThenEmitZeroCount",
+			parser: &stubFaultParser{},
+			expected: `
+# HELP stiebeleltron_fault_count Number of active faults of the ISG
+# TYPE stiebeleltron_fault_count gauge
+stiebeleltron_fault_count 0
+`,
+		},
+		{
+			name:     "GivenUnreachableISG_ThenOmitCount",
+			parser:   &stubFaultParser{err: errors.New("connection refused")},
+			expected: "",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			collector := NewFaultCollector(tt.parser, "?s=2,0", time.Second, nil)
+			err := testutil.CollectAndCompare(collector, strings.NewReader(tt.expected),
+				"stiebeleltron_fault_active", "stiebeleltron_fault_count")
+			assert.NoError(t, err)
+		})
+	}
+}
+
+func TestFaultCollector_Collect_GivenPolling_ThenServeFaultListOfLatestPoll(t *testing.T) {
+	parser := &stubFaultParser{faults: []stiebeleltron.Fault{{Code: "16", Description: "LOW PRESSURE SENSOR"}}}
+	history := NewFaultHistory(10)
+	collector := NewFaultCollector(parser, "?s=2,0", time.Second, history)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	collector.StartPolling(ctx, time.Hour, time.Hour)
+	require.Eventually(t, func() bool {
+		_, ok := collector.currentFaults()
+		return ok
+	}, 5*time.Second, 10*time.Millisecond)
+	parser.mu.Lock()
+	parser.err = errors.New("connection refused")
+	parser.mu.Unlock()
+
+	expected := `
+# HELP stiebeleltron_fault_count Number of active faults of the ISG
+# TYPE stiebeleltron_fault_count gauge
+stiebeleltron_fault_count 1
+`
+	for i := 0; i < 2; i++ {
+		assert.NoError(t, testutil.CollectAndCompare(collector, strings.NewReader(expected), "stiebeleltron_fault_count"))
+	}
+	assert.Equal(t, 1, parser.Calls(), "the fault list is only fetched by the poller")
+	require.Len(t, history.Entries(), 1)
+	assert.Equal(t, 1, history.Entries()[0].Occurrences)
+}
+
+func TestFaultHistory_Record(t *testing.T) {
+	lowPressure := stiebeleltron.Fault{Code: "16", Description: "LOW PRESSURE SENSOR"}
+	highPressure := stiebeleltron.Fault{Code: "31", Description: "HIGH PRESSURE"}
+	defrost := stiebeleltron.Fault{Code: "50", Description: "DEFROST FAILED"}
+
+	history := NewFaultHistory(2)
+	now := time.Date(2023, 1, 7, 6, 0, 0, 0, time.UTC)
+	history.now = func() time.Time { return now }
+	record := func(faults ...stiebeleltron.Fault) {
+		now = now.Add(time.Minute)
+		history.Record(faults)
+	}
+
+	record(lowPressure)
+	record(lowPressure, highPressure)
+	record()
+	record(lowPressure)
+
+	entries := history.Entries()
+	require.Len(t, entries, 2)
+	assert.Equal(t, lowPressure, entries[0].Fault)
+	assert.Equal(t, 2, entries[0].Occurrences, "the fault became active twice")
+	assert.True(t, entries[0].Active)
+	assert.Equal(t, time.Date(2023, 1, 7, 6, 1, 0, 0, time.UTC), entries[0].FirstSeen)
+	assert.Equal(t, time.Date(2023, 1, 7, 6, 4, 0, 0, time.UTC), entries[0].LastSeen)
+	assert.Equal(t, highPressure, entries[1].Fault)
+	assert.Equal(t, 1, entries[1].Occurrences)
+	assert.False(t, entries[1].Active)
+
+	// The least recently seen fault is dropped once the history is full.
+	record(defrost)
+	entries = history.Entries()
+	require.Len(t, entries, 2)
+	assert.Equal(t, defrost, entries[0].Fault)
+	assert.Equal(t, lowPressure, entries[1].Fault)
+}
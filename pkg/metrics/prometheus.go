@@ -1,27 +1,68 @@
 package metrics
 
 import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/ccremer/stiebeleltron-exporter/pkg/stiebeleltron"
 	"github.com/prometheus/client_golang/prometheus"
-	log "github.com/sirupsen/logrus"
 )
 
 type (
+	// Transformer converts the value as displayed by the ISG, e.g. into base units.
 	Transformer func(v float64) float64
 )
 
 type PrometheusMetric struct {
-	GaugeName            string
+	GaugeName string
+	// Type is either MetricTypeGauge (default) or MetricTypeCounter.
+	Type string
+	// DailyReset is true if the ISG resets the value at midnight.
+	// Such values are accumulated by DailyCounters into the counter Accumulated, in addition to the value itself.
+	DailyReset bool
+	// Accumulated is the counter of the values accumulated across days, set by InitializeMetric if DailyReset is true.
+	Accumulated          *PrometheusMetric
 	Group                string
 	GroupSearchString    string
 	PropertySearchString string
+	Register             uint16
+	RegisterType         stiebeleltron.RegisterType
+	DataType             stiebeleltron.DataType
 	HelpText             string
-	Labels               prometheus.Labels
-	Gauge                prometheus.Gauge
-	ValueTransformer     Transformer
+	// Unit is the unit that the value is converted into, if any.
+	Unit string
+	// States maps text values to states, exported as state set with one series per state.
+	States map[string]string
+	// Codes maps text values to numeric codes.
+	Codes            map[string]float64
+	Labels           prometheus.Labels
+	Desc             *prometheus.Desc
+	ValueTransformer Transformer
+}
+
+// Page is a set of metrics that are scraped together, either from an HTML page or via Modbus.
+type Page struct {
+	// Name is the key of the page in the definitions.
+	Name string
+	// Path is the URL suffix of an HTML page, or the name of a Modbus page.
+	Path string
+	// Type selects the stiebeleltron.PageParser of the page.
+	Type    string
+	Metrics []*PrometheusMetric
 }
 
+const (
+	// MetricTypeGauge is the type of values that can go up and down, e.g. temperatures.
+	MetricTypeGauge = "gauge"
+	// MetricTypeCounter is the type of cumulative values that only ever increase, e.g. runtimes and heat amounts.
+	MetricTypeCounter = "counter"
+)
+
 var (
 	Namespace = "stiebeleltron"
+	// StateLabel is the label that holds the state of metrics exported as state set.
+	StateLabel = "state"
 )
 
 func (p *PrometheusMetric) GetGroup() string {
@@ -32,36 +73,160 @@ func (p *PrometheusMetric) GetSearchString() string {
 	return p.PropertySearchString
 }
 
+func (p *PrometheusMetric) GetRegister() uint16 {
+	return p.Register
+}
+
+func (p *PrometheusMetric) GetRegisterType() stiebeleltron.RegisterType {
+	return p.RegisterType
+}
+
+func (p *PrometheusMetric) GetDataType() stiebeleltron.DataType {
+	return p.DataType
+}
+
+func (p *PrometheusMetric) GetUnit() string {
+	return p.Unit
+}
+
+// IsText returns true if the value is displayed as text that is mapped with States or Codes.
+func (p *PrometheusMetric) IsText() bool {
+	return len(p.States) > 0 || len(p.Codes) > 0
+}
+
+// IsStateSet returns true if the metric is exported as state set.
+func (p *PrometheusMetric) IsStateSet() bool {
+	return len(p.States) > 0
+}
+
+// LookupState returns the state of the given text, ignoring case.
+func (p *PrometheusMetric) LookupState(text string) (string, bool) {
+	for key, state := range p.States {
+		if strings.EqualFold(key, text) {
+			return state, true
+		}
+	}
+	return "", false
+}
+
+// LookupCode returns the numeric code of the given text, ignoring case.
+func (p *PrometheusMetric) LookupCode(text string) (float64, bool) {
+	for key, code := range p.Codes {
+		if strings.EqualFold(key, text) {
+			return code, true
+		}
+	}
+	return 0, false
+}
+
+// StateNames returns the distinct states of the metric in alphabetical order.
+func (p *PrometheusMetric) StateNames() []string {
+	seen := map[string]bool{}
+	names := make([]string, 0, len(p.States))
+	for _, state := range p.States {
+		if !seen[state] {
+			seen[state] = true
+			names = append(names, state)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// InitializeMetric creates the descriptor of the metric.
+// It has to be called before the metric is used in a Collector.
 func (p *PrometheusMetric) InitializeMetric() {
-	p.Gauge = prometheus.NewGauge(prometheus.GaugeOpts{
-		Namespace:   Namespace,
-		Subsystem:   p.Group,
-		Name:        p.GaugeName,
-		Help:        p.HelpText,
-		ConstLabels: p.Labels,
-	})
-	prometheus.MustRegister(p.Gauge)
+	var variableLabels []string
+	if p.IsStateSet() {
+		variableLabels = []string{StateLabel}
+	}
+	p.Desc = prometheus.NewDesc(
+		p.FQName(),
+		p.HelpText,
+		variableLabels,
+		p.Labels,
+	)
+	p.Accumulated = nil
+	if p.DailyReset {
+		p.Accumulated = &PrometheusMetric{
+			GaugeName: AccumulatedName(p.GaugeName),
+			Type:      MetricTypeCounter,
+			Group:     p.Group,
+			HelpText:  strings.TrimSpace(p.HelpText + " accumulated across days"),
+			Unit:      p.Unit,
+			Labels:    p.Labels,
+		}
+		p.Accumulated.InitializeMetric()
+	}
 }
 
-func (p *PrometheusMetric) SetValue(v float64) {
-	if p.ValueTransformer == nil {
-		p.Gauge.Set(v)
-		return
+// AccumulatedName returns the name of the counter that accumulates the daily values of the metric with the given name,
+// e.g. "heating_accumulated" for "heating_total". FQName adds the suffix "_total" again.
+func AccumulatedName(name string) string {
+	return strings.TrimSuffix(name, "_total") + "_accumulated"
+}
+
+// FQName returns the fully-qualified name of the metric as exported to Prometheus.
+// Counters get the suffix "_total" as required by the Prometheus naming conventions, unless they already have it.
+func (p *PrometheusMetric) FQName() string {
+	name := prometheus.BuildFQName(Namespace, p.Group, p.GaugeName)
+	if p.IsCounter() && !strings.HasSuffix(name, "_total") {
+		name += "_total"
+	}
+	return name
+}
+
+// ID returns the fully-qualified name of the metric including its labels.
+// It identifies the series of the metric, e.g. in DailyCounters.
+// It doesn't include the suffix of FQName, so that persisted state stays valid.
+func (p *PrometheusMetric) ID() string {
+	names := make([]string, 0, len(p.Labels))
+	for name := range p.Labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		pairs[i] = fmt.Sprintf("%s=%q", name, p.Labels[name])
 	}
-	p.Gauge.Set(p.ValueTransformer(v))
+	return fmt.Sprintf("%s{%s}", prometheus.BuildFQName(Namespace, p.Group, p.GaugeName), strings.Join(pairs, ","))
 }
 
-func NewDivisorTransformer(divisor float64) Transformer {
-	if divisor == 0 {
-		log.Fatal("cannot use 0 as a divisor!")
+// Transform applies the ValueTransformer to the given value, if there is any.
+func (p *PrometheusMetric) Transform(v float64) float64 {
+	if p.ValueTransformer == nil {
+		return v
 	}
-	return func(v float64) float64 {
-		return v / divisor
+	return p.ValueTransformer(v)
+}
+
+// IsCounter returns true if the metric is of type MetricTypeCounter.
+func (p *PrometheusMetric) IsCounter() bool {
+	return p.Type == MetricTypeCounter
+}
+
+// NewStateSetMetrics returns one metric per state, with value 1 for the given current state and 0 for all others.
+func (p *PrometheusMetric) NewStateSetMetrics(current string) ([]prometheus.Metric, error) {
+	names := p.StateNames()
+	m := make([]prometheus.Metric, 0, len(names))
+	for _, name := range names {
+		v := 0.0
+		if name == current {
+			v = 1
+		}
+		metric, err := prometheus.NewConstMetric(p.Desc, prometheus.GaugeValue, v, name)
+		if err != nil {
+			return nil, err
+		}
+		m = append(m, metric)
 	}
+	return m, nil
 }
 
-func NewMultiplierTransformer(multiplier float64) Transformer {
-	return func(v float64) float64 {
-		return v * multiplier
+// NewConstMetric returns a metric with the given, already transformed value.
+func (p *PrometheusMetric) NewConstMetric(v float64) (prometheus.Metric, error) {
+	if p.IsCounter() {
+		return prometheus.NewConstMetric(p.Desc, prometheus.CounterValue, v)
 	}
+	return prometheus.NewConstMetric(p.Desc, prometheus.GaugeValue, v)
 }
@@ -0,0 +1,127 @@
+package metrics
+
+import (
+	"errors"
+	"fmt"
+	"math"
+)
+
+type (
+	// TransformStep is a single step of a Transformer chain.
+	// Exactly one of the operations has to be set.
+	TransformStep struct {
+		// Multiply multiplies the value with the given factor.
+		Multiply *float64 `yaml:"multiply,omitempty"`
+		// Divide divides the value by the given divisor, which must not be 0.
+		Divide *float64 `yaml:"divide,omitempty"`
+		// Offset adds the given offset to the value.
+		Offset *float64 `yaml:"offset,omitempty"`
+		// Clamp limits the value to the given range.
+		Clamp *ClampRange `yaml:"clamp,omitempty"`
+		// Round rounds the value to the given number of decimal places.
+		Round *int `yaml:"round,omitempty"`
+		// Invert flips the sign of the value.
+		Invert bool `yaml:"invert,omitempty"`
+	}
+	// ClampRange is the range of a TransformStep that clamps the value.
+	// Either bound may be omitted.
+	ClampRange struct {
+		Min *float64 `yaml:"min,omitempty"`
+		Max *float64 `yaml:"max,omitempty"`
+	}
+)
+
+// NewTransformer returns a Transformer that applies the given steps in order.
+// It returns an error if any step is invalid, so that broken definitions are rejected before any value is scraped.
+func NewTransformer(steps []TransformStep) (Transformer, error) {
+	if len(steps) == 0 {
+		return nil, nil
+	}
+	chain := make([]Transformer, len(steps))
+	for i, step := range steps {
+		t, err := step.transformer()
+		if err != nil {
+			return nil, fmt.Errorf("transform step %d: %w", i+1, err)
+		}
+		chain[i] = t
+	}
+	return func(v float64) float64 {
+		for _, t := range chain {
+			v = t(v)
+		}
+		return v
+	}, nil
+}
+
+func (step TransformStep) transformer() (Transformer, error) {
+	var transformers []Transformer
+	if step.Multiply != nil {
+		factor := *step.Multiply
+		transformers = append(transformers, func(v float64) float64 {
+			return v * factor
+		})
+	}
+	if step.Divide != nil {
+		divisor := *step.Divide
+		if divisor == 0 {
+			return nil, errors.New("cannot divide by 0")
+		}
+		transformers = append(transformers, func(v float64) float64 {
+			return v / divisor
+		})
+	}
+	if step.Offset != nil {
+		offset := *step.Offset
+		transformers = append(transformers, func(v float64) float64 {
+			return v + offset
+		})
+	}
+	if step.Clamp != nil {
+		t, err := step.Clamp.transformer()
+		if err != nil {
+			return nil, err
+		}
+		transformers = append(transformers, t)
+	}
+	if step.Round != nil {
+		if *step.Round < 0 {
+			return nil, fmt.Errorf("cannot round to %d decimal places", *step.Round)
+		}
+		pow := math.Pow(10, float64(*step.Round))
+		transformers = append(transformers, func(v float64) float64 {
+			return math.Round(v*pow) / pow
+		})
+	}
+	if step.Invert {
+		transformers = append(transformers, func(v float64) float64 {
+			return -v
+		})
+	}
+	switch len(transformers) {
+	case 0:
+		return nil, errors.New("no operation given, must be one of multiply, divide, offset, clamp, round, invert")
+	case 1:
+		return transformers[0], nil
+	default:
+		return nil, errors.New("more than one operation given, use a separate step for each operation so that the order is explicit")
+	}
+}
+
+func (r ClampRange) transformer() (Transformer, error) {
+	min, max := math.Inf(-1), math.Inf(1)
+	if r.Min != nil {
+		min = *r.Min
+	}
+	if r.Max != nil {
+		max = *r.Max
+	}
+	if r.Min == nil && r.Max == nil {
+		return nil, errors.New("clamp needs min, max or both")
+	}
+	if min > max {
+		return nil, fmt.Errorf("clamp min %v is greater than max %v", min, max)
+	}
+	return func(v float64) float64 {
+		return math.Max(min, math.Min(max, v))
+	}, nil
+}
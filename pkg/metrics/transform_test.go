@@ -0,0 +1,99 @@
+package metrics
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func float(f float64) *float64 {
+	return &f
+}
+
+func integer(i int) *int {
+	return &i
+}
+
+func TestNewTransformer(t *testing.T) {
+	tests := []struct {
+		name          string
+		steps         []TransformStep
+		value         float64
+		expected      float64
+		expectedError string
+	}{
+		{
+			name:     "GivenNoSteps_ThenKeepValue",
+			value:    21.5,
+			expected: 21.5,
+		},
+		{
+			name:     "GivenMultiplyAndDivide_ThenApplyBoth",
+			steps:    []TransformStep{{Multiply: float(3600)}, {Divide: float(60)}},
+			value:    2,
+			expected: 120,
+		},
+		{
+			name:     "GivenOffsetAndRound_ThenApplyInOrder",
+			steps:    []TransformStep{{Offset: float(-273.15)}, {Round: integer(1)}},
+			value:    300,
+			expected: 26.9,
+		},
+		{
+			name:     "GivenClamp_WhenValueAboveMax_ThenReturnMax",
+			steps:    []TransformStep{{Clamp: &ClampRange{Min: float(0), Max: float(100)}}},
+			value:    120,
+			expected: 100,
+		},
+		{
+			name:     "GivenClampWithMinOnly_WhenValueBelowMin_ThenReturnMin",
+			steps:    []TransformStep{{Clamp: &ClampRange{Min: float(0)}}},
+			value:    -3,
+			expected: 0,
+		},
+		{
+			name:     "GivenInvert_ThenFlipSign",
+			steps:    []TransformStep{{Invert: true}, {Multiply: float(2)}},
+			value:    1.5,
+			expected: -3,
+		},
+		{
+			name:          "GivenDivisionByZero_ThenReturnError",
+			steps:         []TransformStep{{Multiply: float(2)}, {Divide: float(0)}},
+			expectedError: "transform step 2: cannot divide by 0",
+		},
+		{
+			name:          "GivenTwoOperationsInOneStep_ThenReturnError",
+			steps:         []TransformStep{{Multiply: float(2), Divide: float(10)}},
+			expectedError: "transform step 1: more than one operation given",
+		},
+		{
+			name:          "GivenEmptyStep_ThenReturnError",
+			steps:         []TransformStep{{}},
+			expectedError: "transform step 1: no operation given",
+		},
+		{
+			name:          "GivenClampWithMinAboveMax_ThenReturnError",
+			steps:         []TransformStep{{Clamp: &ClampRange{Min: float(10), Max: float(0)}}},
+			expectedError: "transform step 1: clamp min 10 is greater than max 0",
+		},
+		{
+			name:          "GivenNegativeRound_ThenReturnError",
+			steps:         []TransformStep{{Round: integer(-1)}},
+			expectedError: "transform step 1: cannot round to -1 decimal places",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			transformer, err := NewTransformer(tt.steps)
+			if tt.expectedError != "" {
+				assert.ErrorContains(t, err, tt.expectedError)
+				return
+			}
+			require.NoError(t, err)
+			m := &PrometheusMetric{ValueTransformer: transformer}
+			assert.InDelta(t, tt.expected, m.Transform(tt.value), 1e-9)
+		})
+	}
+}
@@ -0,0 +1,299 @@
+package mqtt
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ccremer/stiebeleltron-exporter/pkg/metrics"
+	paho "github.com/eclipse/paho.mqtt.golang"
+	log "github.com/sirupsen/logrus"
+)
+
+type (
+	// Options configures a Publisher.
+	Options struct {
+		// Broker is the URL of the MQTT broker, e.g. "tcp://localhost:1883".
+		Broker   string
+		ClientID string
+		Username string
+		Password string
+		// TopicPrefix is the first level of the topics, e.g. "stiebeleltron".
+		TopicPrefix string
+		// Retain publishes the values as retained messages, so that subscribers get the last value immediately.
+		Retain bool
+		QoS    byte
+		// DiscoveryPrefix is the topic prefix of Home Assistant MQTT discovery, e.g. "homeassistant".
+		// If empty, no discovery configs are published.
+		DiscoveryPrefix string
+		// NodeID identifies the ISG in Home Assistant, e.g. if there is more than one.
+		NodeID string
+		// Timeout is the time to wait for the broker to acknowledge a message.
+		Timeout time.Duration
+	}
+	// Publisher implements metrics.SnapshotHandler.
+	// It publishes each parsed value of a Snapshot to its own topic and announces it to Home Assistant, if enabled.
+	Publisher struct {
+		client  paho.Client
+		options Options
+
+		mu        sync.Mutex
+		announced map[string]bool
+		stopped   bool
+	}
+	// discoveryConfig is the config of a sensor for Home Assistant MQTT discovery.
+	discoveryConfig struct {
+		Name              string   `json:"name"`
+		UniqueID          string   `json:"unique_id"`
+		ObjectID          string   `json:"object_id"`
+		StateTopic        string   `json:"state_topic"`
+		AvailabilityTopic string   `json:"availability_topic"`
+		UnitOfMeasurement string   `json:"unit_of_measurement,omitempty"`
+		DeviceClass       string   `json:"device_class,omitempty"`
+		StateClass        string   `json:"state_class,omitempty"`
+		Options           []string `json:"options,omitempty"`
+		Device            device   `json:"device"`
+	}
+	device struct {
+		Identifiers  []string `json:"identifiers"`
+		Name         string   `json:"name"`
+		Manufacturer string   `json:"manufacturer"`
+	}
+	// homeAssistantUnit is the unit and device class of a metrics.PrometheusMetric unit in Home Assistant.
+	homeAssistantUnit struct {
+		unit        string
+		deviceClass string
+	}
+)
+
+const (
+	// StatusOnline is published to the availability topic when the Publisher connects.
+	StatusOnline = "online"
+	// StatusOffline is published to the availability topic when the Publisher disconnects, or by the broker if the connection is lost.
+	StatusOffline = "offline"
+)
+
+var (
+	homeAssistantUnits = map[string]homeAssistantUnit{
+		"celsius":                 {unit: "°C", deviceClass: "temperature"},
+		"kelvin":                  {unit: "K"},
+		"pascals":                 {unit: "Pa", deviceClass: "pressure"},
+		"cubic_meters_per_second": {unit: "m³/s"},
+		"joules":                  {unit: "J", deviceClass: "energy"},
+		"seconds":                 {unit: "s", deviceClass: "duration"},
+	}
+	invalidTopicCharsRegex = regexp.MustCompile(`[/+#\s]+`)
+	invalidObjectIDRegex   = regexp.MustCompile(`[^a-z0-9_]+`)
+)
+
+// NewPublisher returns a Publisher that publishes to the broker given in the options.
+// It has to be connected with Connect.
+func NewPublisher(options Options) *Publisher {
+	p := &Publisher{
+		options:   options,
+		announced: map[string]bool{},
+	}
+	clientOptions := paho.NewClientOptions().
+		AddBroker(options.Broker).
+		SetClientID(options.ClientID).
+		SetUsername(options.Username).
+		SetPassword(options.Password).
+		SetAutoReconnect(true).
+		SetConnectRetry(true).
+		SetWill(p.availabilityTopic(), StatusOffline, options.QoS, true).
+		SetOnConnectHandler(p.onConnect)
+	p.client = paho.NewClient(clientOptions)
+	return p
+}
+
+// Connect connects to the broker.
+// If the broker isn't reachable within the timeout, an error is returned, but the Publisher keeps retrying in the background.
+func (p *Publisher) Connect() error {
+	token := p.client.Connect()
+	if !token.WaitTimeout(p.options.Timeout) {
+		return fmt.Errorf("could not connect to MQTT broker %s within %s", p.options.Broker, p.options.Timeout)
+	}
+	return token.Error()
+}
+
+// Disconnect publishes the offline status and disconnects from the broker.
+func (p *Publisher) Disconnect() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.stopped = true
+	if p.client.IsConnectionOpen() {
+		p.client.Publish(p.availabilityTopic(), p.options.QoS, true, StatusOffline).WaitTimeout(p.options.Timeout)
+	}
+	p.client.Disconnect(uint(p.options.Timeout.Milliseconds()))
+}
+
+// onConnect announces the availability after each (re)connect.
+// The discovery configs are retained, so they don't have to be published again.
+func (p *Publisher) onConnect(client paho.Client) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.stopped {
+		return
+	}
+	client.Publish(p.availabilityTopic(), p.options.QoS, true, StatusOnline).WaitTimeout(p.options.Timeout)
+	log.WithField("broker", p.options.Broker).Info("Connected to MQTT broker.")
+}
+
+// HandleSnapshot implements metrics.SnapshotHandler.
+// Values of metrics that weren't published before are announced to Home Assistant first.
+func (p *Publisher) HandleSnapshot(snapshot *metrics.Snapshot) {
+	if !p.client.IsConnectionOpen() {
+		log.WithField("broker", p.options.Broker).Warn("Not connected to MQTT broker, skipping publish of values")
+		return
+	}
+	var tokens []paho.Token
+	// announcements maps the tokens of discovery configs to the object ID of their metric.
+	announcements := map[paho.Token]string{}
+	for _, sample := range snapshot.Samples {
+		if p.options.DiscoveryPrefix != "" {
+			if objectID, token := p.announce(sample.Metric); token != nil {
+				tokens = append(tokens, token)
+				announcements[token] = objectID
+			}
+		}
+		tokens = append(tokens, p.client.Publish(p.Topic(sample.Metric), p.options.QoS, p.options.Retain, payload(sample)))
+	}
+	failed := 0
+	var lastErr error
+	for _, token := range tokens {
+		var err error
+		if !token.WaitTimeout(p.options.Timeout) {
+			err = fmt.Errorf("no acknowledgement within %s", p.options.Timeout)
+		} else {
+			err = token.Error()
+		}
+		if err == nil {
+			continue
+		}
+		failed++
+		lastErr = err
+		if objectID, isAnnouncement := announcements[token]; isAnnouncement {
+			// Announce the metric again with the next Snapshot.
+			p.mu.Lock()
+			delete(p.announced, objectID)
+			p.mu.Unlock()
+		}
+	}
+	if failed > 0 {
+		log.WithError(lastErr).WithField("failed", failed).Warn("Could not publish values to MQTT broker")
+		return
+	}
+	log.WithField("values", len(snapshot.Samples)).Debug("Published values to MQTT broker")
+}
+
+// announce publishes the discovery config of the metric, unless it was already published, and returns its object ID.
+// The metric counts as announced right away, so that concurrent snapshots don't announce it twice.
+// If the returned token fails, the caller has to remove the object ID from the announced metrics.
+func (p *Publisher) announce(metric *metrics.PrometheusMetric) (string, paho.Token) {
+	objectID := p.objectID(metric)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.announced[objectID] {
+		return objectID, nil
+	}
+	b, err := json.Marshal(p.discoveryConfig(metric))
+	if err != nil {
+		log.WithError(err).WithField("metric", metric.GaugeName).Warn("Could not create discovery config")
+		return objectID, nil
+	}
+	p.announced[objectID] = true
+	return objectID, p.client.Publish(p.DiscoveryTopic(metric), p.options.QoS, true, b)
+}
+
+// Topic returns the topic of the metric's values, made of the prefix, group, name and label values sorted by label name,
+// e.g. "stiebeleltron/room_temperature/heating_circuit/hc1/actual".
+func (p *Publisher) Topic(metric *metrics.PrometheusMetric) string {
+	levels := append([]string{p.options.TopicPrefix}, seriesParts(metric)...)
+	return strings.Join(levels, "/")
+}
+
+// DiscoveryTopic returns the topic of the metric's Home Assistant discovery config.
+func (p *Publisher) DiscoveryTopic(metric *metrics.PrometheusMetric) string {
+	return strings.Join([]string{p.options.DiscoveryPrefix, "sensor", p.options.NodeID, p.objectID(metric), "config"}, "/")
+}
+
+func (p *Publisher) availabilityTopic() string {
+	return p.options.TopicPrefix + "/availability"
+}
+
+func (p *Publisher) objectID(metric *metrics.PrometheusMetric) string {
+	id := strings.ToLower(strings.Join(append([]string{p.options.NodeID}, seriesParts(metric)...), "_"))
+	return invalidObjectIDRegex.ReplaceAllString(id, "_")
+}
+
+func (p *Publisher) discoveryConfig(metric *metrics.PrometheusMetric) discoveryConfig {
+	name := metric.HelpText
+	if name == "" {
+		name = metric.GaugeName
+	}
+	if values := labelValues(metric); len(values) > 0 {
+		name = fmt.Sprintf("%s (%s)", name, strings.Join(values, ", "))
+	}
+	config := discoveryConfig{
+		Name:              name,
+		UniqueID:          p.objectID(metric),
+		ObjectID:          p.objectID(metric),
+		StateTopic:        p.Topic(metric),
+		AvailabilityTopic: p.availabilityTopic(),
+		Device: device{
+			Identifiers:  []string{p.options.NodeID},
+			Name:         "Stiebel Eltron ISG",
+			Manufacturer: "Stiebel Eltron",
+		},
+	}
+	if metric.IsStateSet() {
+		config.DeviceClass = "enum"
+		config.Options = metric.StateNames()
+		return config
+	}
+	if unit, known := homeAssistantUnits[metric.Unit]; known {
+		config.UnitOfMeasurement = unit.unit
+		config.DeviceClass = unit.deviceClass
+	}
+	config.StateClass = "measurement"
+	if metric.IsCounter() {
+		config.StateClass = "total_increasing"
+	}
+	return config
+}
+
+// seriesParts returns the group, name and label values of the metric, usable as topic levels.
+func seriesParts(metric *metrics.PrometheusMetric) []string {
+	parts := append([]string{metric.Group, metric.GaugeName}, labelValues(metric)...)
+	for i, part := range parts {
+		parts[i] = invalidTopicCharsRegex.ReplaceAllString(part, "_")
+	}
+	return parts
+}
+
+// labelValues returns the values of the metric's labels, sorted by label name.
+func labelValues(metric *metrics.PrometheusMetric) []string {
+	names := make([]string, 0, len(metric.Labels))
+	for name := range metric.Labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	values := make([]string, len(names))
+	for i, name := range names {
+		values[i] = metric.Labels[name]
+	}
+	return values
+}
+
+// payload returns the value of the sample as text, the state for metrics exported as state set.
+func payload(sample metrics.Sample) string {
+	if sample.Metric.IsStateSet() {
+		return sample.State
+	}
+	return strconv.FormatFloat(sample.Value, 'f', -1, 64)
+}
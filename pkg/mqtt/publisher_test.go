@@ -0,0 +1,229 @@
+package mqtt
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ccremer/stiebeleltron-exporter/pkg/metrics"
+	paho "github.com/eclipse/paho.mqtt.golang"
+	"github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/hooks/auth"
+	"github.com/mochi-mqtt/server/v2/listeners"
+	"github.com/mochi-mqtt/server/v2/packets"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newBroker starts an embedded MQTT broker on a random port and returns its URL.
+func newBroker(t *testing.T) (*mqtt.Server, string) {
+	broker := mqtt.New(&mqtt.Options{
+		InlineClient: true,
+		Logger:       slog.New(slog.NewTextHandler(io.Discard, nil)),
+	})
+	require.NoError(t, broker.AddHook(new(auth.AllowHook), nil))
+	listener := listeners.NewTCP(listeners.Config{ID: "tcp", Address: "127.0.0.1:0"})
+	require.NoError(t, broker.AddListener(listener))
+	go func() {
+		_ = broker.Serve()
+	}()
+	t.Cleanup(func() {
+		_ = broker.Close()
+	})
+	return broker, "tcp://" + listener.Address()
+}
+
+// retained returns the payloads of the retained messages on the broker, keyed by topic.
+func retained(t *testing.T, broker *mqtt.Server) map[string]string {
+	var mu sync.Mutex
+	messages := map[string]string{}
+	require.NoError(t, broker.Subscribe("#", 1, func(_ *mqtt.Client, _ packets.Subscription, pk packets.Packet) {
+		mu.Lock()
+		defer mu.Unlock()
+		messages[pk.TopicName] = string(pk.Payload)
+	}))
+	require.NoError(t, broker.Unsubscribe("#", 1))
+	return messages
+}
+
+func newTestPublisher(t *testing.T, broker string) *Publisher {
+	publisher := NewPublisher(Options{
+		Broker:          broker,
+		ClientID:        "test",
+		TopicPrefix:     "stiebeleltron",
+		Retain:          true,
+		QoS:             1,
+		DiscoveryPrefix: "homeassistant",
+		NodeID:          "isg",
+		Timeout:         time.Second,
+	})
+	require.NoError(t, publisher.Connect())
+	t.Cleanup(publisher.Disconnect)
+	return publisher
+}
+
+func TestPublisher_HandleSnapshot(t *testing.T) {
+	broker, url := newBroker(t)
+	publisher := newTestPublisher(t, url)
+
+	temperature := &metrics.PrometheusMetric{
+		Group: "room_temperature", GaugeName: "heating_circuit", HelpText: "Room temperature", Unit: "celsius",
+		Labels: prometheus.Labels{"state": "actual", "circuit": "hc1"},
+	}
+	runtime := &metrics.PrometheusMetric{
+		Group: "runtime", GaugeName: "compressor_heating", Type: metrics.MetricTypeCounter, Unit: "seconds",
+	}
+	mode := &metrics.PrometheusMetric{
+		Group: "status", GaugeName: "operating_mode", HelpText: "Operating mode",
+		States: map[string]string{"ECO MODE": "eco", "AUTOMATIC": "automatic"},
+	}
+	publisher.HandleSnapshot(&metrics.Snapshot{Samples: []metrics.Sample{
+		{Metric: temperature, Value: 21.5},
+		{Metric: runtime, Value: 7200},
+		{Metric: mode, State: "eco"},
+	}})
+
+	messages := retained(t, broker)
+	assert.Eventually(t, func() bool {
+		// The availability is published concurrently after connecting.
+		return retained(t, broker)["stiebeleltron/availability"] == StatusOnline
+	}, time.Second, 10*time.Millisecond)
+	assert.Equal(t, "21.5", messages["stiebeleltron/room_temperature/heating_circuit/hc1/actual"])
+	assert.Equal(t, "7200", messages["stiebeleltron/runtime/compressor_heating"])
+	assert.Equal(t, "eco", messages["stiebeleltron/status/operating_mode"])
+
+	tests := []struct {
+		name     string
+		topic    string
+		expected discoveryConfig
+	}{
+		{
+			name:  "GivenGaugeWithLabels_ThenAnnounceMeasurement",
+			topic: "homeassistant/sensor/isg/isg_room_temperature_heating_circuit_hc1_actual/config",
+			expected: discoveryConfig{
+				Name:              "Room temperature (hc1, actual)",
+				UniqueID:          "isg_room_temperature_heating_circuit_hc1_actual",
+				ObjectID:          "isg_room_temperature_heating_circuit_hc1_actual",
+				StateTopic:        "stiebeleltron/room_temperature/heating_circuit/hc1/actual",
+				AvailabilityTopic: "stiebeleltron/availability",
+				UnitOfMeasurement: "°C",
+				DeviceClass:       "temperature",
+				StateClass:        "measurement",
+			},
+		},
+		{
+			name:  "GivenCounter_ThenAnnounceTotalIncreasing",
+			topic: "homeassistant/sensor/isg/isg_runtime_compressor_heating/config",
+			expected: discoveryConfig{
+				Name:              "compressor_heating",
+				UniqueID:          "isg_runtime_compressor_heating",
+				ObjectID:          "isg_runtime_compressor_heating",
+				StateTopic:        "stiebeleltron/runtime/compressor_heating",
+				AvailabilityTopic: "stiebeleltron/availability",
+				UnitOfMeasurement: "s",
+				DeviceClass:       "duration",
+				StateClass:        "total_increasing",
+			},
+		},
+		{
+			name:  "GivenStateSet_ThenAnnounceEnum",
+			topic: "homeassistant/sensor/isg/isg_status_operating_mode/config",
+			expected: discoveryConfig{
+				Name:              "Operating mode",
+				UniqueID:          "isg_status_operating_mode",
+				ObjectID:          "isg_status_operating_mode",
+				StateTopic:        "stiebeleltron/status/operating_mode",
+				AvailabilityTopic: "stiebeleltron/availability",
+				DeviceClass:       "enum",
+				Options:           []string{"automatic", "eco"},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			require.Contains(t, messages, tt.topic)
+			var config discoveryConfig
+			require.NoError(t, json.Unmarshal([]byte(messages[tt.topic]), &config))
+			tt.expected.Device = device{Identifiers: []string{"isg"}, Name: "Stiebel Eltron ISG", Manufacturer: "Stiebel Eltron"}
+			assert.Equal(t, tt.expected, config)
+		})
+	}
+}
+
+func TestPublisher_HandleSnapshot_GivenSameMetricTwice_ThenAnnounceOnce(t *testing.T) {
+	broker, url := newBroker(t)
+	publisher := newTestPublisher(t, url)
+	var mu sync.Mutex
+	announcements := 0
+	require.NoError(t, broker.Subscribe("homeassistant/#", 1, func(_ *mqtt.Client, _ packets.Subscription, _ packets.Packet) {
+		mu.Lock()
+		defer mu.Unlock()
+		announcements++
+	}))
+
+	metric := &metrics.PrometheusMetric{Group: "runtime", GaugeName: "compressor_heating"}
+	publisher.HandleSnapshot(&metrics.Snapshot{Samples: []metrics.Sample{{Metric: metric, Value: 1}}})
+	publisher.HandleSnapshot(&metrics.Snapshot{Samples: []metrics.Sample{{Metric: metric, Value: 2}}})
+
+	assert.Equal(t, "2", retained(t, broker)["stiebeleltron/runtime/compressor_heating"])
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, 1, announcements)
+}
+
+// failingClient fails the first publish of each discovery config, then publishes with the embedded client.
+type failingClient struct {
+	paho.Client
+	mu     sync.Mutex
+	failed map[string]bool
+}
+
+func (c *failingClient) Publish(topic string, qos byte, retained bool, payload interface{}) paho.Token {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if strings.HasPrefix(topic, "homeassistant/") && !c.failed[topic] {
+		c.failed[topic] = true
+		return &failedToken{}
+	}
+	return c.Client.Publish(topic, qos, retained, payload)
+}
+
+// failedToken is a completed paho.Token with an error.
+type failedToken struct{}
+
+func (t *failedToken) Wait() bool                     { return true }
+func (t *failedToken) WaitTimeout(time.Duration) bool { return true }
+func (t *failedToken) Done() <-chan struct{} {
+	done := make(chan struct{})
+	close(done)
+	return done
+}
+func (t *failedToken) Error() error { return errors.New("not acknowledged") }
+
+func TestPublisher_HandleSnapshot_GivenFailedAnnouncement_ThenAnnounceAgain(t *testing.T) {
+	broker, url := newBroker(t)
+	publisher := newTestPublisher(t, url)
+	publisher.client = &failingClient{Client: publisher.client, failed: map[string]bool{}}
+
+	metric := &metrics.PrometheusMetric{Group: "runtime", GaugeName: "compressor_heating"}
+	publisher.HandleSnapshot(&metrics.Snapshot{Samples: []metrics.Sample{{Metric: metric, Value: 1}}})
+	assert.NotContains(t, retained(t, broker), publisher.DiscoveryTopic(metric))
+	publisher.HandleSnapshot(&metrics.Snapshot{Samples: []metrics.Sample{{Metric: metric, Value: 2}}})
+
+	assert.Contains(t, retained(t, broker), publisher.DiscoveryTopic(metric))
+}
+
+func TestPublisher_Disconnect_ThenPublishOffline(t *testing.T) {
+	broker, url := newBroker(t)
+	publisher := newTestPublisher(t, url)
+
+	publisher.Disconnect()
+
+	assert.Equal(t, StatusOffline, retained(t, broker)["stiebeleltron/availability"])
+}
@@ -0,0 +1,119 @@
+package otlp
+
+import (
+	"time"
+
+	"github.com/ccremer/stiebeleltron-exporter/pkg/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/sdk/instrumentation"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+	"go.opentelemetry.io/otel/sdk/resource"
+)
+
+// ScopeName is the name of the instrumentation scope of all metrics.
+const ScopeName = "github.com/ccremer/stiebeleltron-exporter"
+
+// units maps the units of metrics.PrometheusMetric to UCUM units as recommended by OpenTelemetry.
+var units = map[string]string{
+	"celsius":                 "Cel",
+	"kelvin":                  "K",
+	"pascals":                 "Pa",
+	"cubic_meters_per_second": "m3/s",
+	"joules":                  "J",
+	"seconds":                 "s",
+}
+
+// FirmwareAttribute is the attribute of the resource that holds the firmware version of the ISG.
+const FirmwareAttribute = "isg.firmware"
+
+// NewResource returns the resource that describes the ISG with the given URL.
+// The attributes, e.g. FirmwareAttribute, are added to the resource.
+func NewResource(isgURL string, attributes map[string]string) *resource.Resource {
+	attrs := []attribute.KeyValue{
+		attribute.String("service.name", "stiebeleltron-exporter"),
+		attribute.String("isg.url", isgURL),
+	}
+	for k, v := range attributes {
+		attrs = append(attrs, attribute.String(k, v))
+	}
+	return resource.NewSchemaless(attrs...)
+}
+
+// toResourceMetrics converts the snapshot into OpenTelemetry metrics.
+// Counters become cumulative monotonic sums that started at the given time, all other metrics become gauges.
+// Metrics exported as state set get a data point per state with value 0 or 1, like in the Prometheus exposition.
+func toResourceMetrics(snapshot *metrics.Snapshot, res *resource.Resource, start time.Time) *metricdata.ResourceMetrics {
+	var order []string
+	byName := map[string]*metricdata.Metrics{}
+	for _, s := range snapshot.Samples {
+		name := prometheus.BuildFQName(metrics.Namespace, s.Metric.Group, s.Metric.GaugeName)
+		m, exists := byName[name]
+		if !exists {
+			m = newMetrics(name, s.Metric)
+			byName[name] = m
+			order = append(order, name)
+		}
+		addDataPoints(m, s, snapshot.SampleTimestamp(s), start)
+	}
+
+	scope := metricdata.ScopeMetrics{Scope: instrumentation.Scope{Name: ScopeName}}
+	for _, name := range order {
+		scope.Metrics = append(scope.Metrics, *byName[name])
+	}
+	return &metricdata.ResourceMetrics{Resource: res, ScopeMetrics: []metricdata.ScopeMetrics{scope}}
+}
+
+func newMetrics(name string, metric *metrics.PrometheusMetric) *metricdata.Metrics {
+	m := &metricdata.Metrics{Name: name, Description: metric.HelpText, Unit: units[metric.Unit]}
+	if metric.Type == metrics.MetricTypeCounter {
+		m.Data = metricdata.Sum[float64]{Temporality: metricdata.CumulativeTemporality, IsMonotonic: true}
+	} else {
+		m.Data = metricdata.Gauge[float64]{}
+	}
+	return m
+}
+
+func addDataPoints(m *metricdata.Metrics, s metrics.Sample, timestamp, start time.Time) {
+	var points []metricdata.DataPoint[float64]
+	if !s.Metric.IsStateSet() {
+		points = append(points, metricdata.DataPoint[float64]{Attributes: toAttributes(s.Metric.Labels, nil), Value: s.Value})
+	}
+	for _, state := range s.Metric.StateNames() {
+		value := 0.0
+		if state == s.State {
+			value = 1
+		}
+		stateAttr := attribute.String(metrics.StateLabel, state)
+		points = append(points, metricdata.DataPoint[float64]{Attributes: toAttributes(s.Metric.Labels, &stateAttr), Value: value})
+	}
+	for i := range points {
+		points[i].Time = timestamp
+	}
+
+	switch data := m.Data.(type) {
+	case metricdata.Sum[float64]:
+		for i := range points {
+			points[i].StartTime = start
+		}
+		data.DataPoints = append(data.DataPoints, points...)
+		m.Data = data
+	case metricdata.Gauge[float64]:
+		data.DataPoints = append(data.DataPoints, points...)
+		m.Data = data
+	}
+}
+
+// toAttributes converts the labels into attributes, skipping empty values.
+func toAttributes(labels prometheus.Labels, extra *attribute.KeyValue) attribute.Set {
+	attrs := make([]attribute.KeyValue, 0, len(labels)+1)
+	for k, v := range labels {
+		if v != "" {
+			attrs = append(attrs, attribute.String(k, v))
+		}
+	}
+	if extra != nil {
+		attrs = append(attrs, *extra)
+	}
+	return attribute.NewSet(attrs...)
+}
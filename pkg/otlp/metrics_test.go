@@ -0,0 +1,105 @@
+package otlp
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ccremer/stiebeleltron-exporter/pkg/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+)
+
+var (
+	testTimestamp = time.Unix(1672531200, 0)
+	testStart     = time.Unix(1672527600, 0)
+)
+
+func TestToResourceMetrics(t *testing.T) {
+	tests := []struct {
+		name     string
+		samples  []metrics.Sample
+		expected metricdata.Metrics
+	}{
+		{
+			name: "GivenGaugeWithLabels_ThenConvertLabelsToAttributes",
+			samples: []metrics.Sample{{
+				Metric: &metrics.PrometheusMetric{Group: "room_temperature", GaugeName: "heating_circuit", HelpText: "Room temperature",
+					Unit: "celsius", Labels: prometheus.Labels{"circuit": "hc1", "empty": ""}},
+				Value: 21.5,
+			}},
+			expected: metricdata.Metrics{
+				Name: "stiebeleltron_room_temperature_heating_circuit", Description: "Room temperature", Unit: "Cel",
+				Data: metricdata.Gauge[float64]{DataPoints: []metricdata.DataPoint[float64]{
+					{Attributes: attribute.NewSet(attribute.String("circuit", "hc1")), Time: testTimestamp, Value: 21.5},
+				}},
+			},
+		},
+		{
+			name: "GivenCounter_ThenConvertToCumulativeSum",
+			samples: []metrics.Sample{{
+				Metric: &metrics.PrometheusMetric{Group: "runtime", GaugeName: "compressor", Type: metrics.MetricTypeCounter, Unit: "seconds"},
+				Value:  7200,
+			}},
+			expected: metricdata.Metrics{
+				Name: "stiebeleltron_runtime_compressor", Unit: "s",
+				Data: metricdata.Sum[float64]{Temporality: metricdata.CumulativeTemporality, IsMonotonic: true,
+					DataPoints: []metricdata.DataPoint[float64]{
+						{Attributes: attribute.NewSet(), StartTime: testStart, Time: testTimestamp, Value: 7200},
+					}},
+			},
+		},
+		{
+			name: "GivenStateSet_ThenAddDataPointPerState",
+			samples: []metrics.Sample{{
+				Metric: &metrics.PrometheusMetric{Group: "status", GaugeName: "operating_mode",
+					States: map[string]string{"ECO MODE": "eco", "COMFORT MODE": "comfort"}},
+				State: "eco",
+			}},
+			expected: metricdata.Metrics{
+				Name: "stiebeleltron_status_operating_mode",
+				Data: metricdata.Gauge[float64]{DataPoints: []metricdata.DataPoint[float64]{
+					{Attributes: attribute.NewSet(attribute.String("state", "comfort")), Time: testTimestamp, Value: 0},
+					{Attributes: attribute.NewSet(attribute.String("state", "eco")), Time: testTimestamp, Value: 1},
+				}},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res := NewResource("http://isg", nil)
+			result := toResourceMetrics(&metrics.Snapshot{Timestamp: testTimestamp, Samples: tt.samples}, res, testStart)
+
+			assert.Equal(t, res, result.Resource)
+			require.Len(t, result.ScopeMetrics, 1)
+			assert.Equal(t, ScopeName, result.ScopeMetrics[0].Scope.Name)
+			assert.Equal(t, []metricdata.Metrics{tt.expected}, result.ScopeMetrics[0].Metrics)
+		})
+	}
+}
+
+func TestToResourceMetrics_GivenSameMetricWithDifferentLabels_ThenMergeDataPoints(t *testing.T) {
+	samples := []metrics.Sample{
+		{Metric: &metrics.PrometheusMetric{Group: "room_temperature", GaugeName: "heating_circuit",
+			Labels: prometheus.Labels{"circuit": "hc1"}}, Value: 21.5},
+		{Metric: &metrics.PrometheusMetric{Group: "room_temperature", GaugeName: "heating_circuit",
+			Labels: prometheus.Labels{"circuit": "hc2"}}, Value: 20},
+	}
+
+	result := toResourceMetrics(&metrics.Snapshot{Timestamp: testTimestamp, Samples: samples}, NewResource("http://isg", nil), testStart)
+
+	require.Len(t, result.ScopeMetrics[0].Metrics, 1)
+	gauge := result.ScopeMetrics[0].Metrics[0].Data.(metricdata.Gauge[float64])
+	assert.Len(t, gauge.DataPoints, 2)
+}
+
+func TestNewResource_GivenAttributes_ThenAddToResource(t *testing.T) {
+	res := NewResource("http://isg", map[string]string{"isg.firmware": "12.0.0"})
+
+	url, _ := res.Set().Value("isg.url")
+	firmware, _ := res.Set().Value("isg.firmware")
+	assert.Equal(t, "http://isg", url.AsString())
+	assert.Equal(t, "12.0.0", firmware.AsString())
+}
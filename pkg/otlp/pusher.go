@@ -0,0 +1,128 @@
+package otlp
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/ccremer/stiebeleltron-exporter/pkg/metrics"
+	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetricgrpc"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetrichttp"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/resource"
+)
+
+type (
+	// Options configures a Pusher.
+	Options struct {
+		// Endpoint is the URL of the OTLP receiver, e.g. "http://localhost:4318/v1/metrics" for OTLP/HTTP or
+		// "http://localhost:4317" for OTLP/gRPC. The scheme "http" disables TLS.
+		Endpoint string
+		// GRPC sends the metrics via OTLP/gRPC instead of protobuf via OTLP/HTTP.
+		GRPC bool
+		// Headers are sent with each request, e.g. for authentication.
+		Headers map[string]string
+		// Resource describes the ISG, see NewResource.
+		Resource *resource.Resource
+		// Timeout is the timeout of each export, including retries.
+		Timeout time.Duration
+	}
+	// Pusher implements metrics.SnapshotHandler.
+	// It exports the values of each Snapshot to an OTLP receiver, e.g. an OpenTelemetry Collector, in the background.
+	// If an export is still running when the next Snapshot arrives, only the latest Snapshot is exported afterwards.
+	Pusher struct {
+		exporter sdkmetric.Exporter
+		resource *resource.Resource
+		timeout  time.Duration
+		start    time.Time
+		notify   chan struct{}
+
+		mu      sync.Mutex
+		pending *metrics.Snapshot
+	}
+)
+
+// NewPusher returns a new Pusher with an exporter for the configured protocol.
+// No connection is made yet.
+func NewPusher(ctx context.Context, options Options) (*Pusher, error) {
+	exporter, err := newExporter(ctx, options)
+	if err != nil {
+		return nil, err
+	}
+	return newPusher(exporter, options), nil
+}
+
+func newPusher(exporter sdkmetric.Exporter, options Options) *Pusher {
+	return &Pusher{
+		exporter: exporter,
+		resource: options.Resource,
+		timeout:  options.Timeout,
+		start:    time.Now(),
+		notify:   make(chan struct{}, 1),
+	}
+}
+
+func newExporter(ctx context.Context, options Options) (sdkmetric.Exporter, error) {
+	if options.GRPC {
+		return otlpmetricgrpc.New(ctx,
+			otlpmetricgrpc.WithEndpointURL(options.Endpoint),
+			otlpmetricgrpc.WithHeaders(options.Headers),
+			otlpmetricgrpc.WithTimeout(options.Timeout),
+		)
+	}
+	return otlpmetrichttp.New(ctx,
+		otlpmetrichttp.WithEndpointURL(options.Endpoint),
+		otlpmetrichttp.WithHeaders(options.Headers),
+		otlpmetrichttp.WithTimeout(options.Timeout),
+	)
+}
+
+// HandleSnapshot implements metrics.SnapshotHandler.
+// The values are exported by the goroutine started with Start.
+func (p *Pusher) HandleSnapshot(snapshot *metrics.Snapshot) {
+	p.mu.Lock()
+	p.pending = snapshot
+	p.mu.Unlock()
+	select {
+	case p.notify <- struct{}{}:
+	default:
+		// An export is already pending.
+	}
+}
+
+// Start exports the latest Snapshot after each poll until the context is cancelled.
+// Then the exporter is shut down.
+func (p *Pusher) Start(ctx context.Context) {
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				if err := p.exporter.Shutdown(context.Background()); err != nil {
+					log.WithError(err).Warn("Could not shut down OTLP exporter")
+				}
+				return
+			case <-p.notify:
+			}
+			if err := p.Export(ctx); err != nil {
+				log.WithError(err).Warn("Could not export values via OTLP")
+			}
+		}
+	}()
+}
+
+// Export sends the values of the latest Snapshot, if there is any that wasn't exported yet.
+// The exporter retries temporary errors until the timeout is reached, then the values are dropped.
+func (p *Pusher) Export(ctx context.Context) error {
+	p.mu.Lock()
+	snapshot := p.pending
+	p.pending = nil
+	p.mu.Unlock()
+	if snapshot == nil {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, p.timeout)
+	defer cancel()
+	return p.exporter.Export(ctx, toResourceMetrics(snapshot, p.resource, p.start))
+}
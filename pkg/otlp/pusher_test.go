@@ -0,0 +1,71 @@
+package otlp
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/ccremer/stiebeleltron-exporter/pkg/metrics"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	collectorpb "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
+	"google.golang.org/protobuf/proto"
+)
+
+func newTestSnapshot(value float64) *metrics.Snapshot {
+	return &metrics.Snapshot{Timestamp: testTimestamp, Samples: []metrics.Sample{
+		{Metric: &metrics.PrometheusMetric{Group: "runtime", GaugeName: "compressor"}, Value: value},
+	}}
+}
+
+func TestPusher_Export_GivenHTTPProtocol_ThenSendToReceiver(t *testing.T) {
+	var received []*collectorpb.ExportMetricsServiceRequest
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/v1/metrics", r.URL.Path)
+		assert.Equal(t, "secret", r.Header.Get("X-Api-Key"))
+		body, err := io.ReadAll(r.Body)
+		require.NoError(t, err)
+		request := &collectorpb.ExportMetricsServiceRequest{}
+		require.NoError(t, proto.Unmarshal(body, request))
+		received = append(received, request)
+		w.Header().Set("Content-Type", "application/x-protobuf")
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer receiver.Close()
+	pusher, err := NewPusher(context.Background(), Options{
+		Endpoint: receiver.URL + "/v1/metrics",
+		Headers:  map[string]string{"X-Api-Key": "secret"},
+		Resource: NewResource("http://isg", map[string]string{"isg.firmware": "12.0.0"}),
+		Timeout:  time.Second,
+	})
+	require.NoError(t, err)
+
+	pusher.HandleSnapshot(newTestSnapshot(1))
+	pusher.HandleSnapshot(newTestSnapshot(2))
+	require.NoError(t, pusher.Export(context.Background()))
+	require.NoError(t, pusher.Export(context.Background()))
+
+	require.Len(t, received, 1, "only the latest snapshot is exported")
+	resourceMetrics := received[0].ResourceMetrics
+	require.Len(t, resourceMetrics, 1)
+	attributes := map[string]string{}
+	for _, attr := range resourceMetrics[0].Resource.Attributes {
+		attributes[attr.Key] = attr.Value.GetStringValue()
+	}
+	assert.Equal(t, "http://isg", attributes["isg.url"])
+	assert.Equal(t, "12.0.0", attributes["isg.firmware"])
+	m := resourceMetrics[0].ScopeMetrics[0].Metrics[0]
+	assert.Equal(t, "stiebeleltron_runtime_compressor", m.Name)
+	assert.Equal(t, 2.0, m.GetGauge().DataPoints[0].GetAsDouble())
+	assert.EqualValues(t, testTimestamp.UnixNano(), m.GetGauge().DataPoints[0].TimeUnixNano)
+}
+
+func TestNewPusher_GivenGRPCProtocol_ThenCreateExporter(t *testing.T) {
+	pusher, err := NewPusher(context.Background(), Options{Endpoint: "http://localhost:4317", GRPC: true, Timeout: time.Second})
+
+	require.NoError(t, err)
+	assert.NoError(t, pusher.exporter.Shutdown(context.Background()))
+}
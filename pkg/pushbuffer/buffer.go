@@ -0,0 +1,191 @@
+package pushbuffer
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+type (
+	// Options configures a Buffer.
+	Options struct {
+		// Target names the receiver in log messages, e.g. "InfluxDB".
+		Target string
+		// BatchSize is the maximum number of items per send.
+		BatchSize int
+		// BufferSize is the maximum number of items that are kept until they are sent.
+		// If the target isn't reachable for long enough, the oldest items are dropped.
+		BufferSize int
+		// MaxBackoff is the maximum time to wait between retries.
+		MaxBackoff time.Duration
+	}
+	// SendFunc sends a batch of items.
+	// Errors are retried, unless they are wrapped with Permanent.
+	SendFunc[T any] func(ctx context.Context, items []T) error
+	// Buffer keeps items until they are sent in batches, the oldest first.
+	// Batches that fail with a temporary error are kept and retried with exponential backoff.
+	Buffer[T any] struct {
+		options Options
+		send    SendFunc[T]
+		notify  chan struct{}
+
+		mu      sync.Mutex
+		items   []T
+		flushMu sync.Mutex
+	}
+	// permanentError is an error that won't go away by sending the same batch again.
+	permanentError struct {
+		err error
+	}
+)
+
+// minBackoff is the time to wait before the first retry.
+const minBackoff = time.Second
+
+// New returns a new, empty Buffer that sends the items with the given function.
+func New[T any](options Options, send SendFunc[T]) *Buffer[T] {
+	return &Buffer[T]{
+		options: options,
+		send:    send,
+		notify:  make(chan struct{}, 1),
+	}
+}
+
+// Permanent marks the error of a SendFunc as permanent, so that the batch is dropped instead of retried.
+func Permanent(err error) error {
+	return &permanentError{err: err}
+}
+
+func (e *permanentError) Error() string {
+	return e.err.Error()
+}
+
+func (e *permanentError) Unwrap() error {
+	return e.err
+}
+
+// Add appends the items to the buffer and drops the oldest items if the buffer is full.
+func (b *Buffer[T]) Add(items ...T) {
+	b.mu.Lock()
+	b.items = append(b.items, items...)
+	b.trim()
+	b.mu.Unlock()
+	select {
+	case b.notify <- struct{}{}:
+	default:
+		// A flush is already pending.
+	}
+}
+
+// Buffered returns the number of items that weren't sent yet.
+func (b *Buffer[T]) Buffered() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return len(b.items)
+}
+
+// Start flushes the buffer in the background until the context is cancelled.
+// With an interval, the buffer is flushed in the interval, otherwise after each Add.
+// After a temporary error, the buffer is flushed again with exponential backoff instead, at most every interval.
+func (b *Buffer[T]) Start(ctx context.Context, interval time.Duration) {
+	maxBackoff := b.options.MaxBackoff
+	if interval > 0 && (maxBackoff <= 0 || maxBackoff > interval) {
+		maxBackoff = interval
+	}
+	go func() {
+		var ticks <-chan time.Time
+		if interval > 0 {
+			ticker := time.NewTicker(interval)
+			defer ticker.Stop()
+			ticks = ticker.C
+		}
+		backoff := time.Duration(0)
+		for {
+			wait, tick := b.notify, ticks
+			var retry <-chan time.Time
+			if interval > 0 {
+				wait = nil
+			}
+			if backoff > 0 {
+				wait, tick = nil, nil
+				retry = time.After(backoff)
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-wait:
+			case <-tick:
+			case <-retry:
+			}
+			if err := b.Flush(ctx); err != nil {
+				backoff = nextBackoff(backoff, maxBackoff)
+				log.WithError(err).WithFields(log.Fields{
+					"buffered": b.Buffered(),
+					"retryIn":  backoff.Seconds(),
+				}).Warnf("Could not send values to %s, retrying", b.options.Target)
+				continue
+			}
+			backoff = 0
+		}
+	}()
+}
+
+func nextBackoff(backoff, maxBackoff time.Duration) time.Duration {
+	backoff *= 2
+	if backoff < minBackoff {
+		backoff = minBackoff
+	}
+	if maxBackoff > 0 && backoff > maxBackoff {
+		backoff = maxBackoff
+	}
+	return backoff
+}
+
+// Flush sends the buffered items in batches, the oldest first.
+// If a batch fails with a temporary error, it and all following batches stay in the buffer and the error is returned.
+// A batch that fails with a permanent error is dropped.
+func (b *Buffer[T]) Flush(ctx context.Context) error {
+	b.flushMu.Lock()
+	defer b.flushMu.Unlock()
+
+	b.mu.Lock()
+	items := b.items
+	b.items = nil
+	b.mu.Unlock()
+
+	for len(items) > 0 {
+		size := b.options.BatchSize
+		if size <= 0 || size > len(items) {
+			size = len(items)
+		}
+		err := b.send(ctx, items[:size])
+		var permanent *permanentError
+		if err != nil && !errors.As(err, &permanent) {
+			b.mu.Lock()
+			// Items that were added in the meantime are newer than the unsent ones.
+			b.items = append(items, b.items...)
+			b.trim()
+			b.mu.Unlock()
+			return err
+		}
+		if err != nil {
+			log.WithError(permanent.err).WithField("batch", size).Errorf("%s rejected values, dropping them", b.options.Target)
+		}
+		items = items[size:]
+	}
+	return nil
+}
+
+// trim drops the oldest items if the buffer is full.
+// The caller has to hold the lock.
+func (b *Buffer[T]) trim() {
+	if b.options.BufferSize <= 0 || len(b.items) <= b.options.BufferSize {
+		return
+	}
+	dropped := len(b.items) - b.options.BufferSize
+	b.items = b.items[dropped:]
+	log.WithField("dropped", dropped).Warnf("%s buffer is full, dropping the oldest values", b.options.Target)
+}
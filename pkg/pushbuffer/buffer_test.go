@@ -0,0 +1,166 @@
+package pushbuffer
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// receiver records the sent batches and fails with the given errors in order, then succeeds.
+type receiver struct {
+	mu      sync.Mutex
+	errs    []error
+	batches [][]int
+}
+
+func (rc *receiver) send(_ context.Context, items []int) error {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	if len(rc.errs) > 0 {
+		err := rc.errs[0]
+		rc.errs = rc.errs[1:]
+		if err != nil {
+			return err
+		}
+	}
+	rc.batches = append(rc.batches, append([]int(nil), items...))
+	return nil
+}
+
+func (rc *receiver) Sent() [][]int {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	return rc.batches
+}
+
+var errUnavailable = errors.New("unavailable")
+
+func TestBuffer_Flush(t *testing.T) {
+	tests := []struct {
+		name             string
+		items            []int
+		batchSize        int
+		bufferSize       int
+		errs             []error
+		expectedErr      bool
+		expectedSent     [][]int
+		expectedBuffered int
+	}{
+		{
+			name:         "GivenItemsMoreThanBatchSize_ThenSendInBatches",
+			items:        []int{1, 2, 3},
+			batchSize:    2,
+			expectedSent: [][]int{{1, 2}, {3}},
+		},
+		{
+			name:             "GivenTemporaryError_ThenKeepItemsForRetry",
+			items:            []int{1, 2, 3},
+			batchSize:        2,
+			errs:             []error{errUnavailable},
+			expectedErr:      true,
+			expectedBuffered: 3,
+		},
+		{
+			name:             "GivenTemporaryErrorInSecondBatch_ThenKeepOnlyUnsentItems",
+			items:            []int{1, 2, 3},
+			batchSize:        2,
+			errs:             []error{nil, errUnavailable},
+			expectedErr:      true,
+			expectedSent:     [][]int{{1, 2}},
+			expectedBuffered: 1,
+		},
+		{
+			name:         "GivenPermanentError_ThenDropBatch",
+			items:        []int{1, 2, 3},
+			batchSize:    2,
+			errs:         []error{Permanent(errors.New("invalid"))},
+			expectedSent: [][]int{{3}},
+		},
+		{
+			name:         "GivenMoreItemsThanBufferSize_ThenDropOldestItems",
+			items:        []int{1, 2, 3},
+			bufferSize:   2,
+			expectedSent: [][]int{{2, 3}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rc := &receiver{errs: tt.errs}
+			buffer := New(Options{Target: "test", BatchSize: tt.batchSize, BufferSize: tt.bufferSize}, rc.send)
+
+			buffer.Add(tt.items...)
+			err := buffer.Flush(context.Background())
+
+			if tt.expectedErr {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+			assert.Equal(t, tt.expectedSent, rc.Sent())
+			assert.Equal(t, tt.expectedBuffered, buffer.Buffered())
+		})
+	}
+}
+
+func TestBuffer_Flush_GivenTemporaryError_WhenRetried_ThenSendOldestItemsFirst(t *testing.T) {
+	rc := &receiver{errs: []error{errUnavailable}}
+	buffer := New(Options{Target: "test"}, rc.send)
+
+	buffer.Add(1)
+	require.Error(t, buffer.Flush(context.Background()))
+	buffer.Add(2)
+	require.NoError(t, buffer.Flush(context.Background()))
+
+	assert.Equal(t, [][]int{{1, 2}}, rc.Sent())
+	assert.Equal(t, 0, buffer.Buffered())
+}
+
+func TestBuffer_Start(t *testing.T) {
+	tests := []struct {
+		name     string
+		interval time.Duration
+	}{
+		{name: "GivenNoInterval_WhenTemporaryError_ThenRetryWithBackoff"},
+		{name: "GivenInterval_WhenTemporaryError_ThenRetryWithBackoff", interval: 20 * time.Millisecond},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rc := &receiver{errs: []error{errUnavailable}}
+			buffer := New(Options{Target: "test", MaxBackoff: 10 * time.Millisecond}, rc.send)
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			buffer.Start(ctx, tt.interval)
+			buffer.Add(1)
+
+			assert.Eventually(t, func() bool {
+				return len(rc.Sent()) == 1
+			}, 5*time.Second, 10*time.Millisecond)
+			assert.Equal(t, [][]int{{1}}, rc.Sent())
+			assert.Equal(t, 0, buffer.Buffered())
+		})
+	}
+}
+
+func TestNextBackoff(t *testing.T) {
+	tests := []struct {
+		name       string
+		backoff    time.Duration
+		maxBackoff time.Duration
+		expected   time.Duration
+	}{
+		{name: "GivenNoBackoff_ThenReturnMinBackoff", expected: minBackoff},
+		{name: "GivenBackoff_ThenDouble", backoff: 2 * time.Second, expected: 4 * time.Second},
+		{name: "GivenMaxBackoff_ThenLimit", backoff: 4 * time.Second, maxBackoff: 5 * time.Second, expected: 5 * time.Second},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, nextBackoff(tt.backoff, tt.maxBackoff))
+		})
+	}
+}
@@ -0,0 +1,144 @@
+package remotewrite
+
+import (
+	"math"
+	"sort"
+	"strings"
+
+	"github.com/ccremer/stiebeleltron-exporter/pkg/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+type (
+	// sample is a value of a series at a point in time, as sent in a remote write request.
+	sample struct {
+		// labels are sorted by name and include the metric name.
+		labels    []label
+		value     float64
+		timestamp int64
+	}
+	label struct {
+		name  string
+		value string
+	}
+)
+
+// metricNameLabel is the label that holds the name of a series.
+const metricNameLabel = "__name__"
+
+// Field numbers of the messages of the remote write protocol, see prompb/remote.proto and prompb/types.proto.
+const (
+	writeRequestTimeseries = 1
+	timeSeriesLabels       = 1
+	timeSeriesSamples      = 2
+	labelName              = 1
+	labelValue             = 2
+	sampleValue            = 1
+	sampleTimestamp        = 2
+)
+
+// toSamples returns the samples of the snapshot with the given external labels.
+// Metrics exported as state set get one sample per state, like in the Prometheus exposition.
+func toSamples(snapshot *metrics.Snapshot, externalLabels prometheus.Labels) []sample {
+	var samples []sample
+	for _, s := range snapshot.Samples {
+		name := s.Metric.FQName()
+		timestamp := snapshot.SampleTimestamp(s).UnixMilli()
+		if !s.Metric.IsStateSet() {
+			samples = append(samples, sample{labels: seriesLabels(name, s.Metric.Labels, externalLabels, nil), value: s.Value, timestamp: timestamp})
+			continue
+		}
+		for _, state := range s.Metric.StateNames() {
+			value := 0.0
+			if state == s.State {
+				value = 1
+			}
+			stateLabel := &label{name: metrics.StateLabel, value: state}
+			samples = append(samples, sample{labels: seriesLabels(name, s.Metric.Labels, externalLabels, stateLabel), value: value, timestamp: timestamp})
+		}
+	}
+	return samples
+}
+
+// seriesLabels returns the sorted labels of a series.
+// Labels of the metric take precedence over external labels.
+func seriesLabels(name string, metricLabels, externalLabels prometheus.Labels, extra *label) []label {
+	merged := map[string]string{}
+	for k, v := range externalLabels {
+		merged[k] = v
+	}
+	for k, v := range metricLabels {
+		merged[k] = v
+	}
+	if extra != nil {
+		merged[extra.name] = extra.value
+	}
+	merged[metricNameLabel] = name
+	labels := make([]label, 0, len(merged))
+	for k, v := range merged {
+		if v != "" {
+			labels = append(labels, label{name: k, value: v})
+		}
+	}
+	sort.Slice(labels, func(i, j int) bool {
+		return labels[i].name < labels[j].name
+	})
+	return labels
+}
+
+// seriesKey identifies the series of the sample.
+func (s sample) seriesKey() string {
+	var b strings.Builder
+	for _, l := range s.labels {
+		b.WriteString(l.name)
+		b.WriteString("\xff")
+		b.WriteString(l.value)
+		b.WriteString("\xff")
+	}
+	return b.String()
+}
+
+// marshalWriteRequest encodes the samples as WriteRequest protobuf message.
+// Samples of the same series are sent in the same TimeSeries, in the given order.
+func marshalWriteRequest(samples []sample) []byte {
+	var order []string
+	series := map[string][]sample{}
+	for _, s := range samples {
+		key := s.seriesKey()
+		if _, exists := series[key]; !exists {
+			order = append(order, key)
+		}
+		series[key] = append(series[key], s)
+	}
+
+	var b []byte
+	for _, key := range order {
+		b = protowire.AppendTag(b, writeRequestTimeseries, protowire.BytesType)
+		b = protowire.AppendBytes(b, marshalTimeSeries(series[key]))
+	}
+	return b
+}
+
+func marshalTimeSeries(samples []sample) []byte {
+	var b []byte
+	for _, l := range samples[0].labels {
+		var lb []byte
+		lb = protowire.AppendTag(lb, labelName, protowire.BytesType)
+		lb = protowire.AppendString(lb, l.name)
+		lb = protowire.AppendTag(lb, labelValue, protowire.BytesType)
+		lb = protowire.AppendString(lb, l.value)
+		b = protowire.AppendTag(b, timeSeriesLabels, protowire.BytesType)
+		b = protowire.AppendBytes(b, lb)
+	}
+	for _, s := range samples {
+		var sb []byte
+		sb = protowire.AppendTag(sb, sampleValue, protowire.Fixed64Type)
+		sb = protowire.AppendFixed64(sb, math.Float64bits(s.value))
+		sb = protowire.AppendTag(sb, sampleTimestamp, protowire.VarintType)
+		sb = protowire.AppendVarint(sb, uint64(s.timestamp))
+		b = protowire.AppendTag(b, timeSeriesSamples, protowire.BytesType)
+		b = protowire.AppendBytes(b, sb)
+	}
+	return b
+}
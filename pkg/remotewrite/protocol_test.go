@@ -0,0 +1,176 @@
+package remotewrite
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/ccremer/stiebeleltron-exporter/pkg/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+var testTimestamp = time.Unix(1672531200, 0)
+
+type (
+	// decodedSeries is a TimeSeries message as received by a remote write endpoint.
+	decodedSeries struct {
+		Labels  map[string]string
+		Samples []decodedSample
+	}
+	decodedSample struct {
+		Value     float64
+		Timestamp int64
+	}
+)
+
+// decodeWriteRequest decodes a WriteRequest message without the generated protobuf types.
+func decodeWriteRequest(t *testing.T, b []byte) []decodedSeries {
+	var series []decodedSeries
+	forEachField(t, b, func(num protowire.Number, value []byte) {
+		require.EqualValues(t, writeRequestTimeseries, num)
+		s := decodedSeries{Labels: map[string]string{}}
+		forEachField(t, value, func(num protowire.Number, value []byte) {
+			switch num {
+			case timeSeriesLabels:
+				var name, labelVal string
+				forEachField(t, value, func(num protowire.Number, value []byte) {
+					if num == labelName {
+						name = string(value)
+					} else {
+						labelVal = string(value)
+					}
+				})
+				s.Labels[name] = labelVal
+			case timeSeriesSamples:
+				var sm decodedSample
+				rest := value
+				for len(rest) > 0 {
+					num, typ, n := protowire.ConsumeTag(rest)
+					require.GreaterOrEqual(t, n, 0)
+					rest = rest[n:]
+					if num == sampleValue {
+						require.Equal(t, protowire.Fixed64Type, typ)
+						v, n := protowire.ConsumeFixed64(rest)
+						sm.Value = math.Float64frombits(v)
+						rest = rest[n:]
+						continue
+					}
+					require.Equal(t, protowire.VarintType, typ)
+					v, n := protowire.ConsumeVarint(rest)
+					sm.Timestamp = int64(v)
+					rest = rest[n:]
+				}
+				s.Samples = append(s.Samples, sm)
+			}
+		})
+		series = append(series, s)
+	})
+	return series
+}
+
+// forEachField calls fn for each length-delimited field of the message.
+func forEachField(t *testing.T, b []byte, fn func(num protowire.Number, value []byte)) {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		require.GreaterOrEqual(t, n, 0)
+		require.Equal(t, protowire.BytesType, typ)
+		b = b[n:]
+		value, n := protowire.ConsumeBytes(b)
+		require.GreaterOrEqual(t, n, 0)
+		b = b[n:]
+		fn(num, value)
+	}
+}
+
+func TestMarshalWriteRequest(t *testing.T) {
+	tests := []struct {
+		name           string
+		samples        []metrics.Sample
+		externalLabels prometheus.Labels
+		expected       []decodedSeries
+	}{
+		{
+			name: "GivenMetricWithLabels_ThenAddNameAndExternalLabels",
+			samples: []metrics.Sample{{
+				Metric: &metrics.PrometheusMetric{Group: "room_temperature", GaugeName: "heating_circuit",
+					Labels: prometheus.Labels{"circuit": "hc1"}},
+				Value: 21.5,
+			}},
+			externalLabels: prometheus.Labels{"instance": "isg-1"},
+			expected: []decodedSeries{{
+				Labels: map[string]string{
+					"__name__": "stiebeleltron_room_temperature_heating_circuit", "circuit": "hc1", "instance": "isg-1",
+				},
+				Samples: []decodedSample{{Value: 21.5, Timestamp: 1672531200000}},
+			}},
+		},
+		{
+			name: "GivenExternalLabelAlsoInMetric_ThenPreferMetricLabel",
+			samples: []metrics.Sample{{
+				Metric: &metrics.PrometheusMetric{Group: "runtime", GaugeName: "compressor",
+					Labels: prometheus.Labels{"instance": "metric", "empty": ""}},
+				Value: 1,
+			}},
+			externalLabels: prometheus.Labels{"instance": "external"},
+			expected: []decodedSeries{{
+				Labels:  map[string]string{"__name__": "stiebeleltron_runtime_compressor", "instance": "metric"},
+				Samples: []decodedSample{{Value: 1, Timestamp: 1672531200000}},
+			}},
+		},
+		{
+			name: "GivenCounter_ThenSuffixNameWithTotal",
+			samples: []metrics.Sample{{
+				Metric: &metrics.PrometheusMetric{Group: "runtime", GaugeName: "compressor", Type: metrics.MetricTypeCounter},
+				Value:  1771,
+			}},
+			expected: []decodedSeries{{
+				Labels:  map[string]string{"__name__": "stiebeleltron_runtime_compressor_total"},
+				Samples: []decodedSample{{Value: 1771, Timestamp: 1672531200000}},
+			}},
+		},
+		{
+			name: "GivenStateSet_ThenSendSeriesPerState",
+			samples: []metrics.Sample{{
+				Metric: &metrics.PrometheusMetric{Group: "status", GaugeName: "operating_mode",
+					States: map[string]string{"ECO MODE": "eco", "COMFORT MODE": "comfort"}},
+				State: "eco",
+			}},
+			expected: []decodedSeries{
+				{
+					Labels:  map[string]string{"__name__": "stiebeleltron_status_operating_mode", "state": "comfort"},
+					Samples: []decodedSample{{Value: 0, Timestamp: 1672531200000}},
+				},
+				{
+					Labels:  map[string]string{"__name__": "stiebeleltron_status_operating_mode", "state": "eco"},
+					Samples: []decodedSample{{Value: 1, Timestamp: 1672531200000}},
+				},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			samples := toSamples(&metrics.Snapshot{Timestamp: testTimestamp, Samples: tt.samples}, tt.externalLabels)
+			result := decodeWriteRequest(t, marshalWriteRequest(samples))
+			assert.Equal(t, tt.expected, result)
+		})
+	}
+}
+
+func TestMarshalWriteRequest_GivenSameSeriesTwice_ThenSendInOneTimeSeries(t *testing.T) {
+	metric := &metrics.PrometheusMetric{Group: "runtime", GaugeName: "compressor"}
+	samples := append(
+		toSamples(&metrics.Snapshot{Timestamp: testTimestamp, Samples: []metrics.Sample{{Metric: metric, Value: 1}}}, nil),
+		toSamples(&metrics.Snapshot{Timestamp: testTimestamp.Add(time.Minute), Samples: []metrics.Sample{{Metric: metric, Value: 2}}}, nil)...,
+	)
+
+	result := decodeWriteRequest(t, marshalWriteRequest(samples))
+
+	require.Len(t, result, 1)
+	assert.Equal(t, []decodedSample{
+		{Value: 1, Timestamp: 1672531200000},
+		{Value: 2, Timestamp: 1672531260000},
+	}, result[0].Samples)
+}
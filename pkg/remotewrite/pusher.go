@@ -0,0 +1,134 @@
+package remotewrite
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/ccremer/stiebeleltron-exporter/pkg/metrics"
+	"github.com/ccremer/stiebeleltron-exporter/pkg/pushbuffer"
+	"github.com/golang/snappy"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+type (
+	// Options configures a Pusher.
+	Options struct {
+		// URL is the remote write endpoint, e.g. "https://prometheus.example.com/api/v1/write".
+		URL string
+		// Username and Password are sent with basic authentication, if set.
+		Username string
+		Password string
+		// BearerToken is sent in the Authorization header, if set.
+		BearerToken string
+		// Labels are added to all series, e.g. to tell several ISGs apart.
+		Labels prometheus.Labels
+		// BatchSize is the maximum number of samples per request.
+		BatchSize int
+		// BufferSize is the maximum number of samples that are kept until they are sent.
+		// If the endpoint isn't reachable for long enough, the oldest samples are dropped.
+		BufferSize int
+		// MaxBackoff is the maximum time to wait between retries.
+		MaxBackoff time.Duration
+		// Timeout is the timeout of each request.
+		Timeout time.Duration
+	}
+	// Pusher implements metrics.SnapshotHandler.
+	// It buffers the samples of each Snapshot and sends them to a Prometheus remote write endpoint in the background.
+	// Samples that can't be sent because of a temporary error are retried with exponential backoff.
+	Pusher struct {
+		options Options
+		client  http.Client
+		buffer  *pushbuffer.Buffer[sample]
+	}
+	// pushError is an error response of the remote write endpoint.
+	pushError struct {
+		status int
+		body   string
+	}
+)
+
+// NewPusher returns a new Pusher with an empty buffer.
+func NewPusher(options Options) *Pusher {
+	p := &Pusher{
+		options: options,
+		client:  http.Client{Timeout: options.Timeout},
+	}
+	p.buffer = pushbuffer.New(pushbuffer.Options{
+		Target:     "remote write endpoint",
+		BatchSize:  options.BatchSize,
+		BufferSize: options.BufferSize,
+		MaxBackoff: options.MaxBackoff,
+	}, p.send)
+	return p
+}
+
+// HandleSnapshot implements metrics.SnapshotHandler.
+// The samples are sent by the goroutine started with Start.
+func (p *Pusher) HandleSnapshot(snapshot *metrics.Snapshot) {
+	p.buffer.Add(toSamples(snapshot, p.options.Labels)...)
+}
+
+// Start sends the buffered samples after each Snapshot until the context is cancelled.
+// After a temporary error, the samples are retried with exponential backoff instead.
+func (p *Pusher) Start(ctx context.Context) {
+	p.buffer.Start(ctx, 0)
+}
+
+// Buffered returns the number of samples that weren't sent yet.
+func (p *Pusher) Buffered() int {
+	return p.buffer.Buffered()
+}
+
+// Flush sends the buffered samples in batches, the oldest first.
+// If a batch fails with a temporary error, e.g. a network error or a server error, it and all following batches stay
+// in the buffer and the error is returned.
+// A batch that the endpoint rejects permanently, e.g. because of out-of-order samples, is dropped.
+func (p *Pusher) Flush(ctx context.Context) error {
+	return p.buffer.Flush(ctx)
+}
+
+func (p *Pusher) send(ctx context.Context, samples []sample) error {
+	body := snappy.Encode(nil, marshalWriteRequest(samples))
+	req, err := http.NewRequestWithContext(ctx, "POST", p.options.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Encoding", "snappy")
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+	if p.options.Username != "" || p.options.Password != "" {
+		req.SetBasicAuth(p.options.Username, p.options.Password)
+	}
+	if p.options.BearerToken != "" {
+		req.Header.Set("Authorization", "Bearer "+p.options.BearerToken)
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return nil
+	}
+	b, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	err = &pushError{status: resp.StatusCode, body: strings.TrimSpace(string(b))}
+	if !isRecoverable(resp.StatusCode) {
+		return pushbuffer.Permanent(err)
+	}
+	return err
+}
+
+func (e *pushError) Error() string {
+	return fmt.Sprintf("remote write endpoint responded with status %d: %s", e.status, e.body)
+}
+
+// isRecoverable returns true if sending the samples again may succeed.
+// Like in Prometheus, only client errors other than rate limiting are permanent.
+func isRecoverable(status int) bool {
+	return status == http.StatusTooManyRequests || status >= 500
+}
@@ -0,0 +1,161 @@
+package remotewrite
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ccremer/stiebeleltron-exporter/pkg/metrics"
+	"github.com/golang/snappy"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// receiver is a fake remote write endpoint that responds with the given status codes in order, then with 204.
+type receiver struct {
+	t        *testing.T
+	mu       sync.Mutex
+	statuses []int
+	// written holds the values of each successful request.
+	written [][]float64
+}
+
+func (rc *receiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	assert.Equal(rc.t, "snappy", r.Header.Get("Content-Encoding"))
+	assert.Equal(rc.t, "application/x-protobuf", r.Header.Get("Content-Type"))
+	assert.Equal(rc.t, "0.1.0", r.Header.Get("X-Prometheus-Remote-Write-Version"))
+	assert.Equal(rc.t, "Bearer secret", r.Header.Get("Authorization"))
+	body, err := io.ReadAll(r.Body)
+	require.NoError(rc.t, err)
+	decoded, err := snappy.Decode(nil, body)
+	require.NoError(rc.t, err)
+
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	if len(rc.statuses) > 0 {
+		status := rc.statuses[0]
+		rc.statuses = rc.statuses[1:]
+		w.WriteHeader(status)
+		return
+	}
+	var values []float64
+	for _, s := range decodeWriteRequest(rc.t, decoded) {
+		for _, sm := range s.Samples {
+			values = append(values, sm.Value)
+		}
+	}
+	rc.written = append(rc.written, values)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (rc *receiver) Written() [][]float64 {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	return rc.written
+}
+
+// newTestSnapshot returns a snapshot with a sample of a different series per value.
+func newTestSnapshot(values ...float64) *metrics.Snapshot {
+	snapshot := &metrics.Snapshot{Timestamp: testTimestamp}
+	names := []string{"compressor", "reheating", "defrost", "pump"}
+	for i, v := range values {
+		snapshot.Samples = append(snapshot.Samples, metrics.Sample{
+			Metric: &metrics.PrometheusMetric{Group: "runtime", GaugeName: names[i%len(names)]}, Value: v,
+		})
+	}
+	return snapshot
+}
+
+func TestPusher_Flush(t *testing.T) {
+	tests := []struct {
+		name             string
+		values           []float64
+		batchSize        int
+		statuses         []int
+		expectedErr      bool
+		expectedWritten  [][]float64
+		expectedBuffered int
+	}{
+		{
+			name:            "GivenSamplesMoreThanBatchSize_ThenWriteInBatches",
+			values:          []float64{1, 2, 3},
+			batchSize:       2,
+			expectedWritten: [][]float64{{1, 2}, {3}},
+		},
+		{
+			name:             "GivenTooManyRequests_ThenKeepSamplesForRetry",
+			values:           []float64{1, 2, 3},
+			batchSize:        2,
+			statuses:         []int{http.StatusTooManyRequests},
+			expectedErr:      true,
+			expectedBuffered: 3,
+		},
+		{
+			name:            "GivenClientError_ThenDropBatch",
+			values:          []float64{1, 2, 3},
+			batchSize:       2,
+			statuses:        []int{http.StatusBadRequest},
+			expectedWritten: [][]float64{{3}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rc := &receiver{t: t, statuses: tt.statuses}
+			server := httptest.NewServer(rc)
+			defer server.Close()
+			pusher := NewPusher(Options{
+				URL: server.URL, BearerToken: "secret",
+				BatchSize: tt.batchSize, Timeout: time.Second,
+			})
+
+			pusher.HandleSnapshot(newTestSnapshot(tt.values...))
+			err := pusher.Flush(context.Background())
+
+			if tt.expectedErr {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+			assert.Equal(t, tt.expectedWritten, rc.Written())
+			assert.Equal(t, tt.expectedBuffered, pusher.Buffered())
+		})
+	}
+}
+
+func TestPusher_Start_GivenServerError_ThenRetryWithBackoff(t *testing.T) {
+	rc := &receiver{t: t, statuses: []int{http.StatusInternalServerError}}
+	server := httptest.NewServer(rc)
+	defer server.Close()
+	pusher := NewPusher(Options{URL: server.URL, BearerToken: "secret", MaxBackoff: 10 * time.Millisecond, Timeout: time.Second})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	pusher.Start(ctx)
+	pusher.HandleSnapshot(newTestSnapshot(1))
+
+	assert.Eventually(t, func() bool {
+		return len(rc.Written()) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, [][]float64{{1}}, rc.Written())
+	assert.Equal(t, 0, pusher.Buffered())
+}
+
+func TestPusher_Send_GivenBasicAuth_ThenSetAuthorizationHeader(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, password, ok := r.BasicAuth()
+		assert.True(t, ok)
+		assert.Equal(t, "prometheus", user)
+		assert.Equal(t, "password", password)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+	pusher := NewPusher(Options{URL: server.URL, Username: "prometheus", Password: "password", Timeout: time.Second})
+
+	pusher.HandleSnapshot(newTestSnapshot(1))
+
+	assert.NoError(t, pusher.Flush(context.Background()))
+}
@@ -0,0 +1,135 @@
+package state
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+type (
+	// Store keeps values that the exporter derives over time, so that they survive restarts of the exporter.
+	// Values are encoded as JSON.
+	Store interface {
+		// Load decodes the value of the given key into v.
+		// It returns false if there is no value for the key.
+		Load(key string, v interface{}) (bool, error)
+		// Save sets the value of the given key.
+		// The value isn't persisted until Flush is called.
+		Save(key string, v interface{}) error
+		// Flush persists all values that changed since the last Flush.
+		Flush() error
+	}
+	// MemoryStore is a Store that keeps the values in memory only.
+	MemoryStore struct {
+		mu     sync.Mutex
+		values map[string]json.RawMessage
+		dirty  bool
+	}
+	// FileStore is a Store that persists the values in a JSON file.
+	FileStore struct {
+		*MemoryStore
+		path string
+	}
+)
+
+// NewMemoryStore returns a new, empty MemoryStore.
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{values: map[string]json.RawMessage{}}
+}
+
+// OpenFileStore returns a FileStore with the values of the file of the given path.
+// If the file doesn't exist yet, the store is empty.
+// A corrupt file is moved aside with a warning and the store starts empty, so that a broken state never prevents the exporter from starting.
+func OpenFileStore(path string) (*FileStore, error) {
+	store := &FileStore{MemoryStore: NewMemoryStore(), path: path}
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return store, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, &store.values); err != nil {
+		corruptPath := path + ".corrupt"
+		log.WithError(err).WithFields(log.Fields{
+			"path":   path,
+			"backup": corruptPath,
+		}).Warn("State file is corrupt, resetting state")
+		if err := os.Rename(path, corruptPath); err != nil {
+			return nil, err
+		}
+		store.values = map[string]json.RawMessage{}
+	}
+	if store.values == nil {
+		store.values = map[string]json.RawMessage{}
+	}
+	return store, nil
+}
+
+// Load implements Store.
+func (s *MemoryStore) Load(key string, v interface{}) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	raw, exists := s.values[key]
+	if !exists {
+		return false, nil
+	}
+	return true, json.Unmarshal(raw, v)
+}
+
+// Save implements Store.
+func (s *MemoryStore) Save(key string, v interface{}) error {
+	raw, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.values[key] = raw
+	s.dirty = true
+	return nil
+}
+
+// Flush implements Store.
+// There is nothing to persist in memory.
+func (s *MemoryStore) Flush() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.dirty = false
+	return nil
+}
+
+// Flush implements Store.
+// The file is replaced atomically, so that it's never left half-written.
+func (s *FileStore) Flush() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.dirty {
+		return nil
+	}
+	b, err := json.Marshal(s.values)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), s.path); err != nil {
+		return err
+	}
+	s.dirty = false
+	return nil
+}
@@ -0,0 +1,81 @@
+package state
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type testValue struct {
+	Offset float64 `json:"offset"`
+}
+
+func TestOpenFileStore(t *testing.T) {
+	tests := []struct {
+		name           string
+		content        string
+		expectedExists bool
+		expectedValue  testValue
+		expectCorrupt  bool
+	}{
+		{
+			name: "GivenNoFile_ThenReturnEmptyStore",
+		},
+		{
+			name:           "GivenExistingFile_ThenLoadValues",
+			content:        `{"counter":{"offset":12.5}}`,
+			expectedExists: true,
+			expectedValue:  testValue{Offset: 12.5},
+		},
+		{
+			name:          "GivenCorruptFile_ThenResetStore",
+			content:       `{"counter":{"offs`,
+			expectCorrupt: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "state.json")
+			if tt.content != "" {
+				require.NoError(t, os.WriteFile(path, []byte(tt.content), 0o600))
+			}
+			store, err := OpenFileStore(path)
+			require.NoError(t, err)
+
+			value := testValue{}
+			exists, err := store.Load("counter", &value)
+			require.NoError(t, err)
+			assert.Equal(t, tt.expectedExists, exists)
+			assert.Equal(t, tt.expectedValue, value)
+			assert.Equal(t, tt.expectCorrupt, fileExists(path+".corrupt"))
+		})
+	}
+}
+
+func TestFileStore_Flush(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+	store, err := OpenFileStore(path)
+	require.NoError(t, err)
+	require.NoError(t, store.Save("counter", testValue{Offset: 3}))
+	require.NoError(t, store.Flush())
+
+	reopened, err := OpenFileStore(path)
+	require.NoError(t, err)
+	value := testValue{}
+	exists, err := reopened.Load("counter", &value)
+	require.NoError(t, err)
+	assert.True(t, exists)
+	assert.Equal(t, testValue{Offset: 3}, value)
+
+	matches, err := filepath.Glob(path + ".tmp*")
+	require.NoError(t, err)
+	assert.Empty(t, matches, "temporary files should be removed")
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
@@ -0,0 +1,56 @@
+package stiebeleltron
+
+import (
+	"context"
+	"strings"
+	"unicode"
+
+	"github.com/PuerkitoBio/goquery"
+)
+
+type (
+	// Fault is an entry of the fault list of the ISG diagnosis page.
+	Fault struct {
+		// Code is the error number as displayed by the ISG.
+		Code string `json:"code"`
+		// Description is the error text in the language of the ISG web UI.
+		Description string `json:"description"`
+	}
+	// FaultParser fetches the active faults of the ISG.
+	FaultParser interface {
+		ParseFaults(ctx context.Context, page string) ([]Fault, error)
+	}
+)
+
+// FaultRowQueryExpression selects the rows of the fault list.
+// The first cell of a row holds the error number, the second the error text.
+var FaultRowQueryExpression = "form#werte table.info tr"
+
+// ParseFaults fetches the diagnosis page at the given path and returns the faults listed in it.
+// Rows without an error number, e.g. headers or a row saying that there are no faults, are skipped.
+func (c *ISGClient) ParseFaults(ctx context.Context, urlPath string) ([]Fault, error) {
+	doc, err := c.fetchDocument(ctx, urlPath)
+	if err != nil {
+		return nil, err
+	}
+	return findFaults(doc), nil
+}
+
+func findFaults(doc *goquery.Document) []Fault {
+	var faults []Fault
+	doc.Find(FaultRowQueryExpression).Each(func(i int, row *goquery.Selection) {
+		cells := row.Find("td")
+		if cells.Length() < 2 {
+			return
+		}
+		code := strings.TrimSpace(cells.Eq(0).Text())
+		if strings.IndexFunc(code, unicode.IsDigit) < 0 {
+			return
+		}
+		faults = append(faults, Fault{
+			Code:        code,
+			Description: strings.Join(strings.Fields(cells.Eq(1).Text()), " "),
+		})
+	})
+	return faults
+}
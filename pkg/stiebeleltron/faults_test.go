@@ -0,0 +1,44 @@
+package stiebeleltron
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestISGClient_ParseFaults(t *testing.T) {
+	server := httptest.NewServer(http.FileServer(http.Dir("testdata")))
+	defer server.Close()
+	client, err := NewISGClient(ClientOptions{BaseURL: server.URL})
+	require.NoError(t, err)
+
+	tests := []struct {
+		name     string
+		page     string
+		expected []Fault
+	}{
+		{
+			name: "GivenFaults_ThenReturnCodesAndDescriptions",
+			page: "/diagnosis_faults_1.html",
+			expected: []Fault{
+				{Code: "16", Description: "LOW PRESSURE SENSOR"},
+				{Code: "31", Description: "HIGH PRESSURE"},
+			},
+		},
+		{
+			name: "GivenNoFaults_ThenReturnEmptyList",
+			page: "/diagnosis_faults_none.html",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			faults, err := client.ParseFaults(context.Background(), tt.page)
+			require.NoError(t, err)
+			assert.Equal(t, tt.expected, faults)
+		})
+	}
+}
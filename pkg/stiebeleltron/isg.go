@@ -1,11 +1,16 @@
 package stiebeleltron
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"io"
 	"net/http"
-	"regexp"
-	"strconv"
+	"net/http/cookiejar"
+	"net/url"
 	"strings"
+	"sync"
+	"sync/atomic"
 
 	"github.com/PuerkitoBio/goquery"
 )
@@ -14,17 +19,59 @@ type (
 	ISGClient struct {
 		Options ClientOptions
 		client  http.Client
+		loginMu sync.Mutex
+		// logins counts the successful logins, so that concurrent requests that got the login page log in only once.
+		logins atomic.Uint64
 	}
 	ClientOptions struct {
 		BaseURL string
 		Headers http.Header
+		// Username and Password are used to log in if the web UI of the ISG is password-protected.
+		Username string
+		Password string
+		// NumberFormat is the format of the values in the web UI, DefaultNumberFormat if empty.
+		NumberFormat NumberFormat
+	}
+	// PageParser fetches a page and sets the values of the given properties found in the page.
+	PageParser interface {
+		ParsePage(ctx context.Context, page string, properties []Property) ([]ParseError, error)
+	}
+	// PageDiscoverer is a PageParser that can additionally return all properties found in a page.
+	PageDiscoverer interface {
+		DiscoverPage(ctx context.Context, page string, properties []Property) ([]DiscoveredProperty, []ParseError, error)
 	}
 	Property interface {
 		GetGroup() string
 		GetSearchString() string
 		SetValue(v float64)
 	}
+	// UnitProperty is a Property whose value is converted into the given unit, e.g. "joules" for values displayed in kWh.
+	// If the displayed unit can't be converted, the value is reported as ParseError.
+	UnitProperty interface {
+		Property
+		GetUnit() string
+	}
+	// TextProperty is a Property whose value may be displayed as text, e.g. "ECO MODE" or "ON".
+	TextProperty interface {
+		Property
+		// IsText returns true if the value is expected as text instead of a number.
+		IsText() bool
+		// SetText sets the value from the given text.
+		// It returns an error if the text isn't known.
+		SetText(text string) error
+	}
 	properties []Property
+	// DiscoveredProperty is a row of a property table in an ISG page.
+	DiscoveredProperty struct {
+		Group   string
+		Name    string
+		RawText string
+		// Value is the number found in RawText, if Numeric is true.
+		Value   float64
+		Numeric bool
+		// Unit is the unit after the number in RawText, e.g. "kWh".
+		Unit string
+	}
 	ParseError struct {
 		Property Property
 		RawText  string
@@ -32,9 +79,25 @@ type (
 	}
 )
 
+const (
+	// PageTypeHTML is a page of the ISG web UI that is parsed by ISGClient.
+	PageTypeHTML = "html"
+	// PageTypeModbus is a set of registers that is read by ModbusClient.
+	PageTypeModbus = "modbus"
+	// PageTypeStatus is the status page of the ISG web UI that is parsed by StatusParser.
+	PageTypeStatus = "status"
+)
+
 var (
 	PropertyTableQueryExpression = "form#werte table.info tbody"
-	NumberRegex                  = regexp.MustCompile("([-.,\\d]+)")
+	LoginFormQueryExpression     = "form:has(input[type=password])"
+	// FirmwareQueryExpression selects the firmware version in the footer of each page, e.g. "v10.2.0".
+	FirmwareQueryExpression = "#versionsNummer"
+
+	// ErrLoginRequired is returned if the ISG responds with a login page but no credentials are configured.
+	ErrLoginRequired = errors.New("ISG requires a login, but no username and password are configured")
+	// ErrLoginFailed is returned if the ISG still responds with a login page after logging in.
+	ErrLoginFailed = errors.New("could not log in to ISG, check username and password")
 )
 
 func (p properties) findProperty(group, searchString string) Property {
@@ -47,68 +110,268 @@ func (p properties) findProperty(group, searchString string) Property {
 }
 
 // NewISGClient constructs a client for interacting with Stiebel Eltron ISG.
+// The session cookie of the ISG is kept in a cookie jar.
 func NewISGClient(options ClientOptions) (*ISGClient, error) {
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		return nil, err
+	}
 	return &ISGClient{
 		Options: options,
-		client:  http.Client{},
+		client:  http.Client{Jar: jar},
 	}, nil
 }
 
-func (c *ISGClient) ParsePage(urlPath string, properties []Property) ([]ParseError, error) {
+// ParsePage fetches the page at the given path and sets the values of the properties found in the page.
+// The request is aborted as soon as the context is cancelled.
+func (c *ISGClient) ParsePage(ctx context.Context, urlPath string, properties []Property) ([]ParseError, error) {
+	doc, err := c.fetchDocument(ctx, urlPath)
+	if err != nil {
+		return nil, err
+	}
+	return c.findValues(doc, properties, true), nil
+}
+
+// fetchDocument gets the page at the given path.
+// If the ISG responds with a login page, the client logs in and retries once.
+func (c *ISGClient) fetchDocument(ctx context.Context, urlPath string) (*goquery.Document, error) {
+	pageURL := fmt.Sprintf("%s/%s", c.Options.BaseURL, urlPath)
+	return c.fetch(ctx, pageURL, func() (*http.Request, error) {
+		return http.NewRequestWithContext(ctx, "GET", pageURL, nil)
+	})
+}
+
+// fetch sends the request returned by newRequest to the given URL.
+// If the ISG responds with a login page, the client logs in and sends a new request once.
+func (c *ISGClient) fetch(ctx context.Context, pageURL string, newRequest func() (*http.Request, error)) (*goquery.Document, error) {
+	logins := c.logins.Load()
+	doc, err := c.send(newRequest)
+	if err != nil {
+		return nil, err
+	}
+	loginForm := doc.Find(LoginFormQueryExpression).First()
+	if loginForm.Length() == 0 {
+		return doc, nil
+	}
+	if c.Options.Username == "" && c.Options.Password == "" {
+		return nil, ErrLoginRequired
+	}
+	if err := c.login(ctx, pageURL, loginForm, logins); err != nil {
+		return nil, err
+	}
+	doc, err = c.send(newRequest)
+	if err != nil {
+		return nil, err
+	}
+	if doc.Find(LoginFormQueryExpression).Length() > 0 {
+		return nil, ErrLoginFailed
+	}
+	return doc, nil
+}
 
-	req, err := http.NewRequest("GET", fmt.Sprintf("%s/%s", c.Options.BaseURL, urlPath), nil)
+func (c *ISGClient) send(newRequest func() (*http.Request, error)) (*goquery.Document, error) {
+	req, err := newRequest()
 	if err != nil {
 		return nil, err
 	}
-	req.Header = c.Options.Headers
+	return c.do(req)
+}
 
+// do sends the request and parses the response.
+// Server errors are returned as error, other responses are parsed as they may be login pages.
+func (c *ISGClient) do(req *http.Request) (*goquery.Document, error) {
+	if c.Options.Headers != nil {
+		// The client adds the session cookie to the request headers, so they must not be shared between requests.
+		for key, values := range c.Options.Headers {
+			req.Header[key] = values
+		}
+	}
 	resp, err := c.client.Do(req)
 	if err != nil {
 		return nil, err
 	}
-	doc, err := goquery.NewDocumentFromReader(resp.Body)
+	defer resp.Body.Close()
+	if resp.StatusCode >= http.StatusInternalServerError {
+		return nil, fmt.Errorf("ISG responded with %s", resp.Status)
+	}
+	return goquery.NewDocumentFromReader(resp.Body)
+}
+
+// login submits the given login form with the configured credentials.
+// The hidden fields of the form are submitted as well.
+// The ISG keeps a single session only, so each login invalidates the previous one.
+// Hence, if another request logged in since the given count of logins was taken, the session of that login is used instead.
+func (c *ISGClient) login(ctx context.Context, pageURL string, form *goquery.Selection, logins uint64) error {
+	c.loginMu.Lock()
+	defer c.loginMu.Unlock()
+	if c.logins.Load() != logins {
+		return nil
+	}
+
+	action, err := url.Parse(pageURL)
+	if err != nil {
+		return err
+	}
+	if attr, exists := form.Attr("action"); exists && attr != "" && attr != "#" {
+		if action, err = action.Parse(attr); err != nil {
+			return err
+		}
+	}
+
+	values := url.Values{}
+	form.Find("input").Each(func(i int, input *goquery.Selection) {
+		name, _ := input.Attr("name")
+		if name == "" {
+			return
+		}
+		switch inputType, _ := input.Attr("type"); strings.ToLower(inputType) {
+		case "password":
+			values.Set(name, c.Options.Password)
+		case "", "text", "email":
+			values.Set(name, c.Options.Username)
+		case "submit", "button", "checkbox", "radio":
+			return
+		default:
+			value, _ := input.Attr("value")
+			values.Set(name, value)
+		}
+	})
+
+	req, err := http.NewRequestWithContext(ctx, "POST", action.String(), strings.NewReader(values.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if _, err := c.do(req); err != nil {
+		return fmt.Errorf("could not log in to ISG: %w", err)
+	}
+	c.logins.Add(1)
+	return nil
+}
+
+// DiscoverPage works like ParsePage, but additionally returns all properties found in the page.
+// Properties of the page that aren't in the given list are not reported as ParseError.
+func (c *ISGClient) DiscoverPage(ctx context.Context, urlPath string, properties []Property) ([]DiscoveredProperty, []ParseError, error) {
+	doc, err := c.fetchDocument(ctx, urlPath)
+	if err != nil {
+		return nil, nil, err
+	}
+	return discoverProperties(doc, c.Options.NumberFormat), c.findValues(doc, properties, false), nil
+}
+
+// DiscoverDocument returns all properties found in the given HTML page, e.g. a page saved from the ISG web UI.
+// The values are parsed in the given format, like the ISGClient does.
+func DiscoverDocument(r io.Reader, format NumberFormat) ([]DiscoveredProperty, error) {
+	doc, err := goquery.NewDocumentFromReader(r)
+	if err != nil {
+		return nil, err
+	}
+	return discoverProperties(doc, format), nil
+}
+
+func discoverProperties(doc *goquery.Document, format NumberFormat) []DiscoveredProperty {
+	var discovered []DiscoveredProperty
+	eachPropertyRow(doc, func(group, key, cellText string) {
+		prop := DiscoveredProperty{Group: group, Name: key, RawText: cellText}
+		if quantity, err := format.ParseQuantity(cellText); err == nil {
+			prop.Value = quantity.Value
+			prop.Unit = quantity.Unit
+			prop.Numeric = true
+		}
+		discovered = append(discovered, prop)
+	})
+	return discovered
+}
+
+// FirmwareVersion fetches the page at the given path and returns the firmware version of the ISG shown in its footer,
+// e.g. "10.2.0".
+func (c *ISGClient) FirmwareVersion(ctx context.Context, urlPath string) (string, error) {
+	doc, err := c.fetchDocument(ctx, urlPath)
+	if err != nil {
+		return "", err
+	}
+	version := strings.TrimPrefix(strings.TrimSpace(doc.Find(FirmwareQueryExpression).First().Text()), "v")
+	if version == "" {
+		return "", fmt.Errorf("no firmware version found in page %s", urlPath)
+	}
+	return version, nil
+}
+
+// FindGroups fetches the page at the given path and returns the headers of all property tables, including empty ones.
+// The headers are in the language of the ISG web UI, e.g. "RUNTIME" or "LAUFZEIT".
+func (c *ISGClient) FindGroups(ctx context.Context, urlPath string) ([]string, error) {
+	doc, err := c.fetchDocument(ctx, urlPath)
 	if err != nil {
 		return nil, err
 	}
-	return c.findValues(doc, properties), nil
+	var groups []string
+	doc.Find(PropertyTableQueryExpression).Each(func(i int, selection *goquery.Selection) {
+		if group := strings.TrimSpace(selection.Find("th").Text()); group != "" {
+			groups = append(groups, group)
+		}
+	})
+	return groups, nil
 }
 
-func (c *ISGClient) findValues(doc *goquery.Document, properties properties) []ParseError {
-	var p []ParseError
+// eachPropertyRow calls fn for each row of the property tables in the document.
+func eachPropertyRow(doc *goquery.Document, fn func(group, key, cellText string)) {
 	doc.Find(PropertyTableQueryExpression).Each(func(i int, selection *goquery.Selection) {
 		group := selection.Find("th").Text()
 		selection.Find("tr.even,tr.odd").Each(func(i int, selection *goquery.Selection) {
 			key := selection.Find("td.key").Text()
+			cellText := strings.TrimSpace(selection.Find("td.value").Text())
+			fn(group, key, cellText)
+		})
+	})
+}
 
-			property := properties.findProperty(group, key)
-			if property == nil {
+func (c *ISGClient) findValues(doc *goquery.Document, properties properties, reportUnknown bool) []ParseError {
+	var p []ParseError
+	eachPropertyRow(doc, func(group, key, cellText string) {
+		property := properties.findProperty(group, key)
+		if property == nil {
+			if reportUnknown {
 				p = append(p, ParseError{
 					Error: fmt.Errorf("property found in document but not processed: %s/%s", group, key),
 				})
-				return
 			}
+			return
+		}
 
-			cellText := strings.TrimSpace(selection.Find("td.value").Text())
-			parsed, err := c.findNumericValueInCell(cellText)
-			if err != nil {
+		if textProperty, isText := property.(TextProperty); isText && textProperty.IsText() {
+			if err := textProperty.SetText(cellText); err != nil {
 				p = append(p, ParseError{
 					Property: property,
 					RawText:  cellText,
 					Error:    err,
 				})
 			}
-			property.SetValue(parsed)
-		})
+			return
+		}
+		parsed, err := c.parseValue(property, cellText)
+		if err != nil {
+			p = append(p, ParseError{
+				Property: property,
+				RawText:  cellText,
+				Error:    err,
+			})
+			return
+		}
+		property.SetValue(parsed)
 	})
 	return p
 }
 
-func (c *ISGClient) findNumericValueInCell(str string) (float64, error) {
-	res := NumberRegex.FindAllStringSubmatch(str, -1)
-	if len(res) == 0 {
-		return 0, fmt.Errorf("could not find a match: " + NumberRegex.String())
+// parseValue returns the number in the given cell text.
+// If the property is a UnitProperty, the number is converted from the displayed unit into the unit of the property.
+func (c *ISGClient) parseValue(property Property, cellText string) (float64, error) {
+	quantity, err := c.Options.NumberFormat.ParseQuantity(cellText)
+	if err != nil {
+		return 0, err
+	}
+	unitProperty, hasUnit := property.(UnitProperty)
+	if !hasUnit || unitProperty.GetUnit() == "" {
+		return quantity.Value, nil
 	}
-	match := res[0]
-	replacedComma := strings.ReplaceAll(match[1], ",", ".")
-	return strconv.ParseFloat(replacedComma, 64)
+	return ConvertUnit(quantity.Value, quantity.Unit, unitProperty.GetUnit())
 }
@@ -1,9 +1,15 @@
 package stiebeleltron
 
 import (
+	"context"
 	"net/http"
+	"net/http/cookiejar"
 	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -40,7 +46,242 @@ func TestISGClient_ParsePage(t *testing.T) {
 		group:        "RUNTIME",
 		searchString: "RNT COMP 1 DHW",
 	}
-	_, err = client.ParsePage("/heatpumpinfo_1.html", []Property{prop})
+	_, err = client.ParsePage(context.Background(), "/heatpumpinfo_1.html", []Property{prop})
 	require.NoError(t, err)
 	assert.Equal(t, float64(1771), prop.value)
 }
+
+func TestISGClient_ParsePage_GivenSlowServer_WhenContextTimesOut_ThenAbortRequest(t *testing.T) {
+	cancelled := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+			close(cancelled)
+		case <-time.After(10 * time.Second):
+		}
+	}))
+	defer server.Close()
+
+	client, err := NewISGClient(ClientOptions{BaseURL: server.URL})
+	require.NoError(t, err)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	_, err = client.ParsePage(ctx, "/heatpumpinfo_1.html", []Property{})
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Less(t, time.Since(start), time.Second)
+	select {
+	case <-cancelled:
+	case <-time.After(time.Second):
+		assert.Fail(t, "request has not been cancelled on the server side")
+	}
+}
+
+// newLoginServer returns a stand-in for a password-protected ISG.
+// Requests without a valid session cookie get the login page.
+// Like the ISG, it keeps a single session only, so each login invalidates the previous session.
+func newLoginServer(t *testing.T, sessions *int) *httptest.Server {
+	loginPage := `<html><body><form method="post" action="/?s=0">
+<input type="hidden" name="make" value="send"/>
+<input type="text" name="user"/>
+<input type="password" name="pass"/>
+<input type="submit" value="LOGIN"/>
+</form></body></html>`
+	session := ""
+	mu := sync.Mutex{}
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if r.Method == http.MethodPost {
+			require.NoError(t, r.ParseForm())
+			assert.Equal(t, "send", r.PostForm.Get("make"))
+			if r.PostForm.Get("user") == "admin" && r.PostForm.Get("pass") == "secret" {
+				*sessions++
+				session = strconv.Itoa(*sessions)
+				http.SetCookie(w, &http.Cookie{Name: "PHPSESSID", Value: session})
+			}
+			_, _ = w.Write([]byte(loginPage))
+			return
+		}
+		if cookie, err := r.Cookie("PHPSESSID"); err != nil || cookie.Value != session {
+			_, _ = w.Write([]byte(loginPage))
+			return
+		}
+		http.ServeFile(w, r, "testdata/heatpumpinfo_1.html")
+	}))
+}
+
+func TestISGClient_ParsePage_Login(t *testing.T) {
+	tests := []struct {
+		name          string
+		username      string
+		password      string
+		expireSession bool
+		expectedErr   error
+		expectedLogin int
+	}{
+		{
+			name:          "GivenNoCredentials_WhenLoginPage_ThenReturnError",
+			expectedErr:   ErrLoginRequired,
+			expectedLogin: 0,
+		},
+		{
+			name:          "GivenWrongCredentials_WhenLoginPage_ThenReturnError",
+			username:      "admin",
+			password:      "wrong",
+			expectedErr:   ErrLoginFailed,
+			expectedLogin: 0,
+		},
+		{
+			name:          "GivenCredentials_WhenLoginPage_ThenLoginAndReuseSession",
+			username:      "admin",
+			password:      "secret",
+			expectedLogin: 1,
+		},
+		{
+			name:          "GivenCredentials_WhenSessionExpired_ThenLoginAgain",
+			username:      "admin",
+			password:      "secret",
+			expireSession: true,
+			expectedLogin: 2,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sessions := 0
+			server := newLoginServer(t, &sessions)
+			defer server.Close()
+			client, err := NewISGClient(ClientOptions{
+				BaseURL:  server.URL,
+				Username: tt.username,
+				Password: tt.password,
+			})
+			require.NoError(t, err)
+
+			for i := 0; i < 2; i++ {
+				if tt.expireSession {
+					client.client.Jar, _ = cookiejar.New(nil)
+				}
+				prop := &stubProperty{group: "RUNTIME", searchString: "RNT COMP 1 DHW"}
+				_, err = client.ParsePage(context.Background(), "?s=1,1", []Property{prop})
+				if tt.expectedErr != nil {
+					assert.ErrorIs(t, err, tt.expectedErr)
+					continue
+				}
+				require.NoError(t, err)
+				assert.Equal(t, float64(1771), prop.value)
+			}
+			assert.Equal(t, tt.expectedLogin, sessions)
+		})
+	}
+}
+
+func TestISGClient_ParsePage_GivenConcurrentPages_WhenLoginPage_ThenLoginOnce(t *testing.T) {
+	sessions := 0
+	server := newLoginServer(t, &sessions)
+	defer server.Close()
+	client, err := NewISGClient(ClientOptions{BaseURL: server.URL, Username: "admin", Password: "secret"})
+	require.NoError(t, err)
+
+	wg := sync.WaitGroup{}
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			prop := &stubProperty{group: "RUNTIME", searchString: "RNT COMP 1 DHW"}
+			_, err := client.ParsePage(context.Background(), "?s=1,1", []Property{prop})
+			assert.NoError(t, err)
+			assert.Equal(t, float64(1771), prop.value)
+		}()
+	}
+	wg.Wait()
+
+	assert.Equal(t, 1, sessions, "each login invalidates the session of the previous one")
+}
+
+func TestISGClient_FirmwareVersion(t *testing.T) {
+	server := httptest.NewServer(http.FileServer(http.Dir("testdata")))
+	defer server.Close()
+	client, err := NewISGClient(ClientOptions{BaseURL: server.URL})
+	require.NoError(t, err)
+
+	version, err := client.FirmwareVersion(context.Background(), "/systeminfo_1.html")
+	require.NoError(t, err)
+	assert.Equal(t, "10.2.0", version)
+
+	_, err = client.FirmwareVersion(context.Background(), "/status_1.html")
+	assert.EqualError(t, err, "no firmware version found in page /status_1.html")
+}
+
+func TestISGClient_FindGroups(t *testing.T) {
+	server := httptest.NewServer(http.FileServer(http.Dir("testdata")))
+	defer server.Close()
+
+	client, err := NewISGClient(ClientOptions{BaseURL: server.URL})
+	require.NoError(t, err)
+	groups, err := client.FindGroups(context.Background(), "/systeminfo_1.html")
+	require.NoError(t, err)
+	assert.Equal(t, []string{
+		"ROOM TEMPERATURE", "HEATING", "DHW", "ENERGY MANAGEMENT", "ELECTRIC REHEATING", "GENERAL",
+	}, groups)
+}
+
+type stubUnitProperty struct {
+	stubProperty
+	unit string
+}
+
+func (t stubUnitProperty) GetUnit() string {
+	return t.unit
+}
+
+func TestISGClient_ParsePage_GivenUnitProperty(t *testing.T) {
+	server := httptest.NewServer(http.FileServer(http.Dir("testdata")))
+	defer server.Close()
+	client, err := NewISGClient(ClientOptions{BaseURL: server.URL})
+	require.NoError(t, err)
+
+	energy := &stubUnitProperty{stubProperty: stubProperty{group: "AMOUNT OF HEAT", searchString: "COMPRESSOR HEATING TOTAL"}, unit: "joules"}
+	mismatch := &stubUnitProperty{stubProperty: stubProperty{group: "RUNTIME", searchString: "RNT COMP 1 DHW"}, unit: "joules"}
+	parseErrors, err := client.ParsePage(context.Background(), "/heatpumpinfo_1.html", []Property{energy, mismatch})
+	require.NoError(t, err)
+
+	assert.InDelta(t, 56.97*3.6e9, energy.value, 1)
+	var mismatchErrors []ParseError
+	for _, parseError := range parseErrors {
+		if parseError.Property != nil {
+			mismatchErrors = append(mismatchErrors, parseError)
+		}
+	}
+	require.Len(t, mismatchErrors, 1)
+	assert.Equal(t, mismatch, mismatchErrors[0].Property)
+	assert.Equal(t, "1771 h", mismatchErrors[0].RawText)
+	assert.EqualError(t, mismatchErrors[0].Error, "unit mismatch: h (time) can't be converted into joules (energy)")
+}
+
+func TestDiscoverDocument_GivenNumberFormat_ThenParseValuesInFormat(t *testing.T) {
+	page := `<html><body><form id="werte"><table class="info"><tbody>
+<tr><th>AMOUNT OF HEAT</th></tr>
+<tr class="even"><td class="key">COMPRESSOR HEATING TOTAL</td><td class="value">1,234.5 kWh</td></tr>
+</tbody></table></form></body></html>`
+	tests := []struct {
+		name     string
+		format   NumberFormat
+		numeric  bool
+		expected float64
+	}{
+		{name: "GivenDefaultFormat_ThenDontParseValue", format: DefaultNumberFormat},
+		{name: "GivenDotAsDecimalSeparator_ThenParseValue", format: NumberFormat{DecimalSeparator: ".", GroupingSeparator: ","},
+			numeric: true, expected: 1234.5},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			props, err := DiscoverDocument(strings.NewReader(page), tt.format)
+			require.NoError(t, err)
+			require.Len(t, props, 1)
+			assert.Equal(t, tt.numeric, props[0].Numeric)
+			assert.Equal(t, tt.expected, props[0].Value)
+		})
+	}
+}
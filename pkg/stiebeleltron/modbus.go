@@ -0,0 +1,218 @@
+package stiebeleltron
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+type (
+	// ModbusClient reads the input and holding registers of the ISG via Modbus TCP.
+	ModbusClient struct {
+		Options       ModbusOptions
+		mu            sync.Mutex
+		transactionID uint16
+	}
+	ModbusOptions struct {
+		// Address is the host and port of the Modbus TCP server, e.g. "isg:502".
+		Address string
+		UnitID  byte
+	}
+	// RegisterProperty is a Property whose value is read from a Modbus register.
+	RegisterProperty interface {
+		Property
+		// GetRegister returns the 1-based register number as listed in the Modbus documentation of the ISG.
+		GetRegister() uint16
+		GetRegisterType() RegisterType
+		GetDataType() DataType
+	}
+	RegisterType string
+	DataType     string
+	// ModbusException is returned if the server responds with a Modbus exception code.
+	ModbusException struct {
+		FunctionCode  byte
+		ExceptionCode byte
+	}
+)
+
+const (
+	InputRegister   RegisterType = "input"
+	HoldingRegister RegisterType = "holding"
+
+	Int16  DataType = "int16"
+	Uint16 DataType = "uint16"
+
+	readHoldingRegisters byte = 0x03
+	readInputRegisters   byte = 0x04
+	// notAvailable is the value of signed registers for which the ISG has no value, e.g. an unconnected sensor.
+	notAvailable int16 = -32768
+)
+
+var (
+	DefaultModbusPort    = 502
+	DefaultModbusTimeout = 5 * time.Second
+)
+
+// NewModbusClient constructs a client for reading registers of Stiebel Eltron ISG.
+func NewModbusClient(options ModbusOptions) (*ModbusClient, error) {
+	if options.Address == "" {
+		return nil, fmt.Errorf("modbus address cannot be empty")
+	}
+	return &ModbusClient{Options: options}, nil
+}
+
+// ParsePage reads the registers of the given properties and sets their values.
+// The page name is only used for error messages, as Modbus doesn't know pages.
+// Properties that aren't a RegisterProperty or whose register has no value are returned as ParseError.
+func (c *ModbusClient) ParsePage(ctx context.Context, page string, properties []Property) ([]ParseError, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	dialer := net.Dialer{Timeout: DefaultModbusTimeout}
+	conn, err := dialer.DialContext(ctx, "tcp", c.Options.Address)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	deadline, hasDeadline := ctx.Deadline()
+	if !hasDeadline {
+		deadline = time.Now().Add(DefaultModbusTimeout)
+	}
+	if err := conn.SetDeadline(deadline); err != nil {
+		return nil, err
+	}
+	// Unblock pending reads if the context is cancelled before its deadline.
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			_ = conn.SetDeadline(time.Now())
+		case <-stop:
+		}
+	}()
+
+	var parseErrors []ParseError
+	for _, prop := range properties {
+		registerProp, ok := prop.(RegisterProperty)
+		if !ok || registerProp.GetRegister() == 0 {
+			parseErrors = append(parseErrors, ParseError{
+				Property: prop,
+				Error:    fmt.Errorf("property has no register defined in page %s: %s", page, prop.GetSearchString()),
+			})
+			continue
+		}
+		functionCode, err := registerProp.GetRegisterType().functionCode()
+		if err != nil {
+			parseErrors = append(parseErrors, ParseError{Property: prop, Error: err})
+			continue
+		}
+		raw, err := c.readRegister(conn, functionCode, registerProp.GetRegister())
+		if err != nil {
+			if _, isException := err.(*ModbusException); isException {
+				parseErrors = append(parseErrors, ParseError{Property: prop, Error: err})
+				continue
+			}
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			return nil, err
+		}
+		value, err := convertRegister(raw, registerProp.GetDataType())
+		if err != nil {
+			parseErrors = append(parseErrors, ParseError{
+				Property: prop,
+				RawText:  fmt.Sprintf("0x%04x", raw),
+				Error:    err,
+			})
+			continue
+		}
+		prop.SetValue(value)
+	}
+	return parseErrors, nil
+}
+
+func (c *ModbusClient) readRegister(conn io.ReadWriter, functionCode byte, register uint16) (uint16, error) {
+	c.transactionID++
+	req := make([]byte, 12)
+	binary.BigEndian.PutUint16(req[0:], c.transactionID)
+	binary.BigEndian.PutUint16(req[2:], 0) // protocol identifier
+	binary.BigEndian.PutUint16(req[4:], 6) // length of the remaining bytes
+	req[6] = c.Options.UnitID
+	req[7] = functionCode
+	binary.BigEndian.PutUint16(req[8:], register-1)
+	binary.BigEndian.PutUint16(req[10:], 1) // quantity of registers
+	if _, err := conn.Write(req); err != nil {
+		return 0, err
+	}
+
+	header := make([]byte, 7)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return 0, err
+	}
+	if id := binary.BigEndian.Uint16(header[0:]); id != c.transactionID {
+		return 0, fmt.Errorf("unexpected modbus transaction id %d, expected %d", id, c.transactionID)
+	}
+	length := binary.BigEndian.Uint16(header[4:])
+	if length < 3 || length > 256 {
+		return 0, fmt.Errorf("invalid modbus response length: %d", length)
+	}
+	pdu := make([]byte, length-1)
+	if _, err := io.ReadFull(conn, pdu); err != nil {
+		return 0, err
+	}
+	if pdu[0] == functionCode|0x80 {
+		return 0, &ModbusException{FunctionCode: functionCode, ExceptionCode: pdu[1]}
+	}
+	if pdu[0] != functionCode || pdu[1] != 2 || len(pdu) < 4 {
+		return 0, fmt.Errorf("invalid modbus response for function code %d", functionCode)
+	}
+	return binary.BigEndian.Uint16(pdu[2:]), nil
+}
+
+// Validate returns an error if the register type isn't supported.
+func (t RegisterType) Validate() error {
+	_, err := t.functionCode()
+	return err
+}
+
+// Validate returns an error if the data type isn't supported.
+func (d DataType) Validate() error {
+	switch d {
+	case "", Int16, Uint16:
+		return nil
+	}
+	return fmt.Errorf("unsupported data type: %s", d)
+}
+
+func (t RegisterType) functionCode() (byte, error) {
+	switch t {
+	case "", InputRegister:
+		return readInputRegisters, nil
+	case HoldingRegister:
+		return readHoldingRegisters, nil
+	}
+	return 0, fmt.Errorf("unsupported register type: %s", t)
+}
+
+func convertRegister(raw uint16, dataType DataType) (float64, error) {
+	switch dataType {
+	case "", Int16:
+		v := int16(raw)
+		if v == notAvailable {
+			return 0, fmt.Errorf("register has no value")
+		}
+		return float64(v), nil
+	case Uint16:
+		return float64(raw), nil
+	}
+	return 0, dataType.Validate()
+}
+
+func (e *ModbusException) Error() string {
+	return fmt.Sprintf("modbus exception %d for function code %d", e.ExceptionCode, e.FunctionCode)
+}
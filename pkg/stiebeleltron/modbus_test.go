@@ -0,0 +1,164 @@
+package stiebeleltron
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type stubRegisterProperty struct {
+	stubProperty
+	register     uint16
+	registerType RegisterType
+	dataType     DataType
+}
+
+func (s *stubRegisterProperty) GetRegister() uint16 {
+	return s.register
+}
+
+func (s *stubRegisterProperty) GetRegisterType() RegisterType {
+	return s.registerType
+}
+
+func (s *stubRegisterProperty) GetDataType() DataType {
+	return s.dataType
+}
+
+// newModbusServer starts an in-process Modbus TCP server stub that serves the given registers.
+// The maps are keyed by the 0-based register address.
+// Unknown registers are answered with the exception "illegal data address".
+func newModbusServer(t *testing.T, inputRegisters, holdingRegisters map[uint16]uint16) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				for {
+					req := make([]byte, 12)
+					if _, err := io.ReadFull(conn, req); err != nil {
+						return
+					}
+					registers := inputRegisters
+					if req[7] == readHoldingRegisters {
+						registers = holdingRegisters
+					}
+					resp := make([]byte, 11)
+					copy(resp, req[:7])
+					value, exists := registers[binary.BigEndian.Uint16(req[8:])]
+					if !exists {
+						binary.BigEndian.PutUint16(resp[4:], 3)
+						resp[7] = req[7] | 0x80
+						resp[8] = 0x02
+						resp = resp[:9]
+					} else {
+						binary.BigEndian.PutUint16(resp[4:], 5)
+						resp[7] = req[7]
+						resp[8] = 2
+						binary.BigEndian.PutUint16(resp[9:], value)
+					}
+					if _, err := conn.Write(resp); err != nil {
+						return
+					}
+				}
+			}(conn)
+		}
+	}()
+	return listener.Addr().String()
+}
+
+func TestModbusClient_ParsePage(t *testing.T) {
+	address := newModbusServer(t,
+		map[uint16]uint16{
+			500: 215,
+			501: 0xff9c, // -100
+			502: 0x8000, // not available
+		},
+		map[uint16]uint16{
+			1500: 0xff9c,
+		},
+	)
+	client, err := NewModbusClient(ModbusOptions{Address: address, UnitID: 1})
+	require.NoError(t, err)
+
+	tests := []struct {
+		name          string
+		property      *stubRegisterProperty
+		expectedValue float64
+		expectedError string
+	}{
+		{
+			name:          "GivenInputRegister_ThenReadValue",
+			property:      &stubRegisterProperty{register: 501},
+			expectedValue: 215,
+		},
+		{
+			name:          "GivenNegativeValue_WhenInt16_ThenReadSignedValue",
+			property:      &stubRegisterProperty{register: 502, dataType: Int16},
+			expectedValue: -100,
+		},
+		{
+			name:          "GivenNegativeValue_WhenUint16_ThenReadUnsignedValue",
+			property:      &stubRegisterProperty{register: 502, dataType: Uint16},
+			expectedValue: 65436,
+		},
+		{
+			name:          "GivenHoldingRegister_ThenReadValue",
+			property:      &stubRegisterProperty{register: 1501, registerType: HoldingRegister},
+			expectedValue: -100,
+		},
+		{
+			name:          "GivenUnavailableValue_ThenReturnParseError",
+			property:      &stubRegisterProperty{register: 503},
+			expectedError: "register has no value",
+		},
+		{
+			name:          "GivenUnknownRegister_ThenReturnParseError",
+			property:      &stubRegisterProperty{register: 999},
+			expectedError: "modbus exception 2 for function code 4",
+		},
+		{
+			name:          "GivenNoRegister_ThenReturnParseError",
+			property:      &stubRegisterProperty{},
+			expectedError: "property has no register defined",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			parseErrors, err := client.ParsePage(context.Background(), "modbus", []Property{tt.property})
+			require.NoError(t, err)
+			if tt.expectedError != "" {
+				require.Len(t, parseErrors, 1)
+				assert.ErrorContains(t, parseErrors[0].Error, tt.expectedError)
+				return
+			}
+			assert.Empty(t, parseErrors)
+			assert.Equal(t, tt.expectedValue, tt.property.value)
+		})
+	}
+}
+
+func TestModbusClient_ParsePage_GivenMultipleProperties_ThenReadAllValues(t *testing.T) {
+	address := newModbusServer(t, map[uint16]uint16{0: 1, 1: 2, 2: 3}, nil)
+	client, err := NewModbusClient(ModbusOptions{Address: address})
+	require.NoError(t, err)
+
+	props := []*stubRegisterProperty{{register: 1}, {register: 2}, {register: 3}}
+	parseErrors, err := client.ParsePage(context.Background(), "modbus", []Property{props[0], props[1], props[2]})
+	require.NoError(t, err)
+	assert.Empty(t, parseErrors)
+	for i, prop := range props {
+		assert.Equal(t, float64(i+1), prop.value)
+	}
+}
@@ -0,0 +1,150 @@
+package stiebeleltron
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+type (
+	// NumberFormat describes how numbers are displayed in the ISG web UI.
+	NumberFormat struct {
+		// DecimalSeparator separates the fractional part, e.g. "," in "21,5".
+		DecimalSeparator string
+		// GroupingSeparator separates groups of thousands, e.g. "." in "1.234".
+		GroupingSeparator string
+	}
+	// Quantity is a number with its unit as displayed in the ISG web UI, e.g. "21,145 kWh".
+	Quantity struct {
+		Value float64
+		// Unit is the text after the number, empty if there is none.
+		Unit string
+	}
+	// unit is a unit of measurement that values can be converted from and into.
+	unit struct {
+		dimension string
+		// factor converts a value of this unit into the base unit of the dimension.
+		factor float64
+	}
+)
+
+// DefaultNumberFormat is the format of numbers in the ISG web UI, regardless of its language.
+var DefaultNumberFormat = NumberFormat{DecimalSeparator: ",", GroupingSeparator: "."}
+
+var (
+	quantityRegex = regexp.MustCompile(`^([-+]?[\d.,]*\d)(.*)$`)
+
+	// units are the units displayed by the ISG and the base units that they are normalized to.
+	// The base units are named after the Prometheus naming conventions.
+	units = map[string]unit{
+		"°C":      {dimension: "temperature", factor: 1},
+		"celsius": {dimension: "temperature", factor: 1},
+
+		"K":      {dimension: "temperature difference", factor: 1},
+		"kelvin": {dimension: "temperature difference", factor: 1},
+
+		"bar":     {dimension: "pressure", factor: 1e5},
+		"pascals": {dimension: "pressure", factor: 1},
+
+		"l/min":                   {dimension: "volume flow", factor: 1e-3 / 60},
+		"l/s":                     {dimension: "volume flow", factor: 1e-3},
+		"cubic_meters_per_second": {dimension: "volume flow", factor: 1},
+
+		"Wh":     {dimension: "energy", factor: 3600},
+		"kWh":    {dimension: "energy", factor: 3.6e6},
+		"MWh":    {dimension: "energy", factor: 3.6e9},
+		"joules": {dimension: "energy", factor: 1},
+
+		"s":       {dimension: "time", factor: 1},
+		"min":     {dimension: "time", factor: 60},
+		"h":       {dimension: "time", factor: 3600},
+		"seconds": {dimension: "time", factor: 1},
+
+		"%":     {dimension: "ratio", factor: 0.01},
+		"ratio": {dimension: "ratio", factor: 1},
+	}
+)
+
+// ParseQuantity parses the number at the beginning of the given text and the unit after it.
+// Grouping separators are only accepted between groups of three digits, so that a number in an unexpected format is
+// reported as error instead of being misread by a factor of 1000.
+func (f NumberFormat) ParseQuantity(text string) (Quantity, error) {
+	text = strings.TrimSpace(text)
+	match := quantityRegex.FindStringSubmatch(text)
+	if match == nil {
+		return Quantity{}, fmt.Errorf("could not find a number in %q", text)
+	}
+	value, err := f.parseNumber(strings.TrimSpace(match[1]))
+	if err != nil {
+		return Quantity{}, err
+	}
+	return Quantity{Value: value, Unit: strings.TrimSpace(match[2])}, nil
+}
+
+func (f NumberFormat) parseNumber(number string) (float64, error) {
+	if f.DecimalSeparator == "" {
+		f = DefaultNumberFormat
+	}
+	integer, fraction, hasFraction := strings.Cut(number, f.DecimalSeparator)
+	if hasFraction && (fraction == "" || strings.ContainsAny(fraction, f.DecimalSeparator+f.GroupingSeparator)) {
+		return 0, fmt.Errorf("invalid number %q: unexpected separator after decimal separator %q", number, f.DecimalSeparator)
+	}
+	sign := ""
+	if strings.HasPrefix(integer, "-") || strings.HasPrefix(integer, "+") {
+		sign, integer = integer[:1], integer[1:]
+	}
+	if f.GroupingSeparator != "" && strings.Contains(integer, f.GroupingSeparator) {
+		groups := strings.Split(integer, f.GroupingSeparator)
+		for i, group := range groups {
+			if (i == 0 && (len(group) == 0 || len(group) > 3)) || (i > 0 && len(group) != 3) {
+				return 0, fmt.Errorf("invalid number %q: digits not grouped by thousands with grouping separator %q", number, f.GroupingSeparator)
+			}
+		}
+		integer = strings.Join(groups, "")
+	}
+	normalized := sign + integer
+	if hasFraction {
+		normalized += "." + fraction
+	}
+	value, err := strconv.ParseFloat(normalized, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid number %q with decimal separator %q", number, f.DecimalSeparator)
+	}
+	return value, nil
+}
+
+// ConvertUnit converts the given value from the unit as displayed by the ISG into the given target unit.
+// It returns an error if either unit is unknown or the units are of different dimensions, e.g. kWh and bar.
+func ConvertUnit(value float64, from, to string) (float64, error) {
+	if from == to {
+		return value, nil
+	}
+	target, exists := units[to]
+	if !exists {
+		return 0, fmt.Errorf("unknown target unit %q, must be one of %s", to, strings.Join(KnownUnits(), ", "))
+	}
+	if from == "" {
+		return 0, errors.New("value has no unit, expected a unit convertible into " + to)
+	}
+	source, exists := units[from]
+	if !exists {
+		return 0, fmt.Errorf("unknown unit %q, expected a unit convertible into %s", from, to)
+	}
+	if source.dimension != target.dimension {
+		return 0, fmt.Errorf("unit mismatch: %s (%s) can't be converted into %s (%s)", from, source.dimension, to, target.dimension)
+	}
+	return value * source.factor / target.factor, nil
+}
+
+// KnownUnits returns the units that values can be converted from and into.
+func KnownUnits() []string {
+	names := make([]string, 0, len(units))
+	for name := range units {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,82 @@
+package stiebeleltron
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNumberFormat_ParseQuantity(t *testing.T) {
+	tests := []struct {
+		name          string
+		format        NumberFormat
+		text          string
+		expected      Quantity
+		expectedError string
+	}{
+		{name: "GivenTemperature_ThenParseDecimalComma", text: "-13,0 °C", expected: Quantity{Value: -13, Unit: "°C"}},
+		{name: "GivenEnergy_ThenParseFraction", text: "1,234 MWh", expected: Quantity{Value: 1.234, Unit: "MWh"}},
+		{name: "GivenGroupedThousands_ThenIgnoreGroupingSeparator", text: "1.234 kWh", expected: Quantity{Value: 1234, Unit: "kWh"}},
+		{name: "GivenGroupingAndDecimal_ThenParseBoth", text: "12.345,6 h", expected: Quantity{Value: 12345.6, Unit: "h"}},
+		{name: "GivenFlowRate_ThenParseUnitWithSlash", text: "0,4 l/min", expected: Quantity{Value: 0.4, Unit: "l/min"}},
+		{name: "GivenPercentage_ThenParseUnitWithoutSpace", text: "13%", expected: Quantity{Value: 13, Unit: "%"}},
+		{name: "GivenNoUnit_ThenReturnEmptyUnit", text: "1", expected: Quantity{Value: 1}},
+		{
+			name:     "GivenDecimalPoint_WhenFormatUsesPoint_ThenParseFraction",
+			format:   NumberFormat{DecimalSeparator: ".", GroupingSeparator: ","},
+			text:     "1,234.5 kWh",
+			expected: Quantity{Value: 1234.5, Unit: "kWh"},
+		},
+		{name: "GivenInvalidGrouping_ThenReturnError", text: "1.23 bar", expectedError: "digits not grouped by thousands"},
+		{name: "GivenTwoDecimalSeparators_ThenReturnError", text: "1,2,3 bar", expectedError: "unexpected separator after decimal separator"},
+		{name: "GivenText_ThenReturnError", text: "ON", expectedError: "could not find a number"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			format := tt.format
+			if format.DecimalSeparator == "" {
+				format = DefaultNumberFormat
+			}
+			result, err := format.ParseQuantity(tt.text)
+			if tt.expectedError != "" {
+				assert.ErrorContains(t, err, tt.expectedError)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.expected, result)
+		})
+	}
+}
+
+func TestConvertUnit(t *testing.T) {
+	tests := []struct {
+		name          string
+		value         float64
+		from, to      string
+		expected      float64
+		expectedError string
+	}{
+		{name: "GivenKWh_WhenJoules_ThenConvert", value: 21.145, from: "kWh", to: "joules", expected: 76.122e6},
+		{name: "GivenMWh_WhenJoules_ThenConvert", value: 12.617, from: "MWh", to: "joules", expected: 45.4212e9},
+		{name: "GivenHours_WhenSeconds_ThenConvert", value: 2, from: "h", to: "seconds", expected: 7200},
+		{name: "GivenBar_WhenPascals_ThenConvert", value: 1.23, from: "bar", to: "pascals", expected: 123000},
+		{name: "GivenLitersPerMinute_WhenLitersPerSecond_ThenConvert", value: 0.6, from: "l/min", to: "l/s", expected: 0.01},
+		{name: "GivenPercent_WhenRatio_ThenConvert", value: 13, from: "%", to: "ratio", expected: 0.13},
+		{name: "GivenSameUnit_ThenKeepValue", value: 21.6, from: "°C", to: "°C", expected: 21.6},
+		{name: "GivenOtherDimension_ThenReturnError", value: 1, from: "bar", to: "joules", expectedError: "unit mismatch: bar (pressure) can't be converted into joules (energy)"},
+		{name: "GivenNoUnit_ThenReturnError", value: 1, from: "", to: "joules", expectedError: "value has no unit"},
+		{name: "GivenUnknownUnit_ThenReturnError", value: 1, from: "GJ", to: "joules", expectedError: `unknown unit "GJ"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := ConvertUnit(tt.value, tt.from, tt.to)
+			if tt.expectedError != "" {
+				assert.ErrorContains(t, err, tt.expectedError)
+				return
+			}
+			require.NoError(t, err)
+			assert.InDelta(t, tt.expected, result, tt.expected*1e-9)
+		})
+	}
+}
@@ -0,0 +1,162 @@
+package stiebeleltron
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+type (
+	// Setting is a parameter of the ISG that can be changed like in the settings forms of the web UI,
+	// e.g. the DHW set temperature or the operating mode.
+	Setting struct {
+		// Name identifies the setting in the exporter, e.g. "dhw_set_temperature".
+		Name string `yaml:"name" json:"name"`
+		// ID is the name of the input field in the settings form of the web UI, e.g. "val22".
+		ID string `yaml:"id" json:"-"`
+		// Min and Max are the inclusive range of numeric values.
+		Min *float64 `yaml:"min,omitempty" json:"min,omitempty"`
+		Max *float64 `yaml:"max,omitempty" json:"max,omitempty"`
+		// Step is the increment of numeric values, e.g. 0.5. If 0, any value in the range is accepted.
+		Step float64 `yaml:"step,omitempty" json:"step,omitempty"`
+		// Options maps the choices of a setting with fixed values, e.g. "eco", to the values submitted by the web UI, e.g. "11".
+		// A setting has either options or a range.
+		Options map[string]string `yaml:"options,omitempty" json:"-"`
+	}
+	// SettingWriter changes settings of the ISG.
+	SettingWriter interface {
+		WriteSetting(ctx context.Context, setting Setting, value string) error
+	}
+	// settingValue is a changed input field as submitted by the settings forms of the web UI.
+	settingValue struct {
+		Name  string `json:"name"`
+		Value string `json:"value"`
+	}
+)
+
+// SettingsSavePath is the path that the settings forms of the web UI submit changed values to.
+var SettingsSavePath = "save.php"
+
+// SettingsSavedResponse is the response of the ISG to values that were saved.
+var SettingsSavedResponse = "success"
+
+// ErrInvalidSettingValue is returned if a value is out of range or not one of the options of a setting.
+var ErrInvalidSettingValue = errors.New("invalid value")
+
+// ErrSettingRejected is returned if the ISG doesn't confirm that a value was saved.
+var ErrSettingRejected = errors.New("rejected by ISG")
+
+// Verify returns an error if the setting can't be written, e.g. because it has neither options nor a range.
+func (s Setting) Verify() error {
+	if s.ID == "" {
+		return errors.New("id is required")
+	}
+	if len(s.Options) > 0 {
+		if s.Min != nil || s.Max != nil || s.Step != 0 {
+			return errors.New("options can't be combined with min, max or step")
+		}
+		return nil
+	}
+	if s.Min == nil || s.Max == nil {
+		return errors.New("min and max are required for settings without options")
+	}
+	if *s.Min > *s.Max {
+		return fmt.Errorf("min %v is greater than max %v", *s.Min, *s.Max)
+	}
+	if s.Step < 0 {
+		return fmt.Errorf("step %v is negative", s.Step)
+	}
+	return nil
+}
+
+// OptionNames returns the names of the options, sorted alphabetically.
+func (s Setting) OptionNames() []string {
+	names := make([]string, 0, len(s.Options))
+	for name := range s.Options {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Validate returns an error wrapping ErrInvalidSettingValue if the given value can't be written to the setting.
+// Numbers are expected with "." as decimal separator, options by their name, ignoring case.
+func (s Setting) Validate(value string) error {
+	_, err := s.rawValue(value, DefaultNumberFormat)
+	return err
+}
+
+// rawValue returns the value as submitted by the web UI.
+func (s Setting) rawValue(value string, format NumberFormat) (string, error) {
+	value = strings.TrimSpace(value)
+	if len(s.Options) > 0 {
+		for name, raw := range s.Options {
+			if strings.EqualFold(name, value) {
+				return raw, nil
+			}
+		}
+		return "", fmt.Errorf("%w %q for %s: must be one of %s", ErrInvalidSettingValue, value, s.Name, strings.Join(s.OptionNames(), ", "))
+	}
+	if s.Min == nil || s.Max == nil {
+		return "", fmt.Errorf("setting %s has no range", s.Name)
+	}
+	number, err := strconv.ParseFloat(value, 64)
+	if err != nil || math.IsNaN(number) || math.IsInf(number, 0) {
+		return "", fmt.Errorf("%w %q for %s: not a number", ErrInvalidSettingValue, value, s.Name)
+	}
+	if number < *s.Min || number > *s.Max {
+		return "", fmt.Errorf("%w %v for %s: must be between %v and %v", ErrInvalidSettingValue, number, s.Name, *s.Min, *s.Max)
+	}
+	if s.Step > 0 {
+		steps := (number - *s.Min) / s.Step
+		if math.Abs(steps-math.Round(steps)) > 1e-9 {
+			return "", fmt.Errorf("%w %v for %s: must be a multiple of %v", ErrInvalidSettingValue, number, s.Name, s.Step)
+		}
+	}
+	decimalSeparator := format.DecimalSeparator
+	if decimalSeparator == "" {
+		decimalSeparator = DefaultNumberFormat.DecimalSeparator
+	}
+	return strings.Replace(strconv.FormatFloat(number, 'f', -1, 64), ".", decimalSeparator, 1), nil
+}
+
+// WriteSetting validates the given value and submits it to the ISG like the settings forms of the web UI.
+// Numbers are submitted in the NumberFormat of the client.
+// If the ISG responds with anything else than SettingsSavedResponse, an ErrSettingRejected is returned.
+func (c *ISGClient) WriteSetting(ctx context.Context, setting Setting, value string) error {
+	raw, err := setting.rawValue(value, c.Options.NumberFormat)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal([]settingValue{{Name: setting.ID, Value: raw}})
+	if err != nil {
+		return err
+	}
+	body := url.Values{"data": {string(data)}}.Encode()
+	pageURL := fmt.Sprintf("%s/%s", c.Options.BaseURL, SettingsSavePath)
+	doc, err := c.fetch(ctx, pageURL, func() (*http.Request, error) {
+		req, err := http.NewRequestWithContext(ctx, "POST", pageURL, strings.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		return req, nil
+	})
+	if err != nil {
+		return fmt.Errorf("could not write setting %s: %w", setting.Name, err)
+	}
+	if response := strings.TrimSpace(doc.Text()); !strings.EqualFold(response, SettingsSavedResponse) {
+		if len(response) > 100 {
+			response = response[:100] + "..."
+		}
+		return fmt.Errorf("could not write setting %s: %w: %q", setting.Name, ErrSettingRejected, response)
+	}
+	return nil
+}
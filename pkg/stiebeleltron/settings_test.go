@@ -0,0 +1,235 @@
+package stiebeleltron
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func bound(f float64) *float64 {
+	return &f
+}
+
+var (
+	dhwSetTemperature = Setting{Name: "dhw_set_temperature", ID: "val22", Min: bound(10), Max: bound(65), Step: 0.5}
+	operatingMode     = Setting{Name: "operating_mode", ID: "val39s", Options: map[string]string{"eco": "11", "standby": "1"}}
+)
+
+// newSettingsServer returns a fake ISG that records the values submitted to the save path and responds with the given response.
+// Unless loggedIn is true, writes get the login page until the client logs in.
+func newSettingsServer(t *testing.T, loggedIn bool, response string, written *[]settingValue) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.NoError(t, r.ParseForm())
+		if r.PostForm.Get("pass") != "" {
+			loggedIn = r.PostForm.Get("pass") == "secret"
+			return
+		}
+		if !loggedIn {
+			_, _ = w.Write([]byte(`<html><body><form method="post"><input type="text" name="user"/><input type="password" name="pass"/></form></body></html>`))
+			return
+		}
+		assert.Equal(t, "/"+SettingsSavePath, r.URL.Path)
+		var values []settingValue
+		require.NoError(t, json.Unmarshal([]byte(r.PostForm.Get("data")), &values))
+		*written = append(*written, values...)
+		_, _ = w.Write([]byte(response))
+	}))
+}
+
+func TestSetting_Verify(t *testing.T) {
+	tests := []struct {
+		name        string
+		setting     Setting
+		expectedErr string
+	}{
+		{
+			name:    "GivenRange_ThenReturnNoError",
+			setting: dhwSetTemperature,
+		},
+		{
+			name:    "GivenOptions_ThenReturnNoError",
+			setting: operatingMode,
+		},
+		{
+			name:        "GivenNoID_ThenReturnError",
+			setting:     Setting{Name: "test", Min: bound(0), Max: bound(1)},
+			expectedErr: "id is required",
+		},
+		{
+			name:        "GivenNoRangeAndNoOptions_ThenReturnError",
+			setting:     Setting{Name: "test", ID: "val1", Max: bound(1)},
+			expectedErr: "min and max are required for settings without options",
+		},
+		{
+			name:        "GivenMinGreaterThanMax_ThenReturnError",
+			setting:     Setting{Name: "test", ID: "val1", Min: bound(2), Max: bound(1)},
+			expectedErr: "min 2 is greater than max 1",
+		},
+		{
+			name:        "GivenOptionsAndRange_ThenReturnError",
+			setting:     Setting{Name: "test", ID: "val1", Min: bound(0), Options: map[string]string{"on": "1"}},
+			expectedErr: "options can't be combined with min, max or step",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.setting.Verify()
+			if tt.expectedErr != "" {
+				assert.EqualError(t, err, tt.expectedErr)
+				return
+			}
+			assert.NoError(t, err)
+		})
+	}
+}
+
+func TestSetting_Validate(t *testing.T) {
+	tests := []struct {
+		name        string
+		setting     Setting
+		value       string
+		expectedErr string
+	}{
+		{
+			name:    "GivenNumberInRange_ThenReturnNoError",
+			setting: dhwSetTemperature,
+			value:   "47.5",
+		},
+		{
+			name:    "GivenOptionInOtherCase_ThenReturnNoError",
+			setting: operatingMode,
+			value:   "ECO",
+		},
+		{
+			name:        "GivenNumberBelowMin_ThenReturnError",
+			setting:     dhwSetTemperature,
+			value:       "5",
+			expectedErr: "invalid value 5 for dhw_set_temperature: must be between 10 and 65",
+		},
+		{
+			name:        "GivenNumberNotMultipleOfStep_ThenReturnError",
+			setting:     dhwSetTemperature,
+			value:       "47.3",
+			expectedErr: "invalid value 47.3 for dhw_set_temperature: must be a multiple of 0.5",
+		},
+		{
+			name:        "GivenText_WhenSettingIsNumeric_ThenReturnError",
+			setting:     dhwSetTemperature,
+			value:       "hot",
+			expectedErr: `invalid value "hot" for dhw_set_temperature: not a number`,
+		},
+		{
+			name:        "GivenUnknownOption_ThenReturnError",
+			setting:     operatingMode,
+			value:       "comfort",
+			expectedErr: `invalid value "comfort" for operating_mode: must be one of eco, standby`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.setting.Validate(tt.value)
+			if tt.expectedErr != "" {
+				assert.EqualError(t, err, tt.expectedErr)
+				assert.ErrorIs(t, err, ErrInvalidSettingValue)
+				return
+			}
+			assert.NoError(t, err)
+		})
+	}
+}
+
+func TestISGClient_WriteSetting(t *testing.T) {
+	tests := []struct {
+		name          string
+		setting       Setting
+		value         string
+		format        NumberFormat
+		loggedIn      bool
+		response      string
+		expectedValue []settingValue
+		expectedErr   error
+	}{
+		{
+			name:          "GivenNumber_ThenSubmitWithDecimalComma",
+			setting:       dhwSetTemperature,
+			value:         "47.5",
+			loggedIn:      true,
+			expectedValue: []settingValue{{Name: "val22", Value: "47,5"}},
+		},
+		{
+			name:          "GivenNumber_WhenDecimalPoint_ThenSubmitWithDecimalPoint",
+			setting:       dhwSetTemperature,
+			value:         "47.5",
+			format:        NumberFormat{DecimalSeparator: ".", GroupingSeparator: ","},
+			loggedIn:      true,
+			expectedValue: []settingValue{{Name: "val22", Value: "47.5"}},
+		},
+		{
+			name:          "GivenOption_ThenSubmitRawValue",
+			setting:       operatingMode,
+			value:         "eco",
+			loggedIn:      true,
+			expectedValue: []settingValue{{Name: "val39s", Value: "11"}},
+		},
+		{
+			name:          "GivenRejection_ThenReturnError",
+			setting:       operatingMode,
+			value:         "eco",
+			loggedIn:      true,
+			response:      "error",
+			expectedValue: []settingValue{{Name: "val39s", Value: "11"}},
+			expectedErr:   ErrSettingRejected,
+		},
+		{
+			name:          "GivenLoginPage_ThenLoginAndSubmit",
+			setting:       operatingMode,
+			value:         "standby",
+			expectedValue: []settingValue{{Name: "val39s", Value: "1"}},
+		},
+		{
+			name:        "GivenInvalidValue_ThenSubmitNothing",
+			setting:     dhwSetTemperature,
+			value:       "80",
+			loggedIn:    true,
+			expectedErr: ErrInvalidSettingValue,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var written []settingValue
+			response := tt.response
+			if response == "" {
+				response = SettingsSavedResponse
+			}
+			server := newSettingsServer(t, tt.loggedIn, response, &written)
+			defer server.Close()
+			client, err := NewISGClient(ClientOptions{BaseURL: server.URL, Username: "admin", Password: "secret", NumberFormat: tt.format})
+			require.NoError(t, err)
+
+			err = client.WriteSetting(context.Background(), tt.setting, tt.value)
+			if tt.expectedErr != nil {
+				assert.ErrorIs(t, err, tt.expectedErr)
+			} else {
+				assert.NoError(t, err)
+			}
+			assert.Equal(t, tt.expectedValue, written)
+		})
+	}
+}
+
+func TestISGClient_WriteSetting_GivenServerError_ThenReturnError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+	client, err := NewISGClient(ClientOptions{BaseURL: server.URL})
+	require.NoError(t, err)
+
+	err = client.WriteSetting(context.Background(), operatingMode, "eco")
+	assert.EqualError(t, err, "could not write setting operating_mode: ISG responded with 500 Internal Server Error")
+}
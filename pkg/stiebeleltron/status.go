@@ -0,0 +1,96 @@
+package stiebeleltron
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/PuerkitoBio/goquery"
+)
+
+// StatusParser reads the status indicators of the ISG status page, e.g. whether the compressor is running.
+// The status page shows these with icons instead of text, so the ISGClient can't parse them.
+// Each property is set to 1 if its indicator is shown as active, and 0 otherwise.
+// Properties are matched by the label of the icon or of the table row, the group is ignored.
+// The ISG hides the icons of inactive indicators, so a row without icon is inactive as well.
+// Properties whose label isn't in the page at all are reported as ParseError.
+type StatusParser struct {
+	client *ISGClient
+}
+
+var (
+	// StatusIconQueryExpression selects the icons of the status indicators.
+	StatusIconQueryExpression = "form#werte img"
+	// StatusLabelQueryExpression selects the labels of the status indicators that are shown in a table.
+	StatusLabelQueryExpression = "form#werte td.key"
+	// InactiveIconRegex matches the source of icons that show an inactive state, e.g. "aus.png" or "nhz_aus.png".
+	// The state has to be a separate word of the file name, so that e.g. "haus.png" is active.
+	InactiveIconRegex = regexp.MustCompile(`(?i)(^|[/_-])(aus|off|inaktiv|inactive)[._-]`)
+)
+
+// NewStatusParser returns a StatusParser that fetches the status page with the given client.
+func NewStatusParser(client *ISGClient) *StatusParser {
+	return &StatusParser{client: client}
+}
+
+// ParsePage implements PageParser.
+func (p *StatusParser) ParsePage(ctx context.Context, urlPath string, properties []Property) ([]ParseError, error) {
+	doc, err := p.client.fetchDocument(ctx, urlPath)
+	if err != nil {
+		return nil, err
+	}
+	indicators := findStatusIndicators(doc)
+	var parseErrors []ParseError
+	for _, property := range properties {
+		active, exists := indicators[strings.ToUpper(property.GetSearchString())]
+		if !exists {
+			parseErrors = append(parseErrors, ParseError{
+				Property: property,
+				Error:    fmt.Errorf("no status indicator found in page for property: %s", property.GetSearchString()),
+			})
+			continue
+		}
+		value := 0.0
+		if active {
+			value = 1
+		}
+		property.SetValue(value)
+	}
+	return parseErrors, nil
+}
+
+// findStatusIndicators returns whether each indicator in the document is active, keyed by its label in upper case.
+// Labels of rows without icon are inactive.
+func findStatusIndicators(doc *goquery.Document) map[string]bool {
+	indicators := map[string]bool{}
+	doc.Find(StatusLabelQueryExpression).Each(func(i int, key *goquery.Selection) {
+		if label := strings.TrimSpace(key.Text()); label != "" {
+			indicators[strings.ToUpper(label)] = false
+		}
+	})
+	doc.Find(StatusIconQueryExpression).Each(func(i int, icon *goquery.Selection) {
+		label := statusLabel(icon)
+		if label == "" {
+			return
+		}
+		src, _ := icon.Attr("src")
+		key := strings.ToUpper(label)
+		indicators[key] = indicators[key] || !InactiveIconRegex.MatchString(src)
+	})
+	return indicators
+}
+
+// statusLabel returns the title or alt text of the icon, or the text of the row that contains the icon.
+func statusLabel(icon *goquery.Selection) string {
+	for _, attr := range []string{"title", "alt"} {
+		if label, exists := icon.Attr(attr); exists && strings.TrimSpace(label) != "" {
+			return strings.TrimSpace(label)
+		}
+	}
+	row := icon.Closest("tr")
+	if key := strings.TrimSpace(row.Find("td.key").Text()); key != "" {
+		return key
+	}
+	return strings.TrimSpace(row.Text())
+}
@@ -0,0 +1,119 @@
+package stiebeleltron
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStatusParser_ParsePage(t *testing.T) {
+	server := httptest.NewServer(http.FileServer(http.Dir("testdata")))
+	defer server.Close()
+	client, err := NewISGClient(ClientOptions{BaseURL: server.URL})
+	require.NoError(t, err)
+	parser := NewStatusParser(client)
+
+	tests := []struct {
+		name     string
+		page     string
+		expected map[string]float64
+		// unmatched are properties without an indicator in the page.
+		unmatched []string
+	}{
+		{
+			name: "GivenIconsInTable_ThenUseRowLabels",
+			page: "/status_1.html",
+			expected: map[string]float64{
+				"COMPRESSOR":           1,
+				"HEATING CIRCUIT PUMP": 1,
+				"DHW CHARGING PUMP":    0,
+				"ELECTRIC REHEATING":   0,
+			},
+		},
+		{
+			name:     "GivenRowWithoutIcon_ThenReturnInactive",
+			page:     "/status_1.html",
+			expected: map[string]float64{"DEFROST": 0},
+		},
+		{
+			name: "GivenIconsWithTitles_ThenUseTitles",
+			page: "/status_2.html",
+			expected: map[string]float64{
+				"COMPRESSOR":         1,
+				"DEFROST":            1,
+				"ELECTRIC REHEATING": 0,
+			},
+		},
+		{
+			name:      "GivenPropertyWithoutIndicator_ThenReturnParseError",
+			page:      "/status_1.html",
+			expected:  map[string]float64{"COMPRESSOR": 1},
+			unmatched: []string{"BOOSTER HEATER"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			props := map[string]*stubProperty{}
+			list := make([]Property, 0, len(tt.expected)+len(tt.unmatched))
+			for label := range tt.expected {
+				props[label] = &stubProperty{searchString: label, value: -1}
+				list = append(list, props[label])
+			}
+			for _, label := range tt.unmatched {
+				props[label] = &stubProperty{searchString: label, value: -1}
+				list = append(list, props[label])
+			}
+			parseErrors, err := parser.ParsePage(context.Background(), tt.page, list)
+			require.NoError(t, err)
+			require.Len(t, parseErrors, len(tt.unmatched))
+			for i, label := range tt.unmatched {
+				assert.Equal(t, props[label], parseErrors[i].Property)
+				assert.Equal(t, float64(-1), props[label].value, label)
+			}
+			for label, expected := range tt.expected {
+				assert.Equal(t, expected, props[label].value, label)
+			}
+		})
+	}
+}
+
+func TestStatusParser_ParsePage_GivenPageWithoutIcons_ThenReturnZeroForRows(t *testing.T) {
+	server := httptest.NewServer(http.FileServer(http.Dir("testdata")))
+	defer server.Close()
+	client, err := NewISGClient(ClientOptions{BaseURL: server.URL})
+	require.NoError(t, err)
+
+	row := &stubProperty{searchString: "COMPRESSOR HEATING DAY", value: -1}
+	missing := &stubProperty{searchString: "COMPRESSOR", value: -1}
+	parseErrors, err := NewStatusParser(client).ParsePage(context.Background(), "/heatpumpinfo_1.html", []Property{row, missing})
+	require.NoError(t, err)
+	require.Len(t, parseErrors, 1)
+	assert.Equal(t, missing, parseErrors[0].Property)
+	assert.Equal(t, float64(0), row.value)
+	assert.Equal(t, float64(-1), missing.value)
+}
+
+func TestInactiveIconRegex(t *testing.T) {
+	tests := []struct {
+		src      string
+		inactive bool
+	}{
+		{src: "./pics/symbole/aus.png", inactive: true},
+		{src: "./pics/symbole/nhz_aus.png", inactive: true},
+		{src: "./pics/symbole/pump-off.gif", inactive: true},
+		{src: "INAKTIV.png", inactive: true},
+		{src: "./pics/symbole/ein.png"},
+		{src: "./pics/symbole/haus.png"},
+		{src: "./pics/symbole/pause.png"},
+		{src: "./pics/aus/verdichter.png"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.src, func(t *testing.T) {
+			assert.Equal(t, tt.inactive, InactiveIconRegex.MatchString(tt.src))
+		})
+	}
+}
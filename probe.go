@@ -0,0 +1,112 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ccremer/stiebeleltron-exporter/pkg/metrics"
+	"github.com/ccremer/stiebeleltron-exporter/pkg/stiebeleltron"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	log "github.com/sirupsen/logrus"
+)
+
+// probeHandler scrapes the ISG given in the "target" query parameter, similar to the blackbox exporter.
+// Only allowed targets are scraped, so that the exporter can't be abused as an open proxy.
+type probeHandler struct {
+	allowedTargets map[string]bool
+	props          []*metrics.Page
+	timeout        time.Duration
+	discovery      bool
+	newParsers     func(target string) (map[string]stiebeleltron.PageParser, error)
+
+	mu         sync.Mutex
+	collectors map[string]*metrics.Collector
+}
+
+func newProbeHandler(allowedTargets []string, props []*metrics.Page, timeout time.Duration, discovery bool,
+	newParsers func(target string) (map[string]stiebeleltron.PageParser, error)) *probeHandler {
+	allowed := make(map[string]bool, len(allowedTargets))
+	for _, target := range allowedTargets {
+		allowed[normalizeTarget(target)] = true
+	}
+	return &probeHandler{
+		allowedTargets: allowed,
+		props:          props,
+		timeout:        timeout,
+		discovery:      discovery,
+		newParsers:     newParsers,
+		collectors:     map[string]*metrics.Collector{},
+	}
+}
+
+func (h *probeHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	target := normalizeTarget(r.URL.Query().Get("target"))
+	probeLog := log.WithFields(log.Fields{
+		"uri":    r.RequestURI,
+		"client": r.RemoteAddr,
+		"target": target,
+	})
+	probeLog.Debug("Accessed Probe endpoint")
+	if target == "" {
+		http.Error(w, "target parameter is missing", http.StatusBadRequest)
+		return
+	}
+	if !h.allowedTargets[target] {
+		probeLog.Warn("Rejected probe of target that is not allowed")
+		http.Error(w, "target is not allowed", http.StatusForbidden)
+		return
+	}
+
+	collector, err := h.getCollector(target)
+	if err != nil {
+		probeLog.WithError(err).Error("Could not create client")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(collector)
+	promhttp.HandlerFor(registry, promhttp.HandlerOpts{}).ServeHTTP(w, r)
+}
+
+// getCollector returns the collector of the given target, creating it on the first probe.
+// Reusing the collector keeps the error counters of a target across probes.
+func (h *probeHandler) getCollector(target string) (*metrics.Collector, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if collector, exists := h.collectors[target]; exists {
+		return collector, nil
+	}
+	parsers, err := h.newParsers(target)
+	if err != nil {
+		return nil, err
+	}
+	collector := metrics.NewCollector(parsers, h.props, h.timeout)
+	if h.discovery {
+		collector.EnableDiscovery()
+	}
+	h.collectors[target] = collector
+	return collector, nil
+}
+
+// normalizeTarget returns the URL of the given target without trailing slash and with lowercase scheme and host.
+// Targets without scheme get "http://", so that e.g. "isg-a" and "http://isg-a/" are the same target.
+func normalizeTarget(target string) string {
+	target = strings.TrimSuffix(strings.TrimSpace(target), "/")
+	if target == "" {
+		return ""
+	}
+	if !strings.Contains(target, "://") {
+		target = "http://" + target
+	}
+	u, err := url.Parse(target)
+	if err != nil {
+		return target
+	}
+	u.Scheme = strings.ToLower(u.Scheme)
+	u.Host = strings.ToLower(u.Host)
+	return u.String()
+}
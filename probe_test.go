@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/ccremer/stiebeleltron-exporter/pkg/metrics"
+	"github.com/ccremer/stiebeleltron-exporter/pkg/stiebeleltron"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// stubParser sets a fixed value to all properties of a page.
+type stubParser struct {
+	value float64
+}
+
+func (p stubParser) ParsePage(_ context.Context, _ string, properties []stiebeleltron.Property) ([]stiebeleltron.ParseError, error) {
+	for _, prop := range properties {
+		prop.SetValue(p.value)
+	}
+	return nil, nil
+}
+
+func newTestProbeHandler(allowedTargets ...string) (*probeHandler, *[]string) {
+	metric := &metrics.PrometheusMetric{Group: "heating", GaugeName: "outside_temperature", HelpText: "help"}
+	metric.InitializeMetric()
+	pages := []*metrics.Page{{Name: "system", Path: "system", Type: "stub", Metrics: []*metrics.PrometheusMetric{metric}}}
+	var created []string
+	handler := newProbeHandler(allowedTargets, pages, time.Second, false, func(target string) (map[string]stiebeleltron.PageParser, error) {
+		created = append(created, target)
+		return map[string]stiebeleltron.PageParser{"stub": stubParser{value: 5}}, nil
+	})
+	return handler, &created
+}
+
+func TestProbeHandler_ServeHTTP(t *testing.T) {
+	tests := []struct {
+		name            string
+		allowedTargets  []string
+		target          string
+		expectedStatus  int
+		expectedBody    string
+		expectedTargets []string
+	}{
+		{
+			name:           "GivenNoTarget_ThenReturnBadRequest",
+			allowedTargets: []string{"http://isg-a"},
+			expectedStatus: http.StatusBadRequest,
+			expectedBody:   "target parameter is missing\n",
+		},
+		{
+			name:           "GivenTargetNotAllowed_ThenReturnForbidden",
+			allowedTargets: []string{"http://isg-a"},
+			target:         "http://isg-b",
+			expectedStatus: http.StatusForbidden,
+			expectedBody:   "target is not allowed\n",
+		},
+		{
+			name:            "GivenAllowedTarget_ThenReturnMetricsOfTarget",
+			allowedTargets:  []string{"http://isg-a"},
+			target:          "http://isg-a",
+			expectedStatus:  http.StatusOK,
+			expectedBody:    "stiebeleltron_heating_outside_temperature 5\n",
+			expectedTargets: []string{"http://isg-a"},
+		},
+		{
+			name:            "GivenTrailingSlash_ThenMatchTargetWithoutSlash",
+			allowedTargets:  []string{"http://isg-a/"},
+			target:          "http://isg-a/",
+			expectedStatus:  http.StatusOK,
+			expectedBody:    "stiebeleltron_heating_outside_temperature 5\n",
+			expectedTargets: []string{"http://isg-a"},
+		},
+		{
+			name:            "GivenTargetWithoutScheme_ThenMatchTargetWithHTTP",
+			allowedTargets:  []string{"http://isg-a"},
+			target:          "ISG-A",
+			expectedStatus:  http.StatusOK,
+			expectedBody:    "stiebeleltron_heating_outside_temperature 5\n",
+			expectedTargets: []string{"http://isg-a"},
+		},
+		{
+			name:           "GivenOtherScheme_ThenReturnForbidden",
+			allowedTargets: []string{"http://isg-a"},
+			target:         "https://isg-a",
+			expectedStatus: http.StatusForbidden,
+			expectedBody:   "target is not allowed\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler, created := newTestProbeHandler(tt.allowedTargets...)
+			req := httptest.NewRequest(http.MethodGet, "/probe", nil)
+			if tt.target != "" {
+				req.URL.RawQuery = "target=" + tt.target
+			}
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+
+			assert.Equal(t, tt.expectedStatus, rec.Code)
+			assert.Contains(t, rec.Body.String(), tt.expectedBody)
+			assert.Equal(t, tt.expectedTargets, *created)
+		})
+	}
+}
+
+func TestProbeHandler_ServeHTTP_GivenSameTarget_ThenReuseCollector(t *testing.T) {
+	handler, created := newTestProbeHandler("http://isg-a", "http://isg-b")
+
+	for _, target := range []string{"http://isg-a", "http://isg-a/", "isg-a", "http://isg-b"} {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/probe?target="+target, nil))
+		require.Equal(t, http.StatusOK, rec.Code, target)
+		assert.Contains(t, rec.Body.String(), "stiebeleltron_heating_outside_temperature 5", target)
+	}
+
+	assert.Equal(t, []string{"http://isg-a", "http://isg-b"}, *created)
+	assert.Len(t, handler.collectors, 2)
+}